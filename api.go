@@ -0,0 +1,1129 @@
+/*
+api.go is released under the MIT License <http://www.opensource.org/licenses/mit-license.php
+Copyright (C) ITsysCOM. All Rights Reserved.
+
+Provides FreeSWITCH socket communication.
+*/
+package fsock
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/text/encoding/ianaindex"
+)
+
+// ReplyError is the error reply of a command (eg: -ERR No such channel!), unwrapping to the matching typed error
+// (eg: ErrCallNotFound) if any. The usage replies of the api commands called with wrong arguments are errors as well.
+type ReplyError struct {
+	Reply string // as received, trimmed
+	Text  string // the FreeSWITCH error text, without the -ERR or -USAGE token
+	Cause string // the hangup cause of the failed originate (eg: NO_ANSWER), empty otherwise
+	Usage bool   // the usage of the command was returned
+}
+
+func (err *ReplyError) Error() string {
+	return err.Reply
+}
+
+func (err *ReplyError) Unwrap() error {
+	switch {
+	case strings.Contains(err.Text, "No such channel"), strings.Contains(err.Text, "Cannot locate session"):
+		return ErrCallNotFound
+	case strings.Contains(err.Text, "invalid session id"): // sendmsg to a channel hung up already
+		return ErrChannelGone
+	case strings.Contains(err.Text, "Invalid Profile"):
+		return ErrProfileNotFound
+	}
+	return nil
+}
+
+// parseReplyError interprets the reply of a command, nil if successful, else a *ReplyError
+func parseReplyError(rply string) error {
+	rply = strings.TrimSpace(rply)
+	var text string
+	var usage bool
+	if idx := strings.Index(rply, "-ERR"); idx != -1 { // anywhere in the reply, not only as prefix
+		text = strings.TrimSpace(rply[idx+len("-ERR"):])
+	} else if strings.HasPrefix(rply, "-USAGE") {
+		text, usage = strings.TrimSpace(strings.TrimPrefix(strings.TrimPrefix(rply, "-USAGE"), ":")), true
+	} else {
+		return nil
+	}
+	err := &ReplyError{Reply: rply, Text: text, Usage: usage}
+	if !usage && isHangupCause(text) {
+		err.Cause = text
+	}
+	return err
+}
+
+// isReplyError checks if FreeSWITCH replied with the error, as opposed to the command not being sent or replied
+func isReplyError(err error) bool {
+	var rplyErr *ReplyError
+	return errors.As(err, &rplyErr)
+}
+
+// GlobalGetVar returns the value of the global variable, ErrVariableNotFound if it is not set
+func (fs *FSock) GlobalGetVar(name string) (val string, err error) {
+	if name = strings.TrimSpace(name); name == "" {
+		return "", errors.New("Need variable name")
+	}
+	if val, err = fs.SendApiCmd("global_getvar " + name); err != nil {
+		if isReplyError(err) {
+			err = ErrVariableNotFound
+		}
+		return
+	}
+	if val = strings.TrimSpace(val); val == "" {
+		return "", ErrVariableNotFound
+	}
+	return
+}
+
+// GlobalSetVar sets the value of the global variable
+func (fs *FSock) GlobalSetVar(name, value string) (err error) {
+	if name = strings.TrimSpace(name); name == "" {
+		return errors.New("Need variable name")
+	}
+	_, err = fs.SendApiCmd("global_setvar " + name + "=" + value)
+	return
+}
+
+// uptimeUnits are the durations of the units of the FreeSWITCH uptime
+var uptimeUnits = map[string]time.Duration{
+	"year":        365 * 24 * time.Hour,
+	"day":         24 * time.Hour,
+	"hour":        time.Hour,
+	"minute":      time.Minute,
+	"second":      time.Second,
+	"millisecond": time.Millisecond,
+	"microsecond": time.Microsecond,
+}
+
+// ServerUptime returns the uptime of FreeSWITCH, out of the first line of api status
+// (eg: UP 0 years, 2 days, 1 hour, 5 minutes, 3 seconds, 12 milliseconds, 64 microseconds)
+func (fs *FSock) ServerUptime() (uptime time.Duration, err error) {
+	var rply string
+	if rply, err = fs.SendApiCmd("status"); err != nil {
+		return
+	}
+	line := strings.TrimSpace(strings.SplitN(rply, "\n", 2)[0])
+	if !strings.HasPrefix(line, "UP ") {
+		return 0, fmt.Errorf("Unexpected status reply received: <%s>", line)
+	}
+	for _, part := range strings.Split(line[len("UP "):], ",") {
+		flds := strings.Fields(part)
+		if len(flds) != 2 {
+			return 0, fmt.Errorf("Unexpected uptime received: <%s>", line)
+		}
+		n, errConv := strconv.ParseInt(flds[0], 10, 64)
+		unit, has := uptimeUnits[strings.TrimSuffix(flds[1], "s")]
+		if errConv != nil || !has {
+			return 0, fmt.Errorf("Unexpected uptime received: <%s>", line)
+		}
+		uptime += time.Duration(n) * unit
+	}
+	return
+}
+
+// serverTimeLayout is the layout of the time requested from FreeSWITCH by ServerTime, with its UTC offset
+const serverTimeLayout = "2006-01-02 15:04:05 -0700"
+
+// ServerTime returns the current time of FreeSWITCH out of api strftime, in the timezone of the server,
+// letting the callers reconcile their clock with the switch one (eg: to align the CDRs)
+func (fs *FSock) ServerTime() (t time.Time, err error) {
+	var rply string
+	if rply, err = fs.SendApiCmd("strftime %Y-%m-%d %H:%M:%S %z"); err != nil {
+		return
+	}
+	if t, err = time.Parse(serverTimeLayout, strings.TrimSpace(rply)); err != nil {
+		return time.Time{}, fmt.Errorf("Invalid strftime reply: <%s>", strings.TrimSpace(rply))
+	}
+	return
+}
+
+// LimitUsage returns the usage of the mod_limit resource out of api limit_usage, as used for the call admission
+// control. max is the limit reported by the backend along with the usage, 0 if only the usage is reported.
+// Returns ErrLimitNotConfigured if the backend is not loaded or not configured.
+func (fs *FSock) LimitUsage(backend, realm, resource string) (current, max int, err error) {
+	backend, realm, resource = strings.TrimSpace(backend), strings.TrimSpace(realm), strings.TrimSpace(resource)
+	if backend == "" || realm == "" || resource == "" {
+		return 0, 0, errors.New("Need backend, realm and resource")
+	}
+	var rply string
+	if rply, err = fs.SendApiCmd("limit_usage " + backend + " " + realm + " " + resource); err != nil {
+		if isReplyError(err) {
+			err = ErrLimitNotConfigured
+		}
+		return
+	}
+	if rply = strings.TrimSpace(rply); rply == "" {
+		return 0, 0, ErrLimitNotConfigured
+	}
+	usage, limit, hasLimit := strings.Cut(rply, "/")
+	if current, err = strconv.Atoi(usage); err != nil {
+		return 0, 0, fmt.Errorf("Invalid limit_usage reply: <%s>", rply)
+	}
+	if hasLimit {
+		if max, err = strconv.Atoi(limit); err != nil {
+			return 0, 0, fmt.Errorf("Invalid limit_usage reply: <%s>", rply)
+		}
+	}
+	return
+}
+
+// SendJSONAPI runs the command through the json api of FreeSWITCH, sending data as its JSON arguments,
+// and returns the response member of the reply for the caller to unmarshal.
+// The error envelopes (status error) are returned as errors carrying their message.
+func (fs *FSock) SendJSONAPI(command string, data interface{}) (json.RawMessage, error) {
+	if command = strings.TrimSpace(command); command == "" {
+		return nil, errors.New("Need json api command")
+	}
+	req, err := json.Marshal(struct {
+		Command string      `json:"command"`
+		Data    interface{} `json:"data,omitempty"`
+	}{Command: command, Data: data})
+	if err != nil {
+		return nil, fmt.Errorf("Cannot encode the json api request: <%s>", err.Error())
+	}
+	rply, err := fs.SendApiCmd("json " + string(req))
+	if err != nil {
+		return nil, err
+	}
+	var res struct {
+		Status   string          `json:"status"`
+		Message  string          `json:"message"`
+		Response json.RawMessage `json:"response"`
+	}
+	if err = json.Unmarshal([]byte(rply), &res); err != nil {
+		return nil, fmt.Errorf("Invalid json api reply: <%s>", strings.TrimSpace(rply))
+	}
+	if res.Status != "success" {
+		if res.Message == "" {
+			res.Message = strings.TrimSpace(rply)
+		}
+		return nil, fmt.Errorf("json api %s failed: <%s>", command, res.Message)
+	}
+	return res.Response, nil
+}
+
+// Registration is a row of the show registrations output
+type Registration struct {
+	RegUser      string `json:"reg_user"`
+	Realm        string `json:"realm"`
+	Token        string `json:"token"`
+	URL          string `json:"url"` // contact
+	Expires      string `json:"expires"`
+	NetworkIP    string `json:"network_ip"`
+	NetworkPort  string `json:"network_port"`
+	NetworkProto string `json:"network_proto"`
+	Hostname     string `json:"hostname"`
+	Metadata     string `json:"metadata"`
+}
+
+// Registrations returns the registered endpoints out of show registrations,
+// requested as json and falling back on the CSV output of older FreeSWITCH versions, rejecting or garbling the json
+func (fs *FSock) Registrations() (regs []Registration, err error) {
+	var rply string
+	if rply, err = fs.SendApiCmd("show registrations as json"); err == nil {
+		var res struct {
+			Rows []Registration `json:"rows"`
+		}
+		if err = json.Unmarshal([]byte(rply), &res); err == nil {
+			if res.Rows == nil {
+				res.Rows = make([]Registration, 0)
+			}
+			return res.Rows, nil
+		}
+	} else if !isReplyError(err) { // not sent or not replied, no use trying again
+		return
+	}
+	if rply, err = fs.SendApiCmd("show registrations"); err != nil {
+		return
+	}
+	rows := MapChanData(rply)
+	regs = make([]Registration, len(rows))
+	for i, row := range rows {
+		regs[i] = Registration{
+			RegUser:      row["reg_user"],
+			Realm:        row["realm"],
+			Token:        row["token"],
+			URL:          row["url"],
+			Expires:      row["expires"],
+			NetworkIP:    row["network_ip"],
+			NetworkPort:  row["network_port"],
+			NetworkProto: row["network_proto"],
+			Hostname:     row["hostname"],
+			Metadata:     row["metadata"],
+		}
+	}
+	return
+}
+
+// CallStatus is the state of a channel out of its uuid_dump
+type CallStatus struct {
+	UUID              string
+	Direction         string
+	ChannelName       string
+	ChannelState      string
+	CallState         string
+	AnswerState       string
+	CallerIDName      string
+	CallerIDNumber    string
+	DestinationNumber string
+	Context           string
+	OtherLegUUID      string
+	Variables         map[string]string // channel variables, without the variable_ prefix
+}
+
+// CallStatus returns the state and variables of the channel, ErrCallNotFound if it does not exist
+func (fs *FSock) CallStatus(uuid string) (cs *CallStatus, err error) {
+	var dump map[string]string
+	if dump, err = fs.uuidDump(uuid); err != nil {
+		return
+	}
+	cs = &CallStatus{
+		UUID:              dump["Unique-ID"],
+		Direction:         dump["Call-Direction"],
+		ChannelName:       dump["Channel-Name"],
+		ChannelState:      dump["Channel-State"],
+		CallState:         dump["Channel-Call-State"],
+		AnswerState:       dump["Answer-State"],
+		CallerIDName:      dump["Caller-Caller-ID-Name"],
+		CallerIDNumber:    dump["Caller-Caller-ID-Number"],
+		DestinationNumber: dump["Caller-Destination-Number"],
+		Context:           dump["Caller-Context"],
+		OtherLegUUID:      dump["Other-Leg-Unique-ID"],
+		Variables:         (&FSEvent{Headers: dump}).Variables(),
+	}
+	if cs.UUID == "" {
+		cs.UUID = strings.TrimSpace(uuid)
+	}
+	return
+}
+
+// GetVars returns the requested channel variables (all of them if no names are given) out of one uuid_dump,
+// omitting the ones not set. Returns ErrCallNotFound if the channel does not exist.
+func (fs *FSock) GetVars(uuid string, names ...string) (vars map[string]string, err error) {
+	var dump map[string]string
+	if dump, err = fs.uuidDump(uuid); err != nil {
+		return
+	}
+	if len(names) == 0 {
+		return (&FSEvent{Headers: dump}).Variables(), nil
+	}
+	vars = make(map[string]string)
+	for _, name := range names {
+		if val, has := dump["variable_"+name]; has {
+			vars[name] = val
+		}
+	}
+	return
+}
+
+// GetVar returns the value of the channel variable, present false if it is not set, as opposed to set to an empty
+// value. Returns ErrCallNotFound if the channel does not exist.
+func (fs *FSock) GetVar(uuid, name string) (val string, present bool, err error) {
+	if uuid = strings.TrimSpace(uuid); uuid == "" {
+		return "", false, errors.New("Need call UUID")
+	}
+	if name = strings.TrimSpace(name); name == "" {
+		return "", false, errors.New("Need variable name")
+	}
+	if val, err = fs.SendApiCmd("uuid_getvar " + uuid + " " + name); err != nil {
+		if errors.Is(err, ErrCallNotFound) {
+			err = ErrCallNotFound
+		}
+		return "", false, err
+	}
+	if val = strings.TrimSpace(val); val == "_undef_" { // returned by FreeSWITCH for the variables not set
+		return "", false, nil
+	}
+	return val, true, nil
+}
+
+// uuidDump returns the parsed uuid_dump of the channel, ErrCallNotFound if it does not exist
+func (fs *FSock) uuidDump(uuid string) (dump map[string]string, err error) {
+	if uuid = strings.TrimSpace(uuid); uuid == "" {
+		return nil, errors.New("Need call UUID")
+	}
+	var rply string
+	if rply, err = fs.SendApiCmd("uuid_dump " + uuid); err != nil {
+		if errors.Is(err, ErrCallNotFound) {
+			err = ErrCallNotFound
+		}
+		return
+	}
+	return fs.eventMap(rply), nil
+}
+
+// Broadcast plays the path into the active call on the given leg (aleg, bleg or both; aleg if empty),
+// ErrCallNotFound if the call does not exist
+func (fs *FSock) Broadcast(uuid, path, leg string) (err error) {
+	if uuid = strings.TrimSpace(uuid); uuid == "" {
+		return errors.New("Need call UUID")
+	}
+	if path = strings.TrimSpace(path); path == "" {
+		return errors.New("Need broadcast path")
+	}
+	if leg, err = parseLeg(leg); err != nil {
+		return
+	}
+	if _, err = fs.SendApiCmd("uuid_broadcast " + uuid + " " + path + " " + leg); errors.Is(err, ErrCallNotFound) {
+		err = ErrCallNotFound
+	}
+	return
+}
+
+// Transfer sends the call leg (aleg, bleg or both; aleg if empty) to the dest extension,
+// within the dialplan and dpContext if given, ErrCallNotFound if the call does not exist
+func (fs *FSock) Transfer(uuid, dest, dialplan, dpContext, leg string) (err error) {
+	if uuid = strings.TrimSpace(uuid); uuid == "" {
+		return errors.New("Need call UUID")
+	}
+	if dest = strings.TrimSpace(dest); dest == "" {
+		return errors.New("Need transfer destination")
+	}
+	if leg, err = parseLeg(leg); err != nil {
+		return
+	}
+	cmd := "uuid_transfer " + uuid
+	if leg != "aleg" {
+		cmd += " -" + leg
+	}
+	cmd += " " + dest
+	dialplan, dpContext = strings.TrimSpace(dialplan), strings.TrimSpace(dpContext)
+	if dialplan == "" && dpContext != "" {
+		dialplan = "XML" // positional, needed before the context
+	}
+	if dialplan != "" {
+		cmd += " " + dialplan
+	}
+	if dpContext != "" {
+		cmd += " " + dpContext
+	}
+	if _, err = fs.SendApiCmd(cmd); errors.Is(err, ErrCallNotFound) {
+		err = ErrCallNotFound
+	}
+	return
+}
+
+// parkConfirmTimeout is waited by Park for the CHANNEL_PARK event without reply timeout
+const parkConfirmTimeout = 5 * time.Second
+
+// Park parks the channel, executing the park application through sendmsg, and waits for its CHANNEL_PARK event
+// confirming it, up to the reply timeout (5s without). The CHANNEL_PARK events need to be subscribed on this
+// connection, the CHANNEL_HANGUP ones as well to detect the channel hanging up meanwhile.
+// Returns ErrChannelGone if the channel hung up, ErrParkNotConfirmed if no CHANNEL_PARK arrived in time.
+func (fs *FSock) Park(uuid string) (err error) {
+	if uuid = strings.TrimSpace(uuid); uuid == "" {
+		return errors.New("Need call UUID")
+	}
+	if !fs.initialized() {
+		return ErrNotConnected
+	}
+	w := fs.addEventWaiter(func(evName string, evMap map[string]string) bool {
+		return (evName == "CHANNEL_PARK" || evName == "CHANNEL_HANGUP") && evMap["Unique-ID"] == uuid
+	})
+	defer fs.removeEventWaiter(w)
+	if err = fs.SendMsgCmd(uuid, map[string]string{
+		"call-command":     "execute",
+		"execute-app-name": "park",
+	}); err != nil {
+		if errors.Is(err, ErrChannelGone) {
+			err = ErrChannelGone
+		}
+		return
+	}
+	timeout := fs.ReplyTimeout()
+	if timeout <= 0 {
+		timeout = parkConfirmTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case ev := <-w.evChan:
+		if headerVal(ev, "Event-Name") == "CHANNEL_HANGUP" {
+			return ErrChannelGone
+		}
+		return
+	case <-timer.C:
+		return ErrParkNotConfirmed
+	}
+}
+
+// Retrieve takes the parked call back, bridging it to the channel of the agent,
+// ErrChannelGone if either channel hung up meanwhile
+func (fs *FSock) Retrieve(uuid, agentUUID string) (err error) {
+	if err = fs.Bridge(uuid, agentUUID); errors.Is(err, ErrCallNotFound) {
+		err = ErrChannelGone
+	}
+	return
+}
+
+// BridgeError is returned when FreeSWITCH refuses to bridge the two channels,
+// unwrapping to ErrCallNotFound if one of them does not exist
+type BridgeError struct {
+	UUIDA string
+	UUIDB string
+	Reply string
+}
+
+func (err *BridgeError) Error() string {
+	return fmt.Sprintf("Bridge %s to %s failed: <%s>", err.UUIDA, err.UUIDB, err.Reply)
+}
+
+func (err *BridgeError) Unwrap() error {
+	if strings.Contains(err.Reply, "No such channel") {
+		return ErrCallNotFound
+	}
+	return nil
+}
+
+// Bridge connects the two existing channels, erroring with *BridgeError if FreeSWITCH refuses it
+func (fs *FSock) Bridge(uuidA, uuidB string) (err error) {
+	uuidA, uuidB = strings.TrimSpace(uuidA), strings.TrimSpace(uuidB)
+	if uuidA == "" || uuidB == "" {
+		return errors.New("Need call UUID")
+	}
+	if uuidA == uuidB {
+		return errors.New("Cannot bridge a call to itself")
+	}
+	var rply string
+	if rply, err = fs.SendApiCmd("uuid_bridge " + uuidA + " " + uuidB); err != nil {
+		if isReplyError(err) {
+			err = &BridgeError{UUIDA: uuidA, UUIDB: uuidB, Reply: err.Error()}
+		}
+		return
+	}
+	if rply = strings.TrimSpace(rply); !strings.HasPrefix(rply, "+OK") {
+		return &BridgeError{UUIDA: uuidA, UUIDB: uuidB, Reply: rply}
+	}
+	return
+}
+
+// HupAll hangs up with cause (eg: NORMAL_CLEARING, or its Q.850 code) all the channels or, if varName is given,
+// only the ones having the channel variable set to varValue
+func (fs *FSock) HupAll(cause, varName, varValue string) (err error) {
+	if cause = strings.TrimSpace(cause); !isHangupCause(cause) {
+		return ErrInvalidHangupCause
+	}
+	cmd := "hupall " + cause
+	if varName = strings.TrimSpace(varName); varName != "" {
+		if varValue = strings.TrimSpace(varValue); varValue == "" {
+			return errors.New("Need variable value")
+		}
+		if strings.ContainsAny(varName+varValue, " \t") {
+			return errors.New("Cannot filter on values with spaces")
+		}
+		cmd += " " + varName + " " + varValue
+	} else if varValue != "" {
+		return errors.New("Need variable name")
+	}
+	_, err = fs.SendApiCmd(cmd)
+	return
+}
+
+// hangupCauses are the names of the hangup causes known by FreeSWITCH: the Q.850 ones and its own (eg: MANAGER_REQUEST)
+var hangupCauses = map[string]struct{}{
+	"UNALLOCATED_NUMBER": {}, "NO_ROUTE_TRANSIT_NET": {}, "NO_ROUTE_DESTINATION": {}, "CHANNEL_UNACCEPTABLE": {},
+	"CALL_AWARDED_DELIVERED": {}, "NORMAL_CLEARING": {}, "USER_BUSY": {}, "NO_USER_RESPONSE": {}, "NO_ANSWER": {},
+	"SUBSCRIBER_ABSENT": {}, "CALL_REJECTED": {}, "NUMBER_CHANGED": {}, "REDIRECTION_TO_NEW_DESTINATION": {},
+	"EXCHANGE_ROUTING_ERROR": {}, "DESTINATION_OUT_OF_ORDER": {}, "INVALID_NUMBER_FORMAT": {}, "FACILITY_REJECTED": {},
+	"RESPONSE_TO_STATUS_ENQUIRY": {}, "NORMAL_UNSPECIFIED": {}, "NORMAL_CIRCUIT_CONGESTION": {},
+	"NETWORK_OUT_OF_ORDER": {}, "NORMAL_TEMPORARY_FAILURE": {}, "SWITCH_CONGESTION": {}, "ACCESS_INFO_DISCARDED": {},
+	"REQUESTED_CHAN_UNAVAIL": {}, "PRE_EMPTED": {}, "FACILITY_NOT_SUBSCRIBED": {}, "OUTGOING_CALL_BARRED": {},
+	"INCOMING_CALL_BARRED": {}, "BEARERCAPABILITY_NOTAUTH": {}, "BEARERCAPABILITY_NOTAVAIL": {},
+	"SERVICE_UNAVAILABLE": {}, "BEARERCAPABILITY_NOTIMPL": {}, "CHAN_NOT_IMPLEMENTED": {},
+	"FACILITY_NOT_IMPLEMENTED": {}, "SERVICE_NOT_IMPLEMENTED": {}, "INVALID_CALL_REFERENCE": {},
+	"INCOMPATIBLE_DESTINATION": {}, "INVALID_MSG_UNSPECIFIED": {}, "MANDATORY_IE_MISSING": {},
+	"MESSAGE_TYPE_NONEXIST": {}, "WRONG_MESSAGE": {}, "IE_NONEXIST": {}, "INVALID_IE_CONTENTS": {},
+	"WRONG_CALL_STATE": {}, "RECOVERY_ON_TIMER_EXPIRE": {}, "MANDATORY_IE_LENGTH_ERROR": {}, "PROTOCOL_ERROR": {},
+	"INTERWORKING": {}, "SUCCESS": {}, "ORIGINATOR_CANCEL": {}, "CRASH": {}, "SYSTEM_SHUTDOWN": {}, "LOSE_RACE": {},
+	"MANAGER_REQUEST": {}, "BLIND_TRANSFER": {}, "ATTENDED_TRANSFER": {}, "ALLOTTED_TIMEOUT": {},
+	"USER_CHALLENGE": {}, "MEDIA_TIMEOUT": {}, "PICKED_OFF": {}, "USER_NOT_REGISTERED": {}, "PROGRESS_TIMEOUT": {},
+	"INVALID_GATEWAY": {}, "GATEWAY_DOWN": {}, "INVALID_URL": {}, "INVALID_PROFILE": {}, "NO_PICKUP": {},
+	"SRTP_READ_ERROR": {}, "BOWOUT": {}, "BUSY_EVERYWHERE": {}, "DECLINE": {}, "DOES_NOT_EXIST_ANYWHERE": {},
+	"NOT_ACCEPTABLE": {}, "UNWANTED": {}, "NO_IDENTITY": {}, "BAD_IDENTITY_INFO": {}, "UNSUPPORTED_CERTIFICATE": {},
+	"INVALID_IDENTITY": {}, "STALE_DATE": {}, "REJECT_ALL": {},
+}
+
+// isHangupCause checks the cause is one of hangupCauses or a Q.850 code (1-127)
+func isHangupCause(cause string) bool {
+	if cause != "" && strings.Trim(cause, "0123456789") == "" { // no sign, as FreeSWITCH reads them
+		code, err := strconv.Atoi(cause)
+		return err == nil && code >= 1 && code <= 127
+	}
+	_, has := hangupCauses[cause]
+	return has
+}
+
+// OriginateOptions customize the call originated by OriginateToApp
+type OriginateOptions struct {
+	UUID    string            // of the originated leg, generated if empty
+	Vars    map[string]string // channel variables of the originated leg
+	Timeout time.Duration     // waiting for the endpoint to answer (originate_timeout), the FreeSWITCH default if 0
+}
+
+// OriginateToApp calls the endpoint (eg: user/1001 or sofia/gateway/gw/1234) and runs the application app with appArgs
+// on the answered leg, returning its UUID. Waits for the answer, up to the ctx and the reply timeout.
+func (fs *FSock) OriginateToApp(ctx context.Context, endpoint, app, appArgs string, opts *OriginateOptions) (uuid string, err error) {
+	if endpoint = strings.TrimSpace(endpoint); endpoint == "" {
+		return "", errors.New("Need originate endpoint")
+	} else if strings.ContainsAny(endpoint, " \t") {
+		return "", errors.New("Cannot originate to an endpoint with spaces")
+	}
+	if app = strings.TrimSpace(app); app == "" {
+		return "", errors.New("Need application name")
+	} else if !isAppName(app) {
+		return "", fmt.Errorf("Invalid application name: <%s>", app)
+	}
+	if opts == nil {
+		opts = new(OriginateOptions)
+	}
+	if uuid = opts.UUID; uuid == "" {
+		uuid = genUUID()
+	}
+	var rply string
+	if rply, err = fs.SendApiCmdContext(ctx, buildOriginateToApp(uuid, endpoint, app, appArgs, opts)); err != nil {
+		return "", err
+	}
+	rply = strings.TrimSpace(rply)
+	if !strings.HasPrefix(rply, "+OK") {
+		return "", fmt.Errorf("Unexpected originate reply received: <%s>", rply)
+	}
+	if rplyUUID := strings.TrimSpace(strings.TrimPrefix(rply, "+OK")); rplyUUID != "" {
+		uuid = rplyUUID
+	}
+	return
+}
+
+// buildOriginateToApp builds the originate command, the variables sorted and
+// the application quoted as a single argument if needed (eg: '&playback(/tmp/hello world.wav)')
+func buildOriginateToApp(uuid, endpoint, app, appArgs string, opts *OriginateOptions) string {
+	vars := []string{"origination_uuid=" + uuid}
+	if opts.Timeout > 0 {
+		vars = append(vars, "originate_timeout="+strconv.Itoa(int((opts.Timeout+time.Second-1)/time.Second)))
+	}
+	names := make([]string, 0, len(opts.Vars))
+	for name := range opts.Vars {
+		if name != "origination_uuid" && name != "originate_timeout" { // set by the options
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		vars = append(vars, name+"="+quoteOriginateArg(strings.ReplaceAll(opts.Vars[name], ",", "\\,")))
+	}
+	return "originate {" + strings.Join(vars, ",") + "}" + endpoint + " " + quoteOriginateArg("&"+app+"("+appArgs+")")
+}
+
+// quoteOriginateArg single quotes the argument of originate holding spaces or quotes, escaping its quotes
+func quoteOriginateArg(arg string) string {
+	if !strings.ContainsAny(arg, " \t'") {
+		return arg
+	}
+	return "'" + strings.ReplaceAll(arg, "'", "\\'") + "'"
+}
+
+// isAppName checks the application name is made of letters, digits, underscores and dashes
+func isAppName(app string) bool {
+	for _, c := range app {
+		if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') && c != '_' && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// ConferenceMember is a row of the conference list output
+type ConferenceMember struct {
+	ID             int
+	ChannelName    string
+	UUID           string
+	CallerIDName   string
+	CallerIDNumber string
+	Flags          []string // eg: hear, speak, talking, floor
+	VolumeIn       int
+	VolumeOut      int
+	EnergyLevel    int
+}
+
+// ConferenceList returns the members of the conference, ErrConferenceNotFound if it does not exist
+func (fs *FSock) ConferenceList(name string) (members []ConferenceMember, err error) {
+	if name = strings.TrimSpace(name); name == "" {
+		return nil, errors.New("Need conference name")
+	}
+	var rply string
+	if rply, err = fs.SendApiCmd("conference " + name + " list"); err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			err = ErrConferenceNotFound
+		}
+		return
+	}
+	if strings.HasPrefix(rply, "Conference "+name+" not found") {
+		return nil, ErrConferenceNotFound
+	}
+	members = make([]ConferenceMember, 0)
+	for _, row := range strings.Split(rply, "\n") {
+		if row = strings.TrimSpace(row); row == "" {
+			continue
+		}
+		var member ConferenceMember
+		if member, err = parseConferenceMember(row); err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	return
+}
+
+// ConferenceKick kicks the member (its id, or all, last or non_moderator) out of the conference,
+// ErrConferenceNotFound or ErrMemberNotFound if either does not exist
+func (fs *FSock) ConferenceKick(name, memberID string) (err error) {
+	if memberID, err = parseMemberID(memberID); err != nil {
+		return
+	}
+	_, err = fs.conferenceCmd(name, "kick "+memberID)
+	return
+}
+
+// ConferenceMute mutes the member (its id, or all, last or non_moderator) of the conference,
+// ErrConferenceNotFound or ErrMemberNotFound if either does not exist
+func (fs *FSock) ConferenceMute(name, memberID string) (err error) {
+	if memberID, err = parseMemberID(memberID); err != nil {
+		return
+	}
+	_, err = fs.conferenceCmd(name, "mute "+memberID)
+	return
+}
+
+// ConferencePlay plays the file to all the members of the conference, ErrConferenceNotFound if it does not exist
+func (fs *FSock) ConferencePlay(name, file string) (err error) {
+	if file = strings.TrimSpace(file); file == "" {
+		return errors.New("Need file to play")
+	}
+	var rply string
+	if rply, err = fs.conferenceCmd(name, "play "+file); err != nil {
+		return
+	}
+	if strings.Contains(rply, "not found") {
+		return fmt.Errorf("Conference play failed: <%s>", strings.TrimSpace(rply))
+	}
+	return
+}
+
+// ConferenceOriginateOptions customize the call originated by OriginateToConference
+type ConferenceOriginateOptions struct {
+	OriginateOptions
+	Profile   string   // conference profile (eg: wideband), the default one if empty
+	Flags     []string // member flags (eg: mute, moderator)
+	MustExist bool     // join only a running conference, ErrConferenceNotFound otherwise, instead of creating it on demand
+}
+
+// OriginateToConference calls the endpoint and joins the answered leg to the conference, created on demand
+// unless MustExist, returning its UUID. Waits for the answer, up to the ctx and the reply timeout.
+func (fs *FSock) OriginateToConference(ctx context.Context, endpoint, name string, opts *ConferenceOriginateOptions) (uuid string, err error) {
+	if name = strings.TrimSpace(name); name == "" {
+		return "", errors.New("Need conference name")
+	} else if strings.ContainsAny(name, " \t@+{}()") {
+		return "", fmt.Errorf("Invalid conference name: <%s>", name)
+	}
+	if opts == nil {
+		opts = new(ConferenceOriginateOptions)
+	}
+	if opts.MustExist {
+		if _, err = fs.ConferenceList(name); err != nil {
+			return
+		}
+	}
+	return fs.OriginateToApp(ctx, endpoint, "conference", conferenceAppArgs(name, opts), &opts.OriginateOptions)
+}
+
+// conferenceAppArgs builds the arguments of the conference application: name[@profile][+flags{flag1|flag2}]
+func conferenceAppArgs(name string, opts *ConferenceOriginateOptions) string {
+	args := name
+	if profile := strings.TrimSpace(opts.Profile); profile != "" {
+		args += "@" + profile
+	}
+	if len(opts.Flags) != 0 {
+		args += "+flags{" + strings.Join(opts.Flags, "|") + "}"
+	}
+	return args
+}
+
+// conferenceCmd runs the action against the conference, mapping the missing conference and member to their errors
+func (fs *FSock) conferenceCmd(name, action string) (rply string, err error) {
+	if name = strings.TrimSpace(name); name == "" {
+		return "", errors.New("Need conference name")
+	}
+	if rply, err = fs.SendApiCmd("conference " + name + " " + action); err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			err = ErrConferenceNotFound
+		}
+		return
+	}
+	switch {
+	case strings.HasPrefix(rply, "Conference "+name+" not found"):
+		return "", ErrConferenceNotFound
+	case strings.HasPrefix(rply, "Non-Existant ID"), strings.HasPrefix(rply, "Non-Existent ID"): // sic, as FreeSWITCH spells it
+		return "", ErrMemberNotFound
+	}
+	return
+}
+
+// parseMemberID validates the conference member, its numeric id or one of the all, last and non_moderator selectors
+func parseMemberID(memberID string) (string, error) {
+	memberID = strings.TrimSpace(memberID)
+	switch memberID {
+	case "all", "last", "non_moderator":
+		return memberID, nil
+	}
+	if id, err := strconv.Atoi(memberID); err != nil || id <= 0 {
+		return "", fmt.Errorf("Invalid conference member id: <%s>", memberID)
+	}
+	return memberID, nil
+}
+
+// parseConferenceMember parses the member row:
+// <id>;<channel name>;<uuid>;<caller id name>;<caller id number>;<flags>;<volume in>;<volume out>;<energy level>
+func parseConferenceMember(row string) (member ConferenceMember, err error) {
+	fields := splitIgnoreGroups(row, ";")
+	if len(fields) < 9 {
+		return member, fmt.Errorf("Malformed conference member: <%s>", row)
+	}
+	ints := make([]int, 0, 4)
+	for _, idx := range []int{0, 6, 7, 8} {
+		var val int
+		if val, err = strconv.Atoi(strings.TrimSpace(fields[idx])); err != nil {
+			return member, fmt.Errorf("Malformed conference member: <%s>", row)
+		}
+		ints = append(ints, val)
+	}
+	member = ConferenceMember{
+		ID:             ints[0],
+		ChannelName:    fields[1],
+		UUID:           fields[2],
+		CallerIDName:   fields[3],
+		CallerIDNumber: fields[4],
+		Flags:          make([]string, 0),
+		VolumeIn:       ints[1],
+		VolumeOut:      ints[2],
+		EnergyLevel:    ints[3],
+	}
+	for _, flag := range strings.Split(fields[5], "|") {
+		if flag != "" {
+			member.Flags = append(member.Flags, flag)
+		}
+	}
+	return
+}
+
+// Channel is a row of the show channels output
+type Channel struct {
+	UUID            string
+	Direction       string
+	Created         string
+	Name            string
+	State           string
+	CallState       string
+	CIDName         string
+	CIDNum          string
+	IPAddr          string
+	Dest            string
+	Application     string
+	ApplicationData string
+	Context         string
+	ReadCodec       string
+	WriteCodec      string
+	Hostname        string
+	CallUUID        string
+	Fields          map[string]string // all the columns, indexed by their header
+}
+
+// ChannelStream iterates over the rows of show channels one at a time, see ChannelsStream
+type ChannelStream struct {
+	rdr   *bufio.Reader
+	rply  io.Closer
+	hdrs  []string
+	ch    *Channel
+	total int
+}
+
+// ChannelsStream returns the iterator over the channels of show channels, parsing one row per Next call as read
+// off the socket by SendApiCmdStream, so neither the reply nor the channels are ever all held at once.
+// The events wait until the iteration ends, Close releasing them if stopped early:
+//
+//	defer chs.Close()
+//	for chs.Next() {
+//		ch := chs.Channel()
+//	}
+func (fs *FSock) ChannelsStream() (*ChannelStream, error) {
+	rdr, err := fs.SendApiCmdStream("show channels")
+	if err != nil {
+		return nil, err
+	}
+	chs := &ChannelStream{rdr: bufio.NewReader(rdr), rply: rdr, total: -1}
+	for {
+		ln, isLast := chs.readLine()
+		switch {
+		case chs.parseTotal(ln): // no channel, hence no header
+			chs.Close()
+			return chs, nil
+		case ln != "":
+			chs.hdrs = strings.Split(ln, ",")
+			return chs, nil
+		case isLast:
+			chs.Close()
+			return nil, errors.New("Missing show channels header")
+		}
+	}
+}
+
+// Next parses the next channel, available with Channel, returns false once all parsed, the reply being closed
+func (chs *ChannelStream) Next() bool {
+	chs.ch = nil
+	if chs.hdrs == nil {
+		return false
+	}
+	for {
+		ln, isLast := chs.readLine()
+		if ln != "" && !chs.parseTotal(ln) {
+			if flds := splitIgnoreGroups(ln, ","); len(flds) == len(chs.hdrs) { // malformed rows skipped as MapChanData
+				chs.ch = newChannel(chs.hdrs, flds)
+				return true
+			}
+		}
+		if isLast {
+			chs.Close()
+			return false
+		}
+	}
+}
+
+// Close closes the reply, releasing the events held until then, Next returning false afterwards
+func (chs *ChannelStream) Close() error {
+	chs.hdrs = nil
+	return chs.rply.Close()
+}
+
+// Channel returns the channel parsed by the last Next call
+func (chs *ChannelStream) Channel() *Channel {
+	return chs.ch
+}
+
+// Total returns the count of the trailing "X total." line once reached by Next, -1 before or if missing
+func (chs *ChannelStream) Total() int {
+	return chs.total
+}
+
+// readLine returns the next line without its line ending, isLast once the reply is consumed
+func (chs *ChannelStream) readLine() (ln string, isLast bool) {
+	ln, err := chs.rdr.ReadString('\n')
+	return strings.TrimRight(ln, "\r\n"), err != nil
+}
+
+// parseTotal checks if ln is the trailing "X total." line, keeping its count
+func (chs *ChannelStream) parseTotal(ln string) bool {
+	if !strings.HasSuffix(ln, " total.") {
+		return false
+	}
+	total, err := strconv.Atoi(strings.TrimSuffix(ln, " total."))
+	if err != nil {
+		return false
+	}
+	chs.total = total
+	return true
+}
+
+// newChannel builds the Channel out of the fields of its row
+func newChannel(hdrs, flds []string) *Channel {
+	fields := make(map[string]string, len(hdrs))
+	for i, hdr := range hdrs {
+		fields[hdr] = flds[i]
+	}
+	return &Channel{
+		UUID:            fields["uuid"],
+		Direction:       fields["direction"],
+		Created:         fields["created"],
+		Name:            fields["name"],
+		State:           fields["state"],
+		CallState:       fields["callstate"],
+		CIDName:         fields["cid_name"],
+		CIDNum:          fields["cid_num"],
+		IPAddr:          fields["ip_addr"],
+		Dest:            fields["dest"],
+		Application:     fields["application"],
+		ApplicationData: fields["application_data"],
+		Context:         fields["context"],
+		ReadCodec:       fields["read_codec"],
+		WriteCodec:      fields["write_codec"],
+		Hostname:        fields["hostname"],
+		CallUUID:        fields["call_uuid"],
+		Fields:          fields,
+	}
+}
+
+// CallLeg is one leg of a Call
+type CallLeg struct {
+	UUID      string
+	Direction string
+	Name      string
+	State     string
+	CallState string
+	CIDName   string
+	CIDNum    string
+	Dest      string
+}
+
+// Call is a row of show calls, pairing the A leg with the B one bridged to it
+type Call struct {
+	Created time.Time // of the call, from the A leg creation
+	A       CallLeg
+	B       *CallLeg // nil for the unbridged calls
+}
+
+// Calls returns the calls out of show calls, each pairing its bridged legs
+func (fs *FSock) Calls() (calls []Call, err error) {
+	var rply string
+	if rply, err = fs.SendApiCmd("show calls as json"); err != nil {
+		return
+	}
+	var res struct {
+		Rows []map[string]string `json:"rows"`
+	}
+	if err = json.Unmarshal([]byte(rply), &res); err != nil {
+		return nil, fmt.Errorf("Cannot parse the calls: <%s>", err.Error())
+	}
+	calls = make([]Call, 0, len(res.Rows))
+	for _, row := range res.Rows {
+		call := Call{A: callLeg(row, "")}
+		epoch := row["call_created_epoch"]
+		if epoch == "" {
+			epoch = row["created_epoch"]
+		}
+		if secs, err := strconv.ParseInt(epoch, 10, 64); err == nil {
+			call.Created = time.Unix(secs, 0)
+		}
+		if row["b_uuid"] != "" {
+			b := callLeg(row, "b_")
+			call.B = &b
+		}
+		calls = append(calls, call)
+	}
+	return
+}
+
+// callLeg builds the leg out of the show calls columns starting with prefix
+func callLeg(row map[string]string, prefix string) CallLeg {
+	return CallLeg{
+		UUID:      row[prefix+"uuid"],
+		Direction: row[prefix+"direction"],
+		Name:      row[prefix+"name"],
+		State:     row[prefix+"state"],
+		CallState: row[prefix+"callstate"],
+		CIDName:   row[prefix+"cid_name"],
+		CIDNum:    row[prefix+"cid_num"],
+		Dest:      row[prefix+"dest"],
+	}
+}
+
+// Gateway is the state of a sofia gateway
+type Gateway struct {
+	Name           string
+	Profile        string
+	State          string        // registration state, eg: REGED, NOREG, TRYING, FAILED
+	Status         string        // UP or DOWN, out of the pings
+	PingTime       time.Duration // last OPTIONS round-trip
+	Uptime         time.Duration // since the gateway is UP
+	CallsIn        int
+	CallsOut       int
+	FailedCallsIn  int
+	FailedCallsOut int
+}
+
+// Gateways returns the gateways of the sofia profile out of sofia xmlstatus gateway,
+// ErrProfileNotFound if the profile does not exist. It takes two api round-trips: sofia status profile first,
+// since the gateways listing of all the profiles cannot tell a missing profile from one without gateways
+func (fs *FSock) Gateways(profile string) (gws []Gateway, err error) {
+	if profile = strings.TrimSpace(profile); profile == "" {
+		return nil, errors.New("Need profile name")
+	}
+	var rply string
+	if rply, err = fs.SendApiCmd("sofia status profile " + profile); err != nil {
+		return
+	}
+	if strings.Contains(rply, "Invalid Profile") {
+		return nil, ErrProfileNotFound
+	}
+	if rply, err = fs.SendApiCmd("sofia xmlstatus gateway"); err != nil {
+		return
+	}
+	var res struct {
+		Gateways []struct {
+			Name           string  `xml:"name"`
+			Profile        string  `xml:"profile"`
+			State          string  `xml:"state"`
+			Status         string  `xml:"status"`
+			PingTime       float64 `xml:"pingtime"` // milliseconds
+			UptimeUsec     int64   `xml:"uptime-usec"`
+			CallsIn        int     `xml:"calls-in"`
+			CallsOut       int     `xml:"calls-out"`
+			FailedCallsIn  int     `xml:"failed-calls-in"`
+			FailedCallsOut int     `xml:"failed-calls-out"`
+		} `xml:"gateway"`
+	}
+	dec := xml.NewDecoder(strings.NewReader(rply))
+	dec.CharsetReader = xmlCharsetReader
+	if err = dec.Decode(&res); err != nil {
+		return nil, fmt.Errorf("Cannot parse the gateways status: <%s>", err.Error())
+	}
+	gws = make([]Gateway, 0)
+	for _, gw := range res.Gateways {
+		if gw.Profile != profile {
+			continue
+		}
+		gws = append(gws, Gateway{
+			Name:           gw.Name,
+			Profile:        gw.Profile,
+			State:          gw.State,
+			Status:         gw.Status,
+			PingTime:       time.Duration(gw.PingTime * float64(time.Millisecond)),
+			Uptime:         time.Duration(gw.UptimeUsec) * time.Microsecond,
+			CallsIn:        gw.CallsIn,
+			CallsOut:       gw.CallsOut,
+			FailedCallsIn:  gw.FailedCallsIn,
+			FailedCallsOut: gw.FailedCallsOut,
+		})
+	}
+	return
+}
+
+// xmlCharsetReader decodes the charset declared by the xml replies of FreeSWITCH, ISO-8859-1 usually
+func xmlCharsetReader(charset string, input io.Reader) (io.Reader, error) {
+	enc, err := ianaindex.IANA.Encoding(charset)
+	if err != nil || enc == nil {
+		return nil, fmt.Errorf("Unsupported charset: <%s>", charset)
+	}
+	return enc.NewDecoder().Reader(input), nil
+}
+
+// parseLeg validates the call leg, aleg if empty
+func parseLeg(leg string) (string, error) {
+	switch leg {
+	case "":
+		return "aleg", nil
+	case "aleg", "bleg", "both":
+		return leg, nil
+	}
+	return "", ErrInvalidLeg
+}
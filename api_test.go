@@ -0,0 +1,1018 @@
+/*
+api_test.go is released under the MIT License <http://www.opensource.org/licenses/mit-license.php
+Copyright (C) ITsysCOM. All Rights Reserved.
+
+Provides FreeSWITCH socket communication.
+*/
+package fsock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPIParseReplyError(t *testing.T) {
+	for rply, exp := range map[string]*ReplyError{
+		"-ERR No such channel!\n":      {Reply: "-ERR No such channel!", Text: "No such channel!"},
+		"-ERR NO_ANSWER\n":             {Reply: "-ERR NO_ANSWER", Text: "NO_ANSWER", Cause: "NO_ANSWER"},
+		"-ERR\n":                       {Reply: "-ERR"},
+		"-USAGE: <uuid> <path> [aleg]": {Reply: "-USAGE: <uuid> <path> [aleg]", Text: "<uuid> <path> [aleg]", Usage: true},
+		"-ERR Invalid Profile!\n":      {Reply: "-ERR Invalid Profile!", Text: "Invalid Profile!"},
+		"[ERROR] -ERR Cannot locate session!": {Reply: "[ERROR] -ERR Cannot locate session!",
+			Text: "Cannot locate session!"},
+	} {
+		if err := parseReplyError(rply); !reflect.DeepEqual(exp, err) {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, err)
+		}
+	}
+	for _, rply := range []string{"+OK\n", "+OK 6f4ec0e2-4a5b-4dd4-b9ab-8265a6fc1a0d\n", "UP 0 years\n", ""} {
+		if err := parseReplyError(rply); err != nil {
+			t.Errorf("Unexpected error for %q: <%v>", rply, err)
+		}
+	}
+	for rply, exp := range map[string]error{
+		"-ERR No such channel!":       ErrCallNotFound,
+		"-ERR Cannot locate session!": ErrCallNotFound,
+		"-ERR Invalid Profile!":       ErrProfileNotFound,
+		"-ERR invalid session id [0]": ErrChannelGone,
+	} {
+		if err := parseReplyError(rply); !errors.Is(err, exp) {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, err)
+		}
+	}
+	for _, rply := range []string{"-ERR FAILED", "-ERR 500"} { // not hangup causes
+		var rplyErr *ReplyError
+		if err := parseReplyError(rply); !errors.As(err, &rplyErr) || rplyErr.Cause != "" {
+			t.Errorf("Unexpected cause for %q: <%#v>", rply, err)
+		}
+	}
+	if err := parseReplyError("-ERR USER_BUSY"); errors.Unwrap(err) != nil {
+		t.Errorf("Unexpected typed error: <%v>", errors.Unwrap(err))
+	}
+	m := newFSMock(t)
+	m.apiReply = func(string) string { return "-ERR No such channel!\n" }
+	fs := newMockedFSock(t, m, nil)
+	_, err := fs.SendApiCmd("uuid_kill 00000000")
+	var rplyErr *ReplyError
+	if !errors.As(err, &rplyErr) || rplyErr.Text != "No such channel!" || !errors.Is(err, ErrCallNotFound) {
+		t.Errorf("Unexpected error: <%#v>", err)
+	}
+}
+
+func TestAPIGlobalGetVar(t *testing.T) {
+	m := newFSMock(t)
+	m.apiReply = func(cmd string) string {
+		switch cmd {
+		case "global_getvar domain":
+			return "192.168.56.74"
+		case "global_getvar bad":
+			return "-ERR no reply\n"
+		}
+		return ""
+	}
+	fs := newMockedFSock(t, m, nil)
+	if val, err := fs.GlobalGetVar("domain"); err != nil {
+		t.Error(err)
+	} else if val != "192.168.56.74" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "192.168.56.74", val)
+	}
+	for _, name := range []string{"missing", "bad"} {
+		if _, err := fs.GlobalGetVar(name); err != ErrVariableNotFound {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrVariableNotFound, err)
+		}
+	}
+	if _, err := fs.GlobalGetVar(" "); err == nil || err.Error() != "Need variable name" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "Need variable name", err)
+	}
+	m.waitCommand(t, 0, "api global_getvar missing")
+}
+
+func TestAPIServerUptime(t *testing.T) {
+	m := newFSMock(t)
+	rply := "UP 0 years, 2 days, 1 hour, 5 minutes, 3 seconds, 12 milliseconds, 64 microseconds\n" +
+		"FreeSWITCH (Version 1.10.9 -release 64bit) is ready\n"
+	m.apiReply = func(string) string { return rply }
+	fs := newMockedFSock(t, m, nil)
+	exp := 49*time.Hour + 5*time.Minute + 3*time.Second + 12*time.Millisecond + 64*time.Microsecond
+	if uptime, err := fs.ServerUptime(); err != nil {
+		t.Error(err)
+	} else if uptime != exp {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, uptime)
+	}
+	m.waitCommand(t, 0, "api status")
+	fs = newMockedFSock(t, newFSMock(t), nil) // mock status without uptime
+	if _, err := fs.ServerUptime(); err == nil {
+		t.Error("Expected error for the status without uptime")
+	}
+}
+
+func TestAPIGetVar(t *testing.T) {
+	m := newFSMock(t)
+	m.apiReply = func(cmd string) string {
+		switch cmd {
+		case "uuid_getvar 4c882cc4 cgr_reqtype":
+			return "*prepaid"
+		case "uuid_getvar 4c882cc4 cgr_account":
+			return ""
+		case "uuid_getvar 4c882cc4 cgr_missing":
+			return "_undef_"
+		}
+		return "-ERR No such channel!\n"
+	}
+	fs := newMockedFSock(t, m, nil)
+	for _, tc := range []struct {
+		name    string
+		val     string
+		present bool
+	}{
+		{"cgr_reqtype", "*prepaid", true},
+		{"cgr_account", "", true},
+		{"cgr_missing", "", false},
+	} {
+		if val, present, err := fs.GetVar("4c882cc4", tc.name); err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		} else if val != tc.val || present != tc.present {
+			t.Errorf("%s: \nExpected: <%q, %v>, \nReceived: <%q, %v>", tc.name, tc.val, tc.present, val, present)
+		}
+	}
+	m.waitCommand(t, 0, "api uuid_getvar 4c882cc4 cgr_missing")
+	if _, _, err := fs.GetVar("d6e5b5ac", "cgr_reqtype"); err != ErrCallNotFound {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrCallNotFound, err)
+	}
+	if _, _, err := fs.GetVar("4c882cc4", " "); err == nil || err.Error() != "Need variable name" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "Need variable name", err)
+	}
+}
+
+func TestAPIGlobalSetVar(t *testing.T) {
+	m := newFSMock(t)
+	fs := newMockedFSock(t, m, nil)
+	if err := fs.GlobalSetVar("outbound_caller_id", "1001"); err != nil {
+		t.Error(err)
+	}
+	m.waitCommand(t, 0, "api global_setvar outbound_caller_id=1001")
+	if err := fs.GlobalSetVar("", "1001"); err == nil || err.Error() != "Need variable name" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "Need variable name", err)
+	}
+}
+
+func TestAPIServerTime(t *testing.T) {
+	m := newFSMock(t)
+	rply := "2023-01-31 14:21:15 +0200\n"
+	m.apiReply = func(string) string { return rply }
+	fs := newMockedFSock(t, m, nil)
+	exp := time.Date(2023, 1, 31, 12, 21, 15, 0, time.UTC)
+	if rcv, err := fs.ServerTime(); err != nil {
+		t.Error(err)
+	} else if !rcv.Equal(exp) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, rcv)
+	} else if _, offset := rcv.Zone(); offset != 2*3600 {
+		t.Errorf("Expected the server offset kept, received: %d", offset)
+	}
+	m.waitCommand(t, 0, "api strftime %Y-%m-%d %H:%M:%S %z")
+	rply = "2023-01-31 14:21:15\n"
+	if _, err := fs.ServerTime(); err == nil || err.Error() != "Invalid strftime reply: <2023-01-31 14:21:15>" {
+		t.Errorf("Unexpected error: <%v>", err)
+	}
+}
+
+func TestAPILimitUsage(t *testing.T) {
+	m := newFSMock(t)
+	m.apiReply = func(cmd string) string {
+		switch cmd {
+		case "limit_usage hash outbound gw1":
+			return "3/10\n"
+		case "limit_usage db outbound gw1":
+			return "7\n"
+		case "limit_usage redis outbound gw1":
+			return "-ERR Invalid limit backend: redis\n"
+		case "limit_usage hash outbound bad":
+			return "many\n"
+		}
+		return ""
+	}
+	fs := newMockedFSock(t, m, nil)
+	if cur, max, err := fs.LimitUsage("hash", "outbound", "gw1"); err != nil {
+		t.Error(err)
+	} else if cur != 3 || max != 10 {
+		t.Errorf("Expected 3/10, received: %d/%d", cur, max)
+	}
+	if cur, max, err := fs.LimitUsage("db", "outbound", "gw1"); err != nil {
+		t.Error(err)
+	} else if cur != 7 || max != 0 {
+		t.Errorf("Expected 7/0, received: %d/%d", cur, max)
+	}
+	for _, backend := range []string{"redis", "missing"} {
+		if _, _, err := fs.LimitUsage(backend, "outbound", "gw1"); err != ErrLimitNotConfigured {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrLimitNotConfigured, err)
+		}
+	}
+	if _, _, err := fs.LimitUsage("hash", "outbound", "bad"); err == nil || err.Error() != "Invalid limit_usage reply: <many>" {
+		t.Errorf("Unexpected error: <%v>", err)
+	}
+	if _, _, err := fs.LimitUsage("hash", "", "gw1"); err == nil || err.Error() != "Need backend, realm and resource" {
+		t.Errorf("Unexpected error: <%v>", err)
+	}
+}
+
+func TestAPIChannelsStream(t *testing.T) {
+	const rows = 5000
+	hdr := "uuid,direction,created,created_epoch,name,state,cid_name,cid_num,ip_addr,dest,application,application_data," +
+		"dialplan,context,read_codec,read_rate,read_bit_rate,write_codec,write_rate,write_bit_rate,secure,hostname," +
+		"presence_id,presence_data,callstate,callee_name,callee_num,callee_direction,call_uuid,sent_callee_name,sent_callee_num\n"
+	var sb strings.Builder
+	sb.WriteString(hdr)
+	for i := 0; i < rows; i++ {
+		fmt.Fprintf(&sb, "uuid-%d,inbound,2014-10-26 18:08:32,1414343312,sofia/internal/%d@172.16.254.66,CS_EXECUTE,"+
+			"dan,%d,172.16.254.66,1002,bridge,[sip_h_X-EpTransport=udp]sofia/ipbxas/dan@172.16.254.1:5060,XML,default,"+
+			"PCMA,8000,64000,PCMA,8000,64000,,iPBXDev,,,ACTIVE,,,,uuid-%d,,\n", i, i, i, i)
+	}
+	sb.WriteString("malformed,row\n")
+	fmt.Fprintf(&sb, "\n%d total.\n", rows)
+	m := newFSMock(t)
+	var empty bool
+	m.apiReply = func(cmd string) string {
+		if empty {
+			return "\n0 total.\n"
+		}
+		return sb.String()
+	}
+	fs := newMockedFSock(t, m, nil)
+	chs, err := fs.ChannelsStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	for chs.Next() {
+		ch := chs.Channel()
+		if uuid := fmt.Sprintf("uuid-%d", n); ch.UUID != uuid || ch.CallUUID != uuid || ch.CIDNum != strconv.Itoa(n) {
+			t.Fatalf("Unexpected channel %d: %+v", n, ch)
+		}
+		if ch.ApplicationData != "[sip_h_X-EpTransport=udp]sofia/ipbxas/dan@172.16.254.1:5060" || ch.Fields["dialplan"] != "XML" {
+			t.Fatalf("Unexpected channel %d: %+v", n, ch)
+		}
+		n++
+	}
+	if n != rows || chs.Total() != rows {
+		t.Errorf("Expected %d channels, received: %d, total: %d", rows, n, chs.Total())
+	}
+	m.waitCommand(t, 0, "api show channels")
+	empty = true
+	if chs, err = fs.ChannelsStream(); err != nil {
+		t.Fatal(err)
+	} else if chs.Next() || chs.Total() != 0 {
+		t.Errorf("Expected no channels, total: %d", chs.Total())
+	}
+}
+
+func TestAPISendJSONAPI(t *testing.T) {
+	m := newFSMock(t)
+	m.apiReply = func(cmd string) string {
+		switch cmd {
+		case `json {"command":"status"}`:
+			return `{"command":"status","data":"","status":"success","response":{"systemStatus":"ready","sessions":{"count":{"active":2}}}}`
+		case `json {"command":"mod_sofia.status","data":{"profile":"missing"}}`:
+			return `{"command":"mod_sofia.status","status":"error","message":"Invalid profile"}`
+		}
+		return "-ERR no reply\n"
+	}
+	fs := newMockedFSock(t, m, nil)
+	rply, err := fs.SendJSONAPI("status", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := `{"systemStatus":"ready","sessions":{"count":{"active":2}}}`; string(rply) != exp {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, string(rply))
+	}
+	m.waitCommand(t, 0, `api json {"command":"status"}`)
+	if _, err = fs.SendJSONAPI("mod_sofia.status", map[string]string{"profile": "missing"}); err == nil ||
+		err.Error() != "json api mod_sofia.status failed: <Invalid profile>" {
+		t.Errorf("Unexpected error: <%v>", err)
+	}
+	if _, err = fs.SendJSONAPI("unknown", nil); !isReplyError(err) {
+		t.Errorf("Unexpected error: <%v>", err)
+	}
+	if _, err = fs.SendJSONAPI("status", make(chan int)); err == nil {
+		t.Error("Expected error for data not encodable as json")
+	}
+}
+
+func TestAPICalls(t *testing.T) {
+	m := newFSMock(t)
+	m.apiReply = func(cmd string) string {
+		if cmd != "show calls as json" {
+			return "-ERR no reply\n"
+		}
+		return `{"row_count":2,"rows":[{"uuid":"a1f3c9e2","direction":"inbound","created":"2023-01-31 14:21:15",` +
+			`"created_epoch":"1675167675","name":"sofia/internal/1001@192.168.56.74","state":"CS_EXCHANGE_MEDIA",` +
+			`"cid_name":"1001","cid_num":"1001","ip_addr":"192.168.56.1","dest":"1002","callstate":"ACTIVE",` +
+			`"call_uuid":"a1f3c9e2","call_created_epoch":"1675167676","b_uuid":"b7d4e0a1","b_direction":"outbound",` +
+			`"b_created":"2023-01-31 14:21:16","b_created_epoch":"1675167676","b_name":"sofia/internal/1002@192.168.56.1:5060",` +
+			`"b_state":"CS_EXCHANGE_MEDIA","b_cid_name":"1001","b_cid_num":"1001","b_dest":"1002","b_callstate":"ACTIVE"},` +
+			`{"uuid":"c2e5f1b3","direction":"inbound","created":"2023-01-31 14:22:00","created_epoch":"1675167720",` +
+			`"name":"sofia/internal/1003@192.168.56.74","state":"CS_EXECUTE","cid_name":"1003","cid_num":"1003",` +
+			`"dest":"9196","callstate":"ACTIVE","call_uuid":"","call_created_epoch":"","b_uuid":"","b_direction":"",` +
+			`"b_name":"","b_state":"","b_cid_name":"","b_cid_num":"","b_dest":"","b_callstate":""}]}` + "\n"
+	}
+	fs := newMockedFSock(t, m, nil)
+	calls, err := fs.Calls()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []Call{
+		{
+			Created: time.Unix(1675167676, 0),
+			A: CallLeg{UUID: "a1f3c9e2", Direction: "inbound", Name: "sofia/internal/1001@192.168.56.74",
+				State: "CS_EXCHANGE_MEDIA", CallState: "ACTIVE", CIDName: "1001", CIDNum: "1001", Dest: "1002"},
+			B: &CallLeg{UUID: "b7d4e0a1", Direction: "outbound", Name: "sofia/internal/1002@192.168.56.1:5060",
+				State: "CS_EXCHANGE_MEDIA", CallState: "ACTIVE", CIDName: "1001", CIDNum: "1001", Dest: "1002"},
+		},
+		{
+			Created: time.Unix(1675167720, 0),
+			A: CallLeg{UUID: "c2e5f1b3", Direction: "inbound", Name: "sofia/internal/1003@192.168.56.74",
+				State: "CS_EXECUTE", CallState: "ACTIVE", CIDName: "1003", CIDNum: "1003", Dest: "9196"},
+		},
+	}
+	if !reflect.DeepEqual(exp, calls) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, calls)
+	}
+	m.apiReply = func(string) string { return `{"row_count":0}` + "\n" }
+	if calls, err = fs.Calls(); err != nil {
+		t.Error(err)
+	} else if calls == nil || len(calls) != 0 {
+		t.Errorf("Expected no calls, received: %+v", calls)
+	}
+}
+
+func TestAPIRegistrations(t *testing.T) {
+	m := newFSMock(t)
+	m.apiReply = func(cmd string) string {
+		if cmd == "show registrations as json" {
+			return `{"row_count":1,"rows":[{"reg_user":"1001","realm":"192.168.56.74","token":"a4e2@192.168.56.1",` +
+				`"url":"sofia/internal/sip:1001@192.168.56.1:5060","expires":"1675160475","network_ip":"192.168.56.1",` +
+				`"network_port":"5060","network_proto":"udp","hostname":"fs1","metadata":""}]}` + "\n"
+		}
+		return ""
+	}
+	fs := newMockedFSock(t, m, nil)
+	exp := []Registration{{
+		RegUser:      "1001",
+		Realm:        "192.168.56.74",
+		Token:        "a4e2@192.168.56.1",
+		URL:          "sofia/internal/sip:1001@192.168.56.1:5060",
+		Expires:      "1675160475",
+		NetworkIP:    "192.168.56.1",
+		NetworkPort:  "5060",
+		NetworkProto: "udp",
+		Hostname:     "fs1",
+	}}
+	if regs, err := fs.Registrations(); err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(exp, regs) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, regs)
+	}
+
+	m.apiReply = func(cmd string) string { // CSV only
+		if cmd == "show registrations" {
+			return "reg_user,realm,token,url,expires,network_ip,network_port,network_proto,hostname,metadata\n" +
+				"1001,192.168.56.74,a4e2@192.168.56.1,sofia/internal/sip:1001@192.168.56.1:5060,1675160475,192.168.56.1,5060,udp,fs1,\n" +
+				"\n1 total.\n\n"
+		}
+		return "-ERR unsupported\n"
+	}
+	if regs, err := fs.Registrations(); err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(exp, regs) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, regs)
+	}
+
+	m.apiReply = func(cmd string) string { return `{"row_count":0}` + "\n" }
+	if regs, err := fs.Registrations(); err != nil {
+		t.Error(err)
+	} else if len(regs) != 0 {
+		t.Errorf("Expected no registrations, received: %+v", regs)
+	}
+
+	unblock := make(chan struct{})
+	defer close(unblock)
+	m.apiReply = func(cmd string) string {
+		<-unblock // no reply
+		return "+OK\n"
+	}
+	fs.SetReplyTimeout(20 * time.Millisecond)
+	sent := len(m.commands(0))
+	if _, err := fs.Registrations(); err != ErrReplyTimeout {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrReplyTimeout, err)
+	}
+	if rcv := len(m.commands(0)) - sent; rcv != 1 { // no CSV fallback on the transport errors
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 1, rcv)
+	}
+}
+
+func TestAPICallStatus(t *testing.T) {
+	m := newFSMock(t)
+	m.apiReply = func(cmd string) string {
+		switch cmd {
+		case "uuid_dump 4c882cc4-cd02-11e6-8b82-395b501876f9":
+			return `Event-Name: CHANNEL_DATA
+Core-UUID: 651a8db2-4f67-4cf3-b4c0-b5fd2b8a7a11
+FreeSWITCH-Hostname: fs1
+Channel-State: CS_EXECUTE
+Channel-Call-State: ACTIVE
+Channel-State-Number: 4
+Channel-Name: sofia/internal/1001%40192.168.56.74
+Unique-ID: 4c882cc4-cd02-11e6-8b82-395b501876f9
+Call-Direction: inbound
+Answer-State: answered
+Caller-Direction: inbound
+Caller-Username: 1001
+Caller-Caller-ID-Name: Extension%201001
+Caller-Caller-ID-Number: 1001
+Caller-Destination-Number: 1002
+Caller-Context: default
+Other-Leg-Unique-ID: 4ca6ef1a-cd02-11e6-8b82-395b501876f9
+variable_direction: inbound
+variable_uuid: 4c882cc4-cd02-11e6-8b82-395b501876f9
+variable_sip_from_user: 1001
+variable_sip_from_uri: 1001%40192.168.56.74
+variable_cgr_reqtype: *prepaid
+`
+		case "uuid_dump 00000000-0000-0000-0000-000000000000":
+			return "-ERR No such channel!\n"
+		}
+		return ""
+	}
+	fs := newMockedFSock(t, m, nil)
+	exp := &CallStatus{
+		UUID:              "4c882cc4-cd02-11e6-8b82-395b501876f9",
+		Direction:         "inbound",
+		ChannelName:       "sofia/internal/1001@192.168.56.74",
+		ChannelState:      "CS_EXECUTE",
+		CallState:         "ACTIVE",
+		AnswerState:       "answered",
+		CallerIDName:      "Extension 1001",
+		CallerIDNumber:    "1001",
+		DestinationNumber: "1002",
+		Context:           "default",
+		OtherLegUUID:      "4ca6ef1a-cd02-11e6-8b82-395b501876f9",
+		Variables: map[string]string{
+			"direction":     "inbound",
+			"uuid":          "4c882cc4-cd02-11e6-8b82-395b501876f9",
+			"sip_from_user": "1001",
+			"sip_from_uri":  "1001@192.168.56.74",
+			"cgr_reqtype":   "*prepaid",
+		},
+	}
+	if cs, err := fs.CallStatus("4c882cc4-cd02-11e6-8b82-395b501876f9"); err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(exp, cs) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, cs)
+	}
+	if _, err := fs.CallStatus("00000000-0000-0000-0000-000000000000"); err != ErrCallNotFound {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrCallNotFound, err)
+	}
+	if _, err := fs.CallStatus(""); err == nil || err.Error() != "Need call UUID" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "Need call UUID", err)
+	}
+}
+
+func TestAPIBroadcast(t *testing.T) {
+	m := newFSMock(t)
+	m.apiReply = func(cmd string) string {
+		if strings.HasPrefix(cmd, "uuid_broadcast 00000000-0000-0000-0000-000000000000") {
+			return "-ERR No such channel!\n"
+		}
+		return "+OK Message sent\n"
+	}
+	fs := newMockedFSock(t, m, nil)
+	if err := fs.Broadcast("4c882cc4-cd02-11e6-8b82-395b501876f9", "/tmp/welcome.wav", "both"); err != nil {
+		t.Error(err)
+	}
+	m.waitCommand(t, 0, "api uuid_broadcast 4c882cc4-cd02-11e6-8b82-395b501876f9 /tmp/welcome.wav both")
+	if err := fs.Broadcast("4c882cc4-cd02-11e6-8b82-395b501876f9", "/tmp/welcome.wav", ""); err != nil {
+		t.Error(err)
+	}
+	m.waitCommand(t, 0, "api uuid_broadcast 4c882cc4-cd02-11e6-8b82-395b501876f9 /tmp/welcome.wav aleg")
+	if err := fs.Broadcast("4c882cc4-cd02-11e6-8b82-395b501876f9", "/tmp/welcome.wav", "cleg"); err != ErrInvalidLeg {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrInvalidLeg, err)
+	}
+	if err := fs.Broadcast("00000000-0000-0000-0000-000000000000", "/tmp/welcome.wav", "aleg"); err != ErrCallNotFound {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrCallNotFound, err)
+	}
+}
+
+func TestAPIGetVars(t *testing.T) {
+	m := newFSMock(t)
+	m.apiReply = func(cmd string) string {
+		switch cmd {
+		case "uuid_dump 4c882cc4-cd02-11e6-8b82-395b501876f9":
+			return `Event-Name: CHANNEL_DATA
+Channel-State: CS_EXECUTE
+Unique-ID: 4c882cc4-cd02-11e6-8b82-395b501876f9
+variable_sip_from_user: 1001
+variable_sip_from_uri: 1001%40192.168.56.74
+variable_cgr_reqtype: *prepaid
+`
+		case "uuid_dump 00000000-0000-0000-0000-000000000000":
+			return "-ERR No such channel!\n"
+		}
+		return ""
+	}
+	fs := newMockedFSock(t, m, nil)
+	exp := map[string]string{"sip_from_uri": "1001@192.168.56.74", "cgr_reqtype": "*prepaid"}
+	if vars, err := fs.GetVars("4c882cc4-cd02-11e6-8b82-395b501876f9", "sip_from_uri", "cgr_reqtype", "cgr_account"); err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(exp, vars) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, vars)
+	}
+	exp["sip_from_user"] = "1001"
+	if vars, err := fs.GetVars("4c882cc4-cd02-11e6-8b82-395b501876f9"); err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(exp, vars) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, vars)
+	}
+	if _, err := fs.GetVars("00000000-0000-0000-0000-000000000000", "cgr_reqtype"); err != ErrCallNotFound {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrCallNotFound, err)
+	}
+}
+
+func TestAPITransfer(t *testing.T) {
+	m := newFSMock(t)
+	m.apiReply = func(cmd string) string {
+		if strings.HasPrefix(cmd, "uuid_transfer 00000000-0000-0000-0000-000000000000") {
+			return "-ERR No such channel!\n"
+		}
+		return "+OK\n"
+	}
+	fs := newMockedFSock(t, m, nil)
+	uuid := "4c882cc4-cd02-11e6-8b82-395b501876f9"
+	for _, tc := range []struct {
+		dest, dialplan, dpContext, leg string
+		exp                            string
+	}{
+		{"1002", "XML", "default", "aleg", "api uuid_transfer " + uuid + " 1002 XML default"},
+		{"1003", "", "", "bleg", "api uuid_transfer " + uuid + " -bleg 1003"},
+		{"1004", "", "public", "both", "api uuid_transfer " + uuid + " -both 1004 XML public"},
+		{"1005", "", "", "", "api uuid_transfer " + uuid + " 1005"},
+	} {
+		if err := fs.Transfer(uuid, tc.dest, tc.dialplan, tc.dpContext, tc.leg); err != nil {
+			t.Error(err)
+		}
+		m.waitCommand(t, 0, tc.exp)
+	}
+	if err := fs.Transfer(uuid, "1002", "", "", "cleg"); err != ErrInvalidLeg {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrInvalidLeg, err)
+	}
+	if err := fs.Transfer(uuid, " ", "", "", ""); err == nil || err.Error() != "Need transfer destination" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "Need transfer destination", err)
+	}
+	if err := fs.Transfer("00000000-0000-0000-0000-000000000000", "1002", "", "", ""); err != ErrCallNotFound {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrCallNotFound, err)
+	}
+}
+
+func TestAPIConferenceList(t *testing.T) {
+	m := newFSMock(t)
+	m.apiReply = func(cmd string) string {
+		switch cmd {
+		case "conference 3000 list":
+			return "2;sofia/internal/1002@192.168.56.74;7a3b2c1d-cd02-11e6-8b82-395b501876f9;Bob (Sales;EU);1002;hear|speak|talking|floor;0;0;100\n" +
+				"1;sofia/internal/1001@192.168.56.74;4c882cc4-cd02-11e6-8b82-395b501876f9;Alice;1001;hear|speak;-1;2;300\n"
+		case "conference 3001 list":
+			return "-ERR Conference 3001 not found\n"
+		case "conference 3002 list":
+			return "Conference 3002 not found\n"
+		}
+		return ""
+	}
+	fs := newMockedFSock(t, m, nil)
+	exp := []ConferenceMember{
+		{
+			ID:             2,
+			ChannelName:    "sofia/internal/1002@192.168.56.74",
+			UUID:           "7a3b2c1d-cd02-11e6-8b82-395b501876f9",
+			CallerIDName:   "Bob (Sales;EU)",
+			CallerIDNumber: "1002",
+			Flags:          []string{"hear", "speak", "talking", "floor"},
+			EnergyLevel:    100,
+		},
+		{
+			ID:             1,
+			ChannelName:    "sofia/internal/1001@192.168.56.74",
+			UUID:           "4c882cc4-cd02-11e6-8b82-395b501876f9",
+			CallerIDName:   "Alice",
+			CallerIDNumber: "1001",
+			Flags:          []string{"hear", "speak"},
+			VolumeIn:       -1,
+			VolumeOut:      2,
+			EnergyLevel:    300,
+		},
+	}
+	if members, err := fs.ConferenceList("3000"); err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(exp, members) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, members)
+	}
+	for _, name := range []string{"3001", "3002"} {
+		if _, err := fs.ConferenceList(name); err != ErrConferenceNotFound {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrConferenceNotFound, err)
+		}
+	}
+	if members, err := fs.ConferenceList("3003"); err != nil {
+		t.Error(err)
+	} else if len(members) != 0 {
+		t.Errorf("Expected no members, received: %+v", members)
+	}
+	expErr := "Malformed conference member: <1;sofia/internal/1001@192.168.56.74>"
+	if _, err := parseConferenceMember("1;sofia/internal/1001@192.168.56.74"); err == nil || err.Error() != expErr {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", expErr, err)
+	}
+}
+
+func TestAPIConferenceControl(t *testing.T) {
+	m := newFSMock(t)
+	m.apiReply = func(cmd string) string {
+		switch {
+		case strings.HasPrefix(cmd, "conference 3001 "):
+			return "Conference 3001 not found\n"
+		case strings.HasSuffix(cmd, " 99"):
+			return "Non-Existant ID 99\n"
+		case strings.HasPrefix(cmd, "conference 3000 play /tmp/missing.wav"):
+			return "(play) File: /tmp/missing.wav not found.\n"
+		case strings.HasPrefix(cmd, "conference 3000 play "):
+			return "(play) Playing file " + strings.TrimPrefix(cmd, "conference 3000 play ") + "\n"
+		}
+		return "OK " + strings.TrimPrefix(cmd, "conference 3000 ") + "\n"
+	}
+	fs := newMockedFSock(t, m, nil)
+	if err := fs.ConferenceKick("3000", "5"); err != nil {
+		t.Error(err)
+	}
+	if err := fs.ConferenceMute("3000", "all"); err != nil {
+		t.Error(err)
+	}
+	if err := fs.ConferencePlay("3000", "/tmp/welcome.wav"); err != nil {
+		t.Error(err)
+	}
+	if exp, rcv := []string{"api conference 3000 kick 5", "api conference 3000 mute all",
+		"api conference 3000 play /tmp/welcome.wav"}, m.commands(0)[len(m.commands(0))-3:]; !reflect.DeepEqual(exp, rcv) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, rcv)
+	}
+	for _, memberID := range []string{"", "abc", "-1", "0", "5;hangup"} {
+		if err := fs.ConferenceKick("3000", memberID); err == nil || !strings.HasPrefix(err.Error(), "Invalid conference member id") {
+			t.Errorf("%q: unexpected error: <%v>", memberID, err)
+		}
+	}
+	if err := fs.ConferenceKick("3000", "99"); err != ErrMemberNotFound {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrMemberNotFound, err)
+	}
+	if err := fs.ConferenceMute("3000", "99"); err != ErrMemberNotFound {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrMemberNotFound, err)
+	}
+	if err := fs.ConferenceMute("3001", "5"); err != ErrConferenceNotFound {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrConferenceNotFound, err)
+	}
+	if err := fs.ConferencePlay("3000", "/tmp/missing.wav"); err == nil {
+		t.Error("Expected error for the missing file")
+	}
+	if err := fs.ConferencePlay(" ", "/tmp/welcome.wav"); err == nil || err.Error() != "Need conference name" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "Need conference name", err)
+	}
+}
+
+func TestAPIBridge(t *testing.T) {
+	m := newFSMock(t)
+	m.apiReply = func(cmd string) string {
+		if strings.Contains(cmd, "00000000-0000-0000-0000-000000000000") {
+			return "-ERR No such channel 00000000-0000-0000-0000-000000000000!\n"
+		}
+		return "+OK 4c882cc4-cd02-11e6-8b82-395b501876f9\n"
+	}
+	fs := newMockedFSock(t, m, nil)
+	uuidA, uuidB := "4c882cc4-cd02-11e6-8b82-395b501876f9", "5e0b1e2a-cd02-11e6-8b82-395b501876f9"
+	if err := fs.Bridge(uuidA, uuidB); err != nil {
+		t.Error(err)
+	}
+	m.waitCommand(t, 0, "api uuid_bridge "+uuidA+" "+uuidB)
+	err := fs.Bridge(uuidA, "00000000-0000-0000-0000-000000000000")
+	var bErr *BridgeError
+	if !errors.As(err, &bErr) {
+		t.Fatalf("\nExpected: <%T>, \nReceived: <%+v>", bErr, err)
+	}
+	exp := &BridgeError{UUIDA: uuidA, UUIDB: "00000000-0000-0000-0000-000000000000",
+		Reply: "-ERR No such channel 00000000-0000-0000-0000-000000000000!"}
+	if !reflect.DeepEqual(exp, bErr) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, bErr)
+	}
+	if !errors.Is(err, ErrCallNotFound) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrCallNotFound, err)
+	}
+	if err := fs.Bridge(uuidA, " "); err == nil || err.Error() != "Need call UUID" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "Need call UUID", err)
+	}
+	if err := fs.Bridge(uuidA, uuidA); err == nil || err.Error() != "Cannot bridge a call to itself" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "Cannot bridge a call to itself", err)
+	}
+}
+
+func TestAPIPark(t *testing.T) {
+	m := newFSMock(t)
+	m.cmdReply = func(cmd string) string {
+		switch uuid := strings.Fields(cmd)[1]; {
+		case !strings.HasPrefix(cmd, "sendmsg "):
+		case uuid == "gone":
+			return "-ERR invalid session id [gone]"
+		case uuid == "hungup":
+			go m.sendEvent(0, "Event-Name: CHANNEL_HANGUP\nUnique-ID: hungup\n")
+		case uuid != "unconfirmed":
+			go m.sendEvent(0, "Event-Name: CHANNEL_PARK\nUnique-ID: other\n")
+			go m.sendEvent(0, "Event-Name: CHANNEL_PARK\nUnique-ID: "+uuid+"\n")
+		}
+		return "+OK"
+	}
+	fs := newMockedFSock(t, m, map[string][]func(string, int){
+		"CHANNEL_PARK":   {func(string, int) {}},
+		"CHANNEL_HANGUP": {func(string, int) {}},
+	}, WithReplyTimeout(100*time.Millisecond))
+	uuid := "4c882cc4-cd02-11e6-8b82-395b501876f9"
+	if err := fs.Park(uuid); err != nil {
+		t.Error(err)
+	}
+	m.waitCommand(t, 0, "sendmsg "+uuid+"\ncall-command: execute\nexecute-app-name: park")
+	for uuid, exp := range map[string]error{
+		"gone":        ErrChannelGone,
+		"hungup":      ErrChannelGone,
+		"unconfirmed": ErrParkNotConfirmed,
+	} {
+		if err := fs.Park(uuid); err != exp {
+			t.Errorf("%s: \nExpected: <%+v>, \nReceived: <%+v>", uuid, exp, err)
+		}
+	}
+	if err := fs.Park(" "); err == nil || err.Error() != "Need call UUID" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "Need call UUID", err)
+	}
+}
+
+func TestAPIRetrieve(t *testing.T) {
+	m := newFSMock(t)
+	m.apiReply = func(cmd string) string {
+		if strings.Contains(cmd, "00000000-0000-0000-0000-000000000000") {
+			return "-ERR No such channel 00000000-0000-0000-0000-000000000000!\n"
+		}
+		return "+OK 4c882cc4-cd02-11e6-8b82-395b501876f9\n"
+	}
+	fs := newMockedFSock(t, m, nil)
+	uuid, agent := "4c882cc4-cd02-11e6-8b82-395b501876f9", "5e0b1e2a-cd02-11e6-8b82-395b501876f9"
+	if err := fs.Retrieve(uuid, agent); err != nil {
+		t.Error(err)
+	}
+	m.waitCommand(t, 0, "api uuid_bridge "+uuid+" "+agent)
+	if err := fs.Retrieve("00000000-0000-0000-0000-000000000000", agent); err != ErrChannelGone {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrChannelGone, err)
+	}
+}
+
+func TestAPIHupAll(t *testing.T) {
+	m := newFSMock(t)
+	m.apiReply = func(cmd string) string {
+		if strings.Contains(cmd, "failing") {
+			return "-ERR failed\n"
+		}
+		return "+OK hangup all channels with cause NORMAL_CLEARING\n"
+	}
+	fs := newMockedFSock(t, m, nil)
+	if err := fs.HupAll("NORMAL_CLEARING", "", ""); err != nil {
+		t.Error(err)
+	}
+	m.waitCommand(t, 0, "api hupall NORMAL_CLEARING")
+	if err := fs.HupAll("16", "cgr_account", "1001"); err != nil {
+		t.Error(err)
+	}
+	m.waitCommand(t, 0, "api hupall 16 cgr_account 1001")
+	if err := fs.HupAll("MANAGER_REQUEST", "failing", "1"); err == nil || err.Error() != "-ERR failed" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "-ERR failed", err)
+	}
+	for _, cause := range []string{"", "normal_clearing", "NORMAL CLEARING", "NOT_A_CAUSE", "HELLO", "0", "128", "-16", "+16"} {
+		if err := fs.HupAll(cause, "", ""); err != ErrInvalidHangupCause {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrInvalidHangupCause, err)
+		}
+	}
+	if err := fs.HupAll("NORMAL_CLEARING", "cgr_account", ""); err == nil || err.Error() != "Need variable value" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "Need variable value", err)
+	}
+	if err := fs.HupAll("NORMAL_CLEARING", "", "1001"); err == nil || err.Error() != "Need variable name" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "Need variable name", err)
+	}
+	if err := fs.HupAll("NORMAL_CLEARING", "cgr_account", "10 01"); err == nil {
+		t.Error("Expected error for the value with spaces")
+	}
+}
+
+func TestAPIOriginateToApp(t *testing.T) {
+	m := newFSMock(t)
+	m.apiReply = func(cmd string) string {
+		switch {
+		case strings.Contains(cmd, "user/slow"):
+			time.Sleep(100 * time.Millisecond)
+			return "-ERR NO_ANSWER\n"
+		case strings.Contains(cmd, "user/busy"):
+			return "-ERR USER_BUSY\n"
+		case strings.HasPrefix(cmd, "originate {origination_uuid="):
+			uuid := strings.TrimPrefix(cmd, "originate {origination_uuid=")
+			return "+OK " + uuid[:strings.IndexAny(uuid, ",}")] + "\n"
+		}
+		return "+OK\n"
+	}
+	fs := newMockedFSock(t, m, nil)
+	uuid, err := fs.OriginateToApp(context.Background(), "user/1001", "playback", "/tmp/hello world.wav", &OriginateOptions{
+		UUID:    "d6e5b5ac-4f54-4b52-9b84-ab2d7c3a0f6e",
+		Vars:    map[string]string{"origination_caller_id_name": "O'Brien", "sip_h_X-Tags": "a,b"},
+		Timeout: 1500 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if uuid != "d6e5b5ac-4f54-4b52-9b84-ab2d7c3a0f6e" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "d6e5b5ac-4f54-4b52-9b84-ab2d7c3a0f6e", uuid)
+	}
+	m.waitCommand(t, 0, `api originate {origination_uuid=d6e5b5ac-4f54-4b52-9b84-ab2d7c3a0f6e,originate_timeout=2,`+
+		`origination_caller_id_name='O\'Brien',sip_h_X-Tags=a\,b}user/1001 '&playback(/tmp/hello world.wav)'`)
+	if uuid, err = fs.OriginateToApp(context.Background(), "user/1002", "park", "", nil); err != nil { // generated UUID
+		t.Fatal(err)
+	} else if len(uuid) != 36 {
+		t.Errorf("Unexpected UUID: <%s>", uuid)
+	}
+	m.waitCommand(t, 0, "api originate {origination_uuid="+uuid+"}user/1002 &park()")
+	if _, err = fs.OriginateToApp(context.Background(), "user/busy", "park", "", nil); err == nil || err.Error() != "-ERR USER_BUSY" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "-ERR USER_BUSY", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err = fs.OriginateToApp(ctx, "user/slow", "park", "", nil); err != context.DeadlineExceeded {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", context.DeadlineExceeded, err)
+	}
+	if rply, err := fs.SendApiCmd("status"); err != nil || rply != "+OK\n" { // the late reply discarded
+		t.Errorf("\nExpected: %q, \nReceived: %q, <%v>", "+OK\n", rply, err)
+	}
+	for _, args := range [][2]string{{"", "park"}, {"user/10 01", "park"}, {"user/1001", ""}, {"user/1001", "park()"}} {
+		if _, err = fs.OriginateToApp(context.Background(), args[0], args[1], "", nil); err == nil {
+			t.Errorf("Expected error for <%+v>", args)
+		}
+	}
+}
+
+func TestAPIOriginateToConference(t *testing.T) {
+	m := newFSMock(t)
+	m.apiReply = func(cmd string) string {
+		switch {
+		case cmd == "conference missing list":
+			return "Conference missing not found\n"
+		case strings.HasPrefix(cmd, "conference "):
+			return ""
+		case strings.HasPrefix(cmd, "originate {origination_uuid="):
+			uuid := strings.TrimPrefix(cmd, "originate {origination_uuid=")
+			return "+OK " + uuid[:strings.IndexAny(uuid, ",}")] + "\n"
+		}
+		return "+OK\n"
+	}
+	fs := newMockedFSock(t, m, nil)
+	uuid, err := fs.OriginateToConference(context.Background(), "user/1001", "room1", &ConferenceOriginateOptions{
+		OriginateOptions: OriginateOptions{UUID: "d6e5b5ac-4f54-4b52-9b84-ab2d7c3a0f6e", Timeout: 30 * time.Second},
+		Profile:          "wideband",
+		Flags:            []string{"mute", "moderator"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if uuid != "d6e5b5ac-4f54-4b52-9b84-ab2d7c3a0f6e" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "d6e5b5ac-4f54-4b52-9b84-ab2d7c3a0f6e", uuid)
+	}
+	m.waitCommand(t, 0, "api originate {origination_uuid=d6e5b5ac-4f54-4b52-9b84-ab2d7c3a0f6e,originate_timeout=30}"+
+		"user/1001 &conference(room1@wideband+flags{mute|moderator})")
+	if uuid, err = fs.OriginateToConference(context.Background(), "user/1002", "room1",
+		&ConferenceOriginateOptions{MustExist: true}); err != nil {
+		t.Fatal(err)
+	}
+	m.waitCommand(t, 0, "api originate {origination_uuid="+uuid+"}user/1002 &conference(room1)")
+	sent := len(m.commands(0))
+	if _, err = fs.OriginateToConference(context.Background(), "user/1003", "missing",
+		&ConferenceOriginateOptions{MustExist: true}); err != ErrConferenceNotFound {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrConferenceNotFound, err)
+	}
+	for _, args := range [][2]string{{"", "room1"}, {"user/10 01", "room1"}, {"user/1001", ""}, {"user/1001", "room 1"},
+		{"user/1001", "room1@default"}} {
+		if _, err = fs.OriginateToConference(context.Background(), args[0], args[1], nil); err == nil {
+			t.Errorf("Expected error for <%+v>", args)
+		}
+	}
+	if exp, rcv := []string{"api conference missing list"}, m.commands(0)[sent:]; !reflect.DeepEqual(exp, rcv) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, rcv) // no originate for the failures
+	}
+}
+func TestAPIGateways(t *testing.T) {
+	m := newFSMock(t)
+	m.apiReply = func(cmd string) string {
+		switch cmd {
+		case "sofia status profile external":
+			return `=================================================================================================
+Name             	external
+Domain Name      	N/A
+Auto-NAT         	false
+DBName           	sofia_reg_external
+Dialplan         	XML
+Context          	public
+RTP-IP           	192.168.56.74
+SIP-IP           	192.168.56.74
+URL              	sip:mod_sofia@192.168.56.74:5080
+BIND-URL         	sip:mod_sofia@192.168.56.74:5080;maddr=192.168.56.74
+=================================================================================================
+`
+		case "sofia status profile missing":
+			return "Invalid Profile!\n"
+		case "sofia xmlstatus gateway":
+			return `<?xml version="1.0" encoding="ISO-8859-1"?>
+<gateways>
+  <gateway>
+    <name>carrier1</name>
+    <profile>external</profile>
+    <scheme>Digest</scheme>
+    <realm>sip.carrier1.com</realm>
+    <username>1001</username>
+    <password>yes</password>
+    <from>&lt;sip:1001@sip.carrier1.com&gt;</from>
+    <contact>&lt;sip:gw+carrier1@192.168.56.74:5080;transport=udp;gw=carrier1&gt;</contact>
+    <exten>1001</exten>
+    <to>sip:1001@sip.carrier1.com</to>
+    <proxy>sip:sip.carrier1.com</proxy>
+    <context>public</context>
+    <expires>3600</expires>
+    <freq>3600</freq>
+    <ping>1697201130</ping>
+    <pingfreq>30</pingfreq>
+    <pingmin>1</pingmin>
+    <pingcount>1</pingcount>
+    <pingmax>3</pingmax>
+    <pingtime>26.72</pingtime>
+    <pinging>0</pinging>
+    <state>REGED</state>
+    <status>UP</status>
+    <uptime-usec>3600000000</uptime-usec>
+    <calls-in>2</calls-in>
+    <calls-out>5</calls-out>
+    <failed-calls-in>0</failed-calls-in>
+    <failed-calls-out>1</failed-calls-out>
+  </gateway>
+  <gateway>
+    <name>carrier2</name>
+    <profile>external</profile>
+    <scheme>Digest</scheme>
+    <realm>sip.carrier2.com</realm>
+    <username>1002</username>
+    <password>yes</password>
+    <ping>1697201140</ping>
+    <pingfreq>30</pingfreq>
+    <pingtime>0.00</pingtime>
+    <pinging>0</pinging>
+    <state>FAILED</state>
+    <status>DOWN</status>
+    <uptime-usec>0</uptime-usec>
+    <calls-in>0</calls-in>
+    <calls-out>0</calls-out>
+    <failed-calls-in>0</failed-calls-in>
+    <failed-calls-out>3</failed-calls-out>
+  </gateway>
+  <gateway>
+    <name>pbx</name>
+    <profile>internal</profile>
+    <pingtime>1.10</pingtime>
+    <state>NOREG</state>
+    <status>UP</status>
+    <uptime-usec>60000000</uptime-usec>
+  </gateway>
+</gateways>
+`
+		}
+		return ""
+	}
+	fs := newMockedFSock(t, m, nil)
+	exp := []Gateway{
+		{Name: "carrier1", Profile: "external", State: "REGED", Status: "UP", PingTime: 26720 * time.Microsecond,
+			Uptime: time.Hour, CallsIn: 2, CallsOut: 5, FailedCallsOut: 1},
+		{Name: "carrier2", Profile: "external", State: "FAILED", Status: "DOWN", FailedCallsOut: 3},
+	}
+	if gws, err := fs.Gateways("external"); err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(exp, gws) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, gws)
+	}
+	if _, err := fs.Gateways("missing"); err != ErrProfileNotFound {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrProfileNotFound, err)
+	}
+	if _, err := fs.Gateways(" "); err == nil || err.Error() != "Need profile name" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "Need profile name", err)
+	}
+}
@@ -0,0 +1,122 @@
+/*
+chaos.go is released under the MIT License <http://www.opensource.org/licenses/mit-license.php
+Copyright (C) ITsysCOM. All Rights Reserved.
+
+Provides FreeSWITCH socket communication.
+*/
+package fsock
+
+import (
+	mrand "math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// ChaosConfig describes the faults injected into the connections by WithChaos
+type ChaosConfig struct {
+	ReadDelay      time.Duration // waited before each read off the socket
+	WriteDelay     time.Duration // latency of the writes, delivered in order once elapsed
+	ReadErrorRate  float64       // probability, from 0 to 1, of a read failing with ErrChaos
+	WriteErrorRate float64       // probability, from 0 to 1, of a write failing with ErrChaos
+}
+
+// WithChaos injects the configured delays and errors into the reads and writes of each connection, so the code
+// built on FSock can be tested against a slow or flaky FreeSWITCH. Meant for testing only: without it nothing
+// is injected.
+func WithChaos(cfg ChaosConfig) FSockOption {
+	return func(fs *FSock) {
+		fs.chaos = &cfg
+	}
+}
+
+// chaosWrite is a write delayed by the ChaosConfig WriteDelay
+type chaosWrite struct {
+	data []byte
+	due  time.Time
+}
+
+// chaosConn injects the faults of its ChaosConfig into the connection
+type chaosConn struct {
+	net.Conn
+	cfg       ChaosConfig
+	rndMux    sync.Mutex
+	rnd       *mrand.Rand
+	writes    chan chaosWrite // delivered by the writer goroutine, with WriteDelay only
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newChaosConn(conn net.Conn, cfg ChaosConfig) *chaosConn {
+	cc := &chaosConn{
+		Conn:   conn,
+		cfg:    cfg,
+		rnd:    mrand.New(mrand.NewSource(time.Now().UnixNano())),
+		closed: make(chan struct{}),
+	}
+	if cfg.WriteDelay > 0 {
+		cc.writes = make(chan chaosWrite, 64)
+		go cc.deliverWrites()
+	}
+	return cc
+}
+
+// fail draws if the operation fails at the given rate
+func (cc *chaosConn) fail(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	cc.rndMux.Lock()
+	defer cc.rndMux.Unlock()
+	return cc.rnd.Float64() < rate
+}
+
+func (cc *chaosConn) Read(b []byte) (int, error) {
+	if cc.cfg.ReadDelay > 0 {
+		time.Sleep(cc.cfg.ReadDelay)
+	}
+	if cc.fail(cc.cfg.ReadErrorRate) {
+		return 0, ErrChaos
+	}
+	return cc.Conn.Read(b)
+}
+
+func (cc *chaosConn) Write(b []byte) (int, error) {
+	if cc.fail(cc.cfg.WriteErrorRate) {
+		return 0, ErrChaos
+	}
+	if cc.writes == nil {
+		return cc.Conn.Write(b)
+	}
+	select {
+	case cc.writes <- chaosWrite{data: append([]byte(nil), b...), due: time.Now().Add(cc.cfg.WriteDelay)}:
+		return len(b), nil
+	case <-cc.closed:
+		return 0, net.ErrClosed
+	}
+}
+
+// deliverWrites writes the delayed data once due, in order, closing the connection if a write fails
+func (cc *chaosConn) deliverWrites() {
+	for {
+		select {
+		case w := <-cc.writes:
+			select {
+			case <-time.After(time.Until(w.due)):
+			case <-cc.closed:
+				return
+			}
+			if err := writeFull(cc.Conn, w.data); err != nil {
+				cc.Close()
+				return
+			}
+		case <-cc.closed:
+			return
+		}
+	}
+}
+
+func (cc *chaosConn) Close() error {
+	cc.closeOnce.Do(func() { close(cc.closed) })
+	return cc.Conn.Close()
+}
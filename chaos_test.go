@@ -0,0 +1,41 @@
+/*
+chaos_test.go is released under the MIT License <http://www.opensource.org/licenses/mit-license.php
+Copyright (C) ITsysCOM. All Rights Reserved.
+
+Provides FreeSWITCH socket communication.
+*/
+package fsock
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestFSockWithChaosWriteDelay(t *testing.T) {
+	m := newFSMock(t)
+	m.apiReply = func(string) string { return "+OK\n" }
+	fs := newMockedFSock(t, m, nil, WithChaos(ChaosConfig{WriteDelay: 200 * time.Millisecond}))
+	fs.SetReplyTimeout(50 * time.Millisecond)
+	if _, err := fs.SendApiCmd("status"); !errors.Is(err, ErrReplyTimeout) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrReplyTimeout, err)
+	}
+	m.waitCommand(t, 0, "api status") // delivered late
+	fs.SetReplyTimeout(time.Second)
+	if rply, err := fs.SendApiCmd("status"); err != nil {
+		t.Error(err)
+	} else if rply != "+OK\n" {
+		t.Errorf("\nExpected: %q, \nReceived: %q", "+OK\n", rply)
+	}
+}
+
+func TestFSockWithChaosWriteErrors(t *testing.T) {
+	m := newFSMock(t)
+	fs := newMockedFSock(t, m, nil)
+	fs.fsMutex.Lock()
+	fs.conn = newChaosConn(fs.conn, ChaosConfig{WriteErrorRate: 1})
+	fs.fsMutex.Unlock()
+	if _, err := fs.SendApiCmd("status"); !errors.Is(err, ErrChaos) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrChaos, err)
+	}
+}
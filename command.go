@@ -0,0 +1,83 @@
+/*
+command.go is released under the MIT License <http://www.opensource.org/licenses/mit-license.php
+Copyright (C) ITsysCOM. All Rights Reserved.
+
+Provides FreeSWITCH socket communication.
+*/
+package fsock
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// CmdBuilder assembles a multi-line ESL command: the command line, one line per header
+// and a single terminating blank line, followed by the body sized with Content-Length if any
+type CmdBuilder struct {
+	cmd  string
+	hdrs []string
+	body string
+}
+
+// NewCmd starts building the command, eg: NewCmd("sendmsg " + uuid)
+func NewCmd(cmd string) *CmdBuilder {
+	return &CmdBuilder{cmd: singleLine(cmd)}
+}
+
+// Header adds the header line, the line breaks within name and value are replaced
+// so they cannot terminate the command early
+func (cb *CmdBuilder) Header(name, value string) *CmdBuilder {
+	cb.hdrs = append(cb.hdrs, singleLine(name)+": "+singleLine(value))
+	return cb
+}
+
+// Headers adds the headers sorted by name, so the command is deterministic
+func (cb *CmdBuilder) Headers(hdrs map[string]string) *CmdBuilder {
+	names := make([]string, 0, len(hdrs))
+	for name := range hdrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cb.Header(name, hdrs[name])
+	}
+	return cb
+}
+
+// Body sets the body, sent after the blank line and announced with its Content-Length, computed in bytes
+// so the multi-byte UTF-8 characters are accounted for. A Content-Length header added is replaced by it.
+func (cb *CmdBuilder) Body(body string) *CmdBuilder {
+	cb.body = body
+	return cb
+}
+
+// String returns the command as written on the socket
+func (cb *CmdBuilder) String() string {
+	var sb strings.Builder
+	sb.WriteString(cb.cmd)
+	sb.WriteByte('\n')
+	for _, hdr := range cb.hdrs {
+		if isHeader(hdr, "Content-Length") { // a wrong one would misalign the frames read by FreeSWITCH
+			continue
+		}
+		sb.WriteString(hdr)
+		sb.WriteByte('\n')
+	}
+	if cb.body != "" {
+		sb.WriteString("Content-Length: " + strconv.Itoa(len(cb.body)) + "\n")
+	}
+	sb.WriteByte('\n')
+	sb.WriteString(cb.body)
+	return sb.String()
+}
+
+// isHeader checks if the header line is the name one, matching it case-insensitively
+func isHeader(hdr, name string) bool {
+	return strings.EqualFold(hdr[:strings.Index(hdr, ": ")], name)
+}
+
+// singleLine removes the trailing line breaks and replaces the inner ones with spaces
+func singleLine(s string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(strings.TrimRight(s, "\r\n"))
+}
@@ -0,0 +1,58 @@
+/*
+command_test.go is released under the MIT License <http://www.opensource.org/licenses/mit-license.php
+Copyright (C) ITsysCOM. All Rights Reserved.
+
+Provides FreeSWITCH socket communication.
+*/
+package fsock
+
+import (
+	"testing"
+)
+
+func TestCommandBuilder(t *testing.T) {
+	cmd := NewCmd("sendmsg 4c882cc4-cd02-11e6-8b82-395b501876f9\n").
+		Header("call-command", "execute").
+		Header("execute-app-name", "playback").
+		Header("execute-app-arg", "/tmp/welcome.wav").
+		String()
+	exp := "sendmsg 4c882cc4-cd02-11e6-8b82-395b501876f9\ncall-command: execute\nexecute-app-name: playback\n" +
+		"execute-app-arg: /tmp/welcome.wav\n\n"
+	if cmd != exp {
+		t.Errorf("\nExpected: %q, \nReceived: %q", exp, cmd)
+	}
+
+	cmd = NewCmd("sendevent CUSTOM").
+		Headers(map[string]string{"Event-Subclass": "cgr::test", "content-type": "text/plain"}).
+		Body("line1\nline2").
+		String()
+	exp = "sendevent CUSTOM\nEvent-Subclass: cgr::test\ncontent-type: text/plain\nContent-Length: 11\n\nline1\nline2"
+	if cmd != exp {
+		t.Errorf("\nExpected: %q, \nReceived: %q", exp, cmd)
+	}
+}
+
+func TestCommandBuilderSingleLine(t *testing.T) {
+	cmd := NewCmd("sendmsg").Header("execute-app-arg", "a\n\nexit").Header("Content-Length", "3").Body("abc").String()
+	exp := "sendmsg\nexecute-app-arg: a  exit\nContent-Length: 3\n\nabc"
+	if cmd != exp {
+		t.Errorf("\nExpected: %q, \nReceived: %q", exp, cmd)
+	}
+}
+
+func TestCommandBuilderContentLength(t *testing.T) {
+	body := "Grüße, 世界 🎉" // 20 bytes, 11 runes
+	cmd := NewCmd("sendevent CUSTOM").
+		Header("Event-Subclass", "cgr::test").
+		Header("content-length", "11"). // the runes, replaced
+		Body(body).
+		String()
+	exp := "sendevent CUSTOM\nEvent-Subclass: cgr::test\nContent-Length: 20\n\n" + body
+	if cmd != exp {
+		t.Errorf("\nExpected: %q, \nReceived: %q", exp, cmd)
+	}
+	cmd = NewCmd("sendmsg").Header("Content-Length", "5").String() // without body
+	if exp = "sendmsg\n\n"; cmd != exp {
+		t.Errorf("\nExpected: %q, \nReceived: %q", exp, cmd)
+	}
+}
@@ -0,0 +1,113 @@
+/*
+config.go is released under the MIT License <http://www.opensource.org/licenses/mit-license.php
+Copyright (C) ITsysCOM. All Rights Reserved.
+
+Provides FreeSWITCH socket communication.
+*/
+package fsock
+
+import (
+	"reflect"
+	"runtime"
+	"sort"
+	"time"
+)
+
+// redacted replaces the secrets in the FSockConfig
+const redacted = "<redacted>"
+
+// FSockConfig is the effective configuration of the connection, as returned by Config, the secrets redacted
+type FSockConfig struct {
+	Address              string
+	Password             string // redacted, empty if none
+	Proxy                string // with its password redacted
+	TLS                  bool
+	ConnID               string
+	ConnIdx              int
+	DialTimeout          time.Duration
+	ReplyTimeout         time.Duration
+	CancelGrace          time.Duration
+	Reconnects           int // -1 for infinite reconnects
+	MaxReconnectInterval time.Duration
+	ReconnectBudget      time.Duration
+	FastRetries          int
+	FastRetryInterval    time.Duration
+	KeepaliveInterval    time.Duration
+	StallTimeout         time.Duration
+	BgJobMaxAge          time.Duration
+	Handlers             map[string][]string // the event names mapped to the function names of their handlers
+	Subscriptions        []string            // sorted
+	SubscribeAll         bool
+	Filters              map[string][]string
+	FilterMatchAll       bool
+	Encoding             string
+	Bgapi                bool
+	AllowedCommands      []string
+	Outbound             bool
+	URLDecode            bool
+}
+
+// Config returns a snapshot of the effective configuration of the connection (eg: to check what a misbehaving
+// connection runs with), the password and the proxy credentials redacted
+func (fs *FSock) Config() *FSockConfig {
+	if !fs.initialized() {
+		return nil
+	}
+	subscriptions := fs.subscriptions()
+	sort.Strings(subscriptions)
+	encoding := fs.encoding()
+	fs.fsMutex.RLock()
+	defer fs.fsMutex.RUnlock()
+	cfg := &FSockConfig{
+		Address:              fs.fsaddress,
+		TLS:                  fs.tlsConfig != nil,
+		ConnID:               fs.connID,
+		ConnIdx:              fs.connIdx,
+		DialTimeout:          fs.dialTimeout,
+		ReplyTimeout:         fs.ReplyTimeout(),
+		CancelGrace:          fs.cancelGrace,
+		Reconnects:           fs.reconnects,
+		MaxReconnectInterval: fs.maxReconnectInterval,
+		ReconnectBudget:      fs.reconnectBudget,
+		FastRetries:          fs.fastRetries,
+		FastRetryInterval:    fs.fastRetryInterval,
+		KeepaliveInterval:    fs.keepaliveInterval,
+		StallTimeout:         fs.stallTimeout,
+		BgJobMaxAge:          fs.bgJobMaxAge,
+		Handlers:             handlerNames(fs.eventHandlers),
+		Subscriptions:        subscriptions,
+		SubscribeAll:         fs.subscribeAll,
+		Filters:              copyFilters(fs.eventFilters),
+		FilterMatchAll:       fs.filterMatchAll,
+		Encoding:             encoding,
+		Bgapi:                fs.bgapiSup,
+		AllowedCommands:      append([]string(nil), fs.allowedCmds...),
+		Outbound:             fs.outbound,
+		URLDecode:            !fs.rawHdrVals,
+	}
+	if fs.fspaswd != "" {
+		cfg.Password = redacted
+	}
+	if fs.proxyURL != nil {
+		cfg.Proxy = fs.proxyURL.Redacted()
+	}
+	return cfg
+}
+
+// handlerNames maps the event names to the function names of their handlers
+func handlerNames(handlers map[string][]func(string, int)) map[string][]string {
+	if len(handlers) == 0 {
+		return nil
+	}
+	names := make(map[string][]string, len(handlers))
+	for evName, hndlrs := range handlers {
+		for _, h := range hndlrs {
+			name := "<nil>"
+			if h != nil {
+				name = runtime.FuncForPC(reflect.ValueOf(h).Pointer()).Name()
+			}
+			names[evName] = append(names[evName], name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,51 @@
+/*
+dryrun.go is released under the MIT License <http://www.opensource.org/licenses/mit-license.php
+Copyright (C) ITsysCOM. All Rights Reserved.
+
+Provides FreeSWITCH socket communication.
+*/
+package fsock
+
+import (
+	"strings"
+	"sync"
+)
+
+// dryRun records the commands instead of sending them, replying with the canned replies
+type dryRun struct {
+	mu    sync.Mutex
+	reply func(cmd string) string // builds the canned reply, +OK if nil
+	cmds  []string
+}
+
+// WithDryRun never connects to FreeSWITCH: the commands are recorded, retrievable with RecordedCommands,
+// and replied with the result of reply (+OK if nil), the -ERR replies failing them as FreeSWITCH would.
+// Meant to unit-test the logic built on top of FSock against the real command building, no event is received.
+func WithDryRun(reply func(cmd string) string) FSockOption {
+	return func(fs *FSock) {
+		fs.dryRun = &dryRun{reply: reply}
+	}
+}
+
+// RecordedCommands returns the commands recorded in dry-run mode (see WithDryRun), in the order they were sent,
+// without their terminating blank line
+func (fs *FSock) RecordedCommands() []string {
+	if !fs.initialized() || fs.dryRun == nil {
+		return nil
+	}
+	fs.dryRun.mu.Lock()
+	defer fs.dryRun.mu.Unlock()
+	return append([]string{}, fs.dryRun.cmds...)
+}
+
+// record keeps the command frame and returns its canned reply
+func (dr *dryRun) record(frame string) string {
+	cmd := strings.TrimSuffix(frame, "\n\n")
+	dr.mu.Lock()
+	dr.cmds = append(dr.cmds, cmd)
+	dr.mu.Unlock()
+	if dr.reply == nil {
+		return "+OK"
+	}
+	return dr.reply(cmd)
+}
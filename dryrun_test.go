@@ -0,0 +1,54 @@
+/*
+dryrun_test.go is released under the MIT License <http://www.opensource.org/licenses/mit-license.php
+Copyright (C) ITsysCOM. All Rights Reserved.
+
+Provides FreeSWITCH socket communication.
+*/
+package fsock
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFSockWithDryRun(t *testing.T) {
+	fs, err := New("127.0.0.1:1", "ClueCon", WithDryRun(func(cmd string) string { // nothing listening
+		if strings.Contains(cmd, "user/busy") {
+			return "-ERR USER_BUSY\n"
+		}
+		return "+OK d6e5b5ac-4f54-4b52-9b84-ab2d7c3a0f6e\n"
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	uuid, err := fs.OriginateToApp(context.Background(), "user/1001", "park", "", &OriginateOptions{
+		UUID: "d6e5b5ac-4f54-4b52-9b84-ab2d7c3a0f6e",
+		Vars: map[string]string{"origination_caller_id_number": "1002"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if uuid != "d6e5b5ac-4f54-4b52-9b84-ab2d7c3a0f6e" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "d6e5b5ac-4f54-4b52-9b84-ab2d7c3a0f6e", uuid)
+	}
+	if _, err = fs.OriginateToApp(context.Background(), "user/busy", "park", "", nil); err == nil ||
+		err.Error() != "-ERR USER_BUSY" {
+		t.Errorf("Unexpected error: <%v>", err)
+	}
+	if err = fs.SendMsgCmd("d6e5b5ac", map[string]string{"call-command": "hangup"}); err != nil {
+		t.Error(err)
+	}
+	cmds := fs.RecordedCommands()
+	if len(cmds) != 3 {
+		t.Fatalf("Expected 3 commands recorded, received: %q", cmds)
+	}
+	exp := []string{"api originate {origination_uuid=d6e5b5ac-4f54-4b52-9b84-ab2d7c3a0f6e," +
+		"origination_caller_id_number=1002}user/1001 &park()", "sendmsg d6e5b5ac\ncall-command: hangup"}
+	if rcv := []string{cmds[0], cmds[2]}; !reflect.DeepEqual(exp, rcv) {
+		t.Errorf("\nExpected: <%q>, \nReceived: <%q>", exp, rcv)
+	}
+	if fs.Connected() {
+		t.Error("Expected never connected")
+	}
+}
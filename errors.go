@@ -0,0 +1,53 @@
+/*
+errors.go is released under the MIT License <http://www.opensource.org/licenses/mit-license.php
+Copyright (C) ITsysCOM. All Rights Reserved.
+
+Provides FreeSWITCH socket communication.
+*/
+package fsock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// AuthError is returned when FreeSWITCH rejects the password, on connect or ReAuth
+type AuthError struct {
+	Reply string
+}
+
+func (err *AuthError) Error() string {
+	return fmt.Sprintf("Unexpected auth reply received: <%s>", err.Reply)
+}
+
+// IsTimeout checks if err is a timeout: of the reply, the background job, the pool or the connection
+func IsTimeout(err error) bool {
+	if errors.Is(err, ErrReplyTimeout) || errors.Is(err, ErrBgJobTimeout) ||
+		errors.Is(err, ErrConnectionPoolTimeout) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// IsDisconnect checks if err comes from the connection to FreeSWITCH being lost or not established
+func IsDisconnect(err error) bool {
+	return errors.Is(err, ErrDisconnected) || errors.Is(err, ErrNotConnected) || errors.Is(err, ErrSessionEnded) ||
+		errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed)
+}
+
+// IsAuthError checks if err is FreeSWITCH rejecting the password
+func IsAuthError(err error) bool {
+	var authErr *AuthError
+	return errors.As(err, &authErr)
+}
+
+// IsServerError checks if err is FreeSWITCH refusing the command, as opposed to it not being sent or replied
+func IsServerError(err error) bool {
+	var bridgeErr *BridgeError
+	var fsctlErr *FsctlError
+	return isReplyError(err) || errors.As(err, &bridgeErr) || errors.As(err, &fsctlErr)
+}
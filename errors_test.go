@@ -0,0 +1,61 @@
+/*
+errors_test.go is released under the MIT License <http://www.opensource.org/licenses/mit-license.php
+Copyright (C) ITsysCOM. All Rights Reserved.
+
+Provides FreeSWITCH socket communication.
+*/
+package fsock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestErrorsClassification(t *testing.T) {
+	errs := map[string]error{
+		"replyTimeout":    ErrReplyTimeout,
+		"bgJobTimeout":    ErrBgJobTimeout,
+		"poolTimeout":     ErrConnectionPoolTimeout,
+		"ctxDeadline":     context.DeadlineExceeded,
+		"deadline":        fmt.Errorf("read tcp: %w", os.ErrDeadlineExceeded),
+		"disconnected":    ErrDisconnected,
+		"notConnected":    ErrNotConnected,
+		"sessionEnded":    fmt.Errorf("uuid_kill: %w", ErrSessionEnded),
+		"eof":             io.EOF,
+		"auth":            &AuthError{Reply: "Content-Type: command/reply\nReply-Text: -ERR invalid"},
+		"reply":           parseReplyError("-ERR No such channel!"),
+		"bridge":          &BridgeError{UUIDA: "a", UUIDB: "b", Reply: "-ERR Invalid uuid"},
+		"fsctl":           fmt.Errorf("maintenance: %w", &FsctlError{Cmd: "pause inbound", Reply: "-ERR"}),
+		"callNotFound":    ErrCallNotFound,
+		"other":           errors.New("other"),
+		"ctxCanceled":     context.Canceled,
+		"commandRejected": ErrCommandNotAllowed,
+	}
+	for _, tc := range []struct {
+		name     string
+		classify func(error) bool
+		matching []string
+	}{
+		{"IsTimeout", IsTimeout, []string{"replyTimeout", "bgJobTimeout", "poolTimeout", "ctxDeadline", "deadline"}},
+		{"IsDisconnect", IsDisconnect, []string{"disconnected", "notConnected", "sessionEnded", "eof"}},
+		{"IsAuthError", IsAuthError, []string{"auth"}},
+		{"IsServerError", IsServerError, []string{"reply", "bridge", "fsctl"}},
+	} {
+		matching := make(map[string]bool)
+		for _, name := range tc.matching {
+			matching[name] = true
+		}
+		for name, err := range errs {
+			if rcv := tc.classify(err); rcv != matching[name] {
+				t.Errorf("%s(%s) \nExpected: <%+v>, \nReceived: <%+v>", tc.name, name, matching[name], rcv)
+			}
+		}
+		if tc.classify(nil) {
+			t.Errorf("%s(nil) \nExpected: <false>, \nReceived: <true>", tc.name)
+		}
+	}
+}
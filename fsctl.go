@@ -0,0 +1,119 @@
+/*
+fsctl.go is released under the MIT License <http://www.opensource.org/licenses/mit-license.php
+Copyright (C) ITsysCOM. All Rights Reserved.
+
+Provides FreeSWITCH socket communication.
+*/
+package fsock
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// FsctlError is returned when FreeSWITCH rejects the fsctl command
+type FsctlError struct {
+	Cmd   string // eg: pause inbound
+	Reply string
+}
+
+func (err *FsctlError) Error() string {
+	return fmt.Sprintf("Fsctl %s failed: <%s>", err.Cmd, err.Reply)
+}
+
+// Fsctl runs the fsctl subcommand, erroring with *FsctlError if FreeSWITCH does not reply +OK
+func (fs *FSock) Fsctl(cmd string) (rply string, err error) {
+	if cmd = strings.TrimSpace(cmd); cmd == "" {
+		return "", errors.New("Need fsctl command")
+	}
+	return fs.checkedApiCmd("fsctl "+cmd, cmd)
+}
+
+// ShutdownServer stops FreeSWITCH, once all the calls ended if elegant
+func (fs *FSock) ShutdownServer(elegant bool) (err error) {
+	cmd := "shutdown"
+	if elegant {
+		cmd += " elegant"
+	}
+	_, err = fs.Fsctl(cmd)
+	return
+}
+
+// PauseInbound stops (pause true) or allows again the inbound calls
+func (fs *FSock) PauseInbound(pause bool) (err error) {
+	return fs.pauseCalls("inbound", pause)
+}
+
+// PauseOutbound stops (pause true) or allows again the outbound calls
+func (fs *FSock) PauseOutbound(pause bool) (err error) {
+	return fs.pauseCalls("outbound", pause)
+}
+
+func (fs *FSock) pauseCalls(direction string, pause bool) (err error) {
+	cmd := "resume " + direction
+	if pause {
+		cmd = "pause " + direction
+	}
+	_, err = fs.Fsctl(cmd)
+	return
+}
+
+// Reloadxml reloads the XML configuration. Not an fsctl subcommand, it runs the reloadxml api.
+func (fs *FSock) Reloadxml() (err error) {
+	_, err = fs.checkedApiCmd("reloadxml", "reloadxml")
+	return
+}
+
+// Sync resynchronizes the FreeSWITCH clock with the system one (fsctl sync_clock)
+func (fs *FSock) Sync() (err error) {
+	_, err = fs.Fsctl("sync_clock")
+	return
+}
+
+// MaxSessions limits the number of concurrent calls
+func (fs *FSock) MaxSessions(n int) (err error) {
+	if n <= 0 {
+		return errors.New("Need positive max sessions")
+	}
+	_, err = fs.Fsctl("max_sessions " + strconv.Itoa(n))
+	return
+}
+
+// SessionsPerSecond limits the number of new calls per second
+func (fs *FSock) SessionsPerSecond(n int) (err error) {
+	if n <= 0 {
+		return errors.New("Need positive sessions per second")
+	}
+	_, err = fs.Fsctl("sps " + strconv.Itoa(n))
+	return
+}
+
+// fsctlLogLevels are the levels accepted by fsctl loglevel
+var fsctlLogLevels = map[string]struct{}{
+	"console": {}, "alert": {}, "crit": {}, "err": {}, "warning": {}, "notice": {}, "info": {}, "debug": {},
+}
+
+// LogLevel sets the level of the FreeSWITCH core logs
+func (fs *FSock) LogLevel(level string) (err error) {
+	if _, has := fsctlLogLevels[level]; !has {
+		return fmt.Errorf("Invalid log level: <%s>", level)
+	}
+	_, err = fs.Fsctl("loglevel " + level)
+	return
+}
+
+// checkedApiCmd runs the api command, erroring with *FsctlError labeled name if the reply is not +OK
+func (fs *FSock) checkedApiCmd(cmd, name string) (rply string, err error) {
+	if rply, err = fs.SendApiCmd(cmd); err != nil {
+		if isReplyError(err) {
+			err = &FsctlError{Cmd: name, Reply: err.Error()}
+		}
+		return
+	}
+	if rply = strings.TrimSpace(rply); !strings.HasPrefix(rply, "+OK") {
+		return "", &FsctlError{Cmd: name, Reply: rply}
+	}
+	return
+}
@@ -0,0 +1,85 @@
+/*
+fsctl_test.go is released under the MIT License <http://www.opensource.org/licenses/mit-license.php
+Copyright (C) ITsysCOM. All Rights Reserved.
+
+Provides FreeSWITCH socket communication.
+*/
+package fsock
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestFsctlCommands(t *testing.T) {
+	m := newFSMock(t)
+	m.apiReply = func(cmd string) string {
+		switch cmd {
+		case "fsctl max_sessions 1000":
+			return "+OK max sessions: 1000\n"
+		case "fsctl loglevel debug":
+			return "+OK log level: DEBUG [7]\n"
+		case "reloadxml":
+			return "+OK [Success]\n"
+		}
+		return "+OK\n"
+	}
+	fs := newMockedFSock(t, m, nil)
+	for _, tc := range []struct {
+		run func() error
+		exp string
+	}{
+		{func() error { return fs.ShutdownServer(true) }, "api fsctl shutdown elegant"},
+		{func() error { return fs.ShutdownServer(false) }, "api fsctl shutdown"},
+		{func() error { return fs.PauseInbound(true) }, "api fsctl pause inbound"},
+		{func() error { return fs.PauseInbound(false) }, "api fsctl resume inbound"},
+		{func() error { return fs.PauseOutbound(true) }, "api fsctl pause outbound"},
+		{fs.Reloadxml, "api reloadxml"},
+		{fs.Sync, "api fsctl sync_clock"},
+		{func() error { return fs.MaxSessions(1000) }, "api fsctl max_sessions 1000"},
+		{func() error { return fs.SessionsPerSecond(30) }, "api fsctl sps 30"},
+		{func() error { return fs.LogLevel("debug") }, "api fsctl loglevel debug"},
+	} {
+		if err := tc.run(); err != nil {
+			t.Errorf("%s: %v", tc.exp, err)
+		}
+		m.waitCommand(t, 0, tc.exp)
+	}
+}
+
+func TestFsctlErrors(t *testing.T) {
+	m := newFSMock(t)
+	m.apiReply = func(cmd string) string {
+		switch cmd {
+		case "fsctl pause inbound":
+			return "-ERR Permission denied\n"
+		case "fsctl sync_clock":
+			return "Unknown command\n"
+		}
+		return "+OK\n"
+	}
+	fs := newMockedFSock(t, m, nil)
+	var fsctlErr *FsctlError
+	if err := fs.PauseInbound(true); !errors.As(err, &fsctlErr) {
+		t.Fatalf("Expected FsctlError, received: <%+v>", err)
+	}
+	if exp := (&FsctlError{Cmd: "pause inbound", Reply: "-ERR Permission denied"}); !reflect.DeepEqual(exp, fsctlErr) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, fsctlErr)
+	}
+	expErr := "Fsctl sync_clock failed: <Unknown command>"
+	if err := fs.Sync(); err == nil || err.Error() != expErr {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", expErr, err)
+	}
+	for _, err := range []error{fs.MaxSessions(0), fs.SessionsPerSecond(-1), fs.LogLevel("verbose")} {
+		if err == nil {
+			t.Error("Expected the invalid argument rejected")
+		}
+	}
+	if _, err := fs.Fsctl(" "); err == nil || err.Error() != "Need fsctl command" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "Need fsctl command", err)
+	}
+	if n := len(m.commands(0)); n != 4 { // auth, event subscription and the two rejected commands
+		t.Errorf("Expected the invalid arguments not sent, received commands: %q", m.commands(0))
+	}
+}
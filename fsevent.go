@@ -0,0 +1,284 @@
+/*
+fsevent.go is released under the MIT License <http://www.opensource.org/licenses/mit-license.php
+Copyright (C) ITsysCOM. All Rights Reserved.
+
+Provides FreeSWITCH socket communication.
+*/
+package fsock
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxNestedEvents limits the depth of the events parsed out of the bodies
+const maxNestedEvents = 8
+
+// FSEvent is a FreeSWITCH event parsed out of its plain format
+type FSEvent struct {
+	Headers map[string]string // url-decoded header values
+	Body    string
+	depth   int // nesting level, 0 for the events read from the socket
+}
+
+// ParseFSEvent parses the plain event string into an FSEvent
+func ParseFSEvent(event string) *FSEvent {
+	return newFSEvent(EventToMap(event))
+}
+
+// ParseFSEventStrict parses the plain event string into an FSEvent, erroring on the malformed header lines
+func ParseFSEventStrict(event string) (*FSEvent, error) {
+	hdrs, err := EventToMapStrict(event)
+	if err != nil {
+		return nil, err
+	}
+	return newFSEvent(hdrs), nil
+}
+
+// newFSEvent moves the body out of the parsed headers
+func newFSEvent(hdrs map[string]string) *FSEvent {
+	ev := &FSEvent{Headers: hdrs}
+	if body, has := ev.Headers[EventBodyTag]; has {
+		ev.Body = body
+		delete(ev.Headers, EventBodyTag)
+	}
+	return ev
+}
+
+// Header returns the value of the header with the given name
+func (ev *FSEvent) Header(name string) string {
+	return ev.Headers[name]
+}
+
+// Get returns the value of the header matching name case-insensitively, eg: Get("unique-id") finds Unique-ID.
+// The exact name is looked up first so the headers requested as received cost no scan.
+func (ev *FSEvent) Get(name string) string {
+	if val, has := ev.Headers[name]; has {
+		return val
+	}
+	for hdr, val := range ev.Headers {
+		if strings.EqualFold(hdr, name) {
+			return val
+		}
+	}
+	return ""
+}
+
+// Name returns the Event-Name header, matched case-insensitively for the ESL servers altering its casing
+func (ev *FSEvent) Name() string {
+	return ev.Get("Event-Name")
+}
+
+// UUID returns the Unique-ID header of the channel the event refers to, matched case-insensitively as Name
+func (ev *FSEvent) UUID() string {
+	return ev.Get("Unique-ID")
+}
+
+// Sequence returns the Event-Sequence header, the number FreeSWITCH gives to the events in the order it fires them,
+// false if missing or invalid
+func (ev *FSEvent) Sequence() (uint64, bool) {
+	seq, err := strconv.ParseUint(ev.Get("Event-Sequence"), 10, 64)
+	return seq, err == nil
+}
+
+// BodyAsEvent parses the body as a nested event, as embedded by some CUSTOM events (eg: conference ones).
+// Errors if the body is not an event or the nesting goes deeper than maxNestedEvents.
+func (ev *FSEvent) BodyAsEvent() (nested *FSEvent, err error) {
+	if ev.depth >= maxNestedEvents {
+		return nil, fmt.Errorf("Nested events deeper than %d", maxNestedEvents)
+	}
+	if strings.TrimSpace(ev.Body) == "" {
+		return nil, errors.New("Event body is not an event")
+	}
+	if nested, err = ParseFSEventStrict(ev.Body); err != nil {
+		return nil, fmt.Errorf("Event body is not an event: %s", err)
+	}
+	if len(nested.Headers) == 0 {
+		return nil, errors.New("Event body is not an event")
+	}
+	nested.depth = ev.depth + 1
+	return
+}
+
+// BodyJSON unmarshals the body into v, as structured by some CUSTOM events even in plain mode (eg: conference, verto).
+// Errors if the body is not json.
+func (ev *FSEvent) BodyJSON(v interface{}) error {
+	body := strings.TrimSpace(ev.Body)
+	if body == "" || !json.Valid([]byte(body)) {
+		return errors.New("Event body is not json")
+	}
+	if err := json.Unmarshal([]byte(body), v); err != nil {
+		return fmt.Errorf("Cannot unmarshal the event body: %s", err)
+	}
+	return nil
+}
+
+// HeadersWithPrefix returns the headers starting with prefix, indexed by their names without it,
+// eg: HeadersWithPrefix("Caller-") maps "Caller-Destination-Number" as "Destination-Number"
+func (ev *FSEvent) HeadersWithPrefix(prefix string) (hdrs map[string]string) {
+	hdrs = make(map[string]string)
+	for name, val := range ev.Headers {
+		if strings.HasPrefix(name, prefix) {
+			hdrs[name[len(prefix):]] = val
+		}
+	}
+	return
+}
+
+// Variables returns the channel variables, without the variable_ prefix
+func (ev *FSEvent) Variables() map[string]string {
+	return ev.HeadersWithPrefix("variable_")
+}
+
+// Equal checks if both events have the same headers, regardless of their order, and the same body
+func (ev *FSEvent) Equal(other *FSEvent) bool {
+	if ev == nil || other == nil {
+		return ev == other
+	}
+	return len(ev.Diff(other)) == 0
+}
+
+// Diff returns the sorted names of the headers differing between the events, missing in one of them included,
+// with EventBodyTag standing for a different body
+func (ev *FSEvent) Diff(other *FSEvent) (diff []string) {
+	if ev == nil {
+		ev = new(FSEvent)
+	}
+	if other == nil {
+		other = new(FSEvent)
+	}
+	for name, val := range ev.Headers {
+		if otherVal, has := other.Headers[name]; !has || otherVal != val {
+			diff = append(diff, name)
+		}
+	}
+	for name := range other.Headers {
+		if _, has := ev.Headers[name]; !has {
+			diff = append(diff, name)
+		}
+	}
+	sort.Strings(diff)
+	if ev.Body != other.Body {
+		diff = append(diff, EventBodyTag)
+	}
+	return
+}
+
+// RTPStats is the audio RTP quality out of the variable_rtp_audio_* headers,
+// as carried by the CHANNEL_HANGUP_COMPLETE events
+type RTPStats struct {
+	InMOS               float64
+	InQualityPercentage float64
+	InRawBytes          int64
+	InMediaBytes        int64
+	InPacketCount       int64
+	InMediaPacketCount  int64
+	InSkipPacketCount   int64
+	InJitterPacketCount int64
+	InDTMFPacketCount   int64
+	InCNGPacketCount    int64
+	InFlushPacketCount  int64
+	InLargestJBSize     int64
+	InJitterMinVariance float64
+	InJitterMaxVariance float64
+	InJitterLossRate    float64
+	InJitterBurstRate   float64
+	InMeanInterval      float64
+	InFlawTotal         int64
+	OutRawBytes         int64
+	OutMediaBytes       int64
+	OutPacketCount      int64
+	OutMediaPacketCount int64
+	OutSkipPacketCount  int64
+	OutDTMFPacketCount  int64
+	OutCNGPacketCount   int64
+	RTCPPacketCount     int64
+	RTCPOctetCount      int64
+}
+
+// RTPStats parses the RTP statistics of the event, ErrRTPStatsNotFound if it carries none.
+// The statistics missing out of the event are left 0.
+func (ev *FSEvent) RTPStats() (stats *RTPStats, err error) {
+	stats = new(RTPStats)
+	ints := map[string]*int64{
+		"in_raw_bytes":           &stats.InRawBytes,
+		"in_media_bytes":         &stats.InMediaBytes,
+		"in_packet_count":        &stats.InPacketCount,
+		"in_media_packet_count":  &stats.InMediaPacketCount,
+		"in_skip_packet_count":   &stats.InSkipPacketCount,
+		"in_jitter_packet_count": &stats.InJitterPacketCount,
+		"in_dtmf_packet_count":   &stats.InDTMFPacketCount,
+		"in_cng_packet_count":    &stats.InCNGPacketCount,
+		"in_flush_packet_count":  &stats.InFlushPacketCount,
+		"in_largest_jb_size":     &stats.InLargestJBSize,
+		"in_flaw_total":          &stats.InFlawTotal,
+		"out_raw_bytes":          &stats.OutRawBytes,
+		"out_media_bytes":        &stats.OutMediaBytes,
+		"out_packet_count":       &stats.OutPacketCount,
+		"out_media_packet_count": &stats.OutMediaPacketCount,
+		"out_skip_packet_count":  &stats.OutSkipPacketCount,
+		"out_dtmf_packet_count":  &stats.OutDTMFPacketCount,
+		"out_cng_packet_count":   &stats.OutCNGPacketCount,
+		"rtcp_packet_count":      &stats.RTCPPacketCount,
+		"rtcp_octet_count":       &stats.RTCPOctetCount,
+	}
+	floats := map[string]*float64{
+		"in_mos":                 &stats.InMOS,
+		"in_quality_percentage":  &stats.InQualityPercentage,
+		"in_jitter_min_variance": &stats.InJitterMinVariance,
+		"in_jitter_max_variance": &stats.InJitterMaxVariance,
+		"in_jitter_loss_rate":    &stats.InJitterLossRate,
+		"in_jitter_burst_rate":   &stats.InJitterBurstRate,
+		"in_mean_interval":       &stats.InMeanInterval,
+	}
+	var found bool
+	for name, val := range ev.HeadersWithPrefix("variable_rtp_audio_") {
+		if val = strings.TrimSpace(val); val == "" {
+			continue
+		}
+		if dst, has := ints[name]; has {
+			if *dst, err = strconv.ParseInt(val, 10, 64); err != nil {
+				return nil, fmt.Errorf("Invalid variable_rtp_audio_%s value: <%s>", name, val)
+			}
+			found = true
+		} else if dst, has := floats[name]; has {
+			if *dst, err = strconv.ParseFloat(val, 64); err != nil {
+				return nil, fmt.Errorf("Invalid variable_rtp_audio_%s value: <%s>", name, val)
+			}
+			found = true
+		}
+	}
+	if !found {
+		return nil, ErrRTPStatsNotFound
+	}
+	return
+}
+
+// SIPInfo is the SIP signalling out of the variable_sip_* headers, as carried by the channel events of the SIP calls
+type SIPInfo struct {
+	FromURI   string
+	ToURI     string
+	CallID    string
+	NetworkIP string
+	UserAgent string
+}
+
+// SIPInfo extracts the SIP details of the event, ErrSIPInfoNotFound if the channel is not a SIP one.
+// The details missing out of the event are left empty.
+func (ev *FSEvent) SIPInfo() (info *SIPInfo, err error) {
+	info = &SIPInfo{
+		FromURI:   ev.Headers["variable_sip_from_uri"],
+		ToURI:     ev.Headers["variable_sip_to_uri"],
+		CallID:    ev.Headers["variable_sip_call_id"],
+		NetworkIP: ev.Headers["variable_sip_network_ip"],
+		UserAgent: ev.Headers["variable_sip_user_agent"],
+	}
+	if *info == (SIPInfo{}) {
+		return nil, ErrSIPInfoNotFound
+	}
+	return
+}
@@ -0,0 +1,295 @@
+/*
+fsevent_test.go is released under the MIT License <http://www.opensource.org/licenses/mit-license.php
+Copyright (C) ITsysCOM. All Rights Reserved.
+
+Provides FreeSWITCH socket communication.
+*/
+package fsock
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestFSEventParseFSEvent(t *testing.T) {
+	event := "Event-Name: CHANNEL_EXECUTE_COMPLETE\nUnique-ID: e3f2a1c4\nApplication-Data: a%20b\n\nbody line\n"
+	exp := &FSEvent{
+		Headers: map[string]string{
+			"Event-Name":       "CHANNEL_EXECUTE_COMPLETE",
+			"Unique-ID":        "e3f2a1c4",
+			"Application-Data": "a b",
+		},
+		Body: "body line\n",
+	}
+	ev := ParseFSEvent(event)
+	if !reflect.DeepEqual(exp, ev) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, ev)
+	}
+	if ev.Name() != "CHANNEL_EXECUTE_COMPLETE" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "CHANNEL_EXECUTE_COMPLETE", ev.Name())
+	} else if ev.UUID() != "e3f2a1c4" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "e3f2a1c4", ev.UUID())
+	} else if ev.Header("Application-Data") != "a b" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "a b", ev.Header("Application-Data"))
+	}
+}
+
+func TestFSEventParseFSEventStrict(t *testing.T) {
+	event := "Event-Name: HEARTBEAT\nCore-UUID 651a8db2\nEvent-Info: System%20Ready\n\n"
+	lenient := ParseFSEvent(event)
+	exp := map[string]string{"Event-Name": "HEARTBEAT", "Event-Info": "System Ready"}
+	if !reflect.DeepEqual(exp, lenient.Headers) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, lenient.Headers)
+	}
+	expErr := "Malformed event headers: <Core-UUID 651a8db2>"
+	if _, err := ParseFSEventStrict(event); err == nil || err.Error() != expErr {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", expErr, err)
+	}
+	if ev, err := ParseFSEventStrict("Event-Name: HEARTBEAT\n\nbody"); err != nil {
+		t.Error(err)
+	} else if ev.Name() != "HEARTBEAT" || ev.Body != "body" {
+		t.Errorf("Unexpected event: %+v", ev)
+	}
+}
+
+func TestFSEventEqualDiff(t *testing.T) {
+	ev := ParseFSEvent("Event-Name: CHANNEL_ANSWER\nUnique-ID: e3f2a1c4\nAnswer-State: answered\n\nbody")
+	other := ParseFSEvent("Answer-State: answered\nEvent-Name: CHANNEL_ANSWER\nUnique-ID: e3f2a1c4\n\nbody")
+	if !ev.Equal(other) {
+		t.Error("Expected equal events regardless of the header order")
+	}
+	if diff := ev.Diff(other); len(diff) != 0 {
+		t.Errorf("Expected no diff, received: %v", diff)
+	}
+	other = ParseFSEvent("Event-Name: CHANNEL_ANSWER\nUnique-ID: f00d\nChannel-State: CS_EXECUTE\n\nother body")
+	if ev.Equal(other) {
+		t.Error("Expected different events")
+	}
+	if exp, diff := []string{"Answer-State", "Channel-State", "Unique-ID", EventBodyTag}, ev.Diff(other); !reflect.DeepEqual(exp, diff) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, diff)
+	}
+	other = ParseFSEvent("Event-Name: CHANNEL_ANSWER\nUnique-ID: e3f2a1c4\nAnswer-State: answered\n\nother body")
+	if exp, diff := []string{EventBodyTag}, ev.Diff(other); !reflect.DeepEqual(exp, diff) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, diff)
+	}
+	if ev.Equal(nil) || !(*FSEvent)(nil).Equal(nil) {
+		t.Error("Unexpected nil comparison")
+	}
+}
+
+func TestFSEventHeadersWithPrefix(t *testing.T) {
+	ev := ParseFSEvent("Event-Name: CHANNEL_ANSWER\nCaller-Caller-ID-Number: 1001\nCaller-Destination-Number: 1002\n" +
+		"variable_sip_call_id: 4c882cc4\nvariable_billsec: 12\nUnique-ID: e3f2a1c4\n")
+	exp := map[string]string{"Caller-ID-Number": "1001", "Destination-Number": "1002"}
+	if rcv := ev.HeadersWithPrefix("Caller-"); !reflect.DeepEqual(exp, rcv) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, rcv)
+	}
+	exp = map[string]string{"sip_call_id": "4c882cc4", "billsec": "12"}
+	if rcv := ev.Variables(); !reflect.DeepEqual(exp, rcv) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, rcv)
+	}
+	if rcv := ev.HeadersWithPrefix("Other-Leg-"); len(rcv) != 0 {
+		t.Errorf("Expected no headers, received: %+v", rcv)
+	}
+}
+
+func TestFSEventRTPStats(t *testing.T) {
+	ev := ParseFSEvent("Event-Name: CHANNEL_HANGUP_COMPLETE\nUnique-ID: e3f2a1c4\n" +
+		"variable_rtp_audio_in_raw_bytes: 187480\nvariable_rtp_audio_in_media_bytes: 187136\n" +
+		"variable_rtp_audio_in_packet_count: 1090\nvariable_rtp_audio_in_media_packet_count: 1088\n" +
+		"variable_rtp_audio_in_skip_packet_count: 2\nvariable_rtp_audio_in_jitter_packet_count: 0\n" +
+		"variable_rtp_audio_in_dtmf_packet_count: 0\nvariable_rtp_audio_in_cng_packet_count: 0\n" +
+		"variable_rtp_audio_in_flush_packet_count: 2\nvariable_rtp_audio_in_largest_jb_size: 0\n" +
+		"variable_rtp_audio_in_jitter_min_variance: 9.37\nvariable_rtp_audio_in_jitter_max_variance: 34.35\n" +
+		"variable_rtp_audio_in_jitter_loss_rate: 0.00\nvariable_rtp_audio_in_jitter_burst_rate: 0.00\n" +
+		"variable_rtp_audio_in_mean_interval: 20.01\nvariable_rtp_audio_in_flaw_total: 3\n" +
+		"variable_rtp_audio_in_quality_percentage: 97.00\nvariable_rtp_audio_in_mos: 4.45\n" +
+		"variable_rtp_audio_out_raw_bytes: 184040\nvariable_rtp_audio_out_media_bytes: 184040\n" +
+		"variable_rtp_audio_out_packet_count: 1070\nvariable_rtp_audio_out_media_packet_count: 1070\n" +
+		"variable_rtp_audio_out_skip_packet_count: 0\nvariable_rtp_audio_out_dtmf_packet_count: 0\n" +
+		"variable_rtp_audio_out_cng_packet_count: 0\nvariable_rtp_audio_rtcp_packet_count: 5\n" +
+		"variable_rtp_audio_rtcp_octet_count: 640\n")
+	exp := &RTPStats{
+		InMOS:               4.45,
+		InQualityPercentage: 97,
+		InRawBytes:          187480,
+		InMediaBytes:        187136,
+		InPacketCount:       1090,
+		InMediaPacketCount:  1088,
+		InSkipPacketCount:   2,
+		InFlushPacketCount:  2,
+		InJitterMinVariance: 9.37,
+		InJitterMaxVariance: 34.35,
+		InMeanInterval:      20.01,
+		InFlawTotal:         3,
+		OutRawBytes:         184040,
+		OutMediaBytes:       184040,
+		OutPacketCount:      1070,
+		OutMediaPacketCount: 1070,
+		RTCPPacketCount:     5,
+		RTCPOctetCount:      640,
+	}
+	if rcv, err := ev.RTPStats(); err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(exp, rcv) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, rcv)
+	}
+	if _, err := ParseFSEvent("Event-Name: CHANNEL_HANGUP_COMPLETE\nvariable_billsec: 12\n").RTPStats(); err != ErrRTPStatsNotFound {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrRTPStatsNotFound, err)
+	}
+	expErr := "Invalid variable_rtp_audio_in_mos value: <high>"
+	if _, err := ParseFSEvent("variable_rtp_audio_in_mos: high\n").RTPStats(); err == nil || err.Error() != expErr {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", expErr, err)
+	}
+}
+
+func TestFSEventSIPInfo(t *testing.T) {
+	ev := ParseFSEvent("Event-Name: CHANNEL_CREATE\nUnique-ID: e3f2a1c4\n" +
+		"variable_sip_from_uri: 1001%40192.168.56.74\nvariable_sip_to_uri: 1002%40192.168.56.74\n" +
+		"variable_sip_call_id: 4c882cc4-f1d8\nvariable_sip_network_ip: 192.168.56.1\n" +
+		"variable_sip_user_agent: Zoiper%20rv2.8.46\nvariable_sip_from_user: 1001\n")
+	exp := &SIPInfo{
+		FromURI:   "1001@192.168.56.74",
+		ToURI:     "1002@192.168.56.74",
+		CallID:    "4c882cc4-f1d8",
+		NetworkIP: "192.168.56.1",
+		UserAgent: "Zoiper rv2.8.46",
+	}
+	if rcv, err := ev.SIPInfo(); err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(exp, rcv) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, rcv)
+	}
+	if _, err := ParseFSEvent("Event-Name: CHANNEL_CREATE\nvariable_channel_name: loopback/1002-a\n").SIPInfo(); err != ErrSIPInfoNotFound {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrSIPInfoNotFound, err)
+	}
+}
+
+func TestFSEventGet(t *testing.T) {
+	ev := ParseFSEvent("Event-Name: CHANNEL_ANSWER\nUnique-ID: e3f2a1c4\n")
+	if rcv := ev.Get("unique-id"); rcv != "e3f2a1c4" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "e3f2a1c4", rcv)
+	}
+	if rcv := ev.Get("Unique-ID"); rcv != "e3f2a1c4" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "e3f2a1c4", rcv)
+	}
+	if rcv := ev.Header("unique-id"); rcv != "" {
+		t.Errorf("Expected exact match only from Header, received: <%s>", rcv)
+	}
+	if rcv := ev.Get("Other-Leg-Unique-ID"); rcv != "" {
+		t.Errorf("Expected empty value, received: <%s>", rcv)
+	}
+}
+
+func TestFSEventUppercaseHeaders(t *testing.T) {
+	ev := ParseFSEvent("EVENT-NAME: CHANNEL_ANSWER\nUNIQUE-ID: e3f2a1c4\nEVENT-SEQUENCE: 4012\n")
+	if rcv := ev.Name(); rcv != "CHANNEL_ANSWER" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "CHANNEL_ANSWER", rcv)
+	}
+	if rcv := ev.UUID(); rcv != "e3f2a1c4" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "e3f2a1c4", rcv)
+	}
+	if seq, ok := ev.Sequence(); !ok || seq != 4012 {
+		t.Errorf("Expected sequence 4012, received: %d, %v", seq, ok)
+	}
+	if _, has := ev.Headers["EVENT-NAME"]; !has {
+		t.Errorf("Expected the original casing kept, received: %v", ev.Headers)
+	}
+}
+
+func TestFSEventSequence(t *testing.T) {
+	if seq, has := ParseFSEvent("Event-Name: CHANNEL_ANSWER\nEvent-Sequence: 34263\n").Sequence(); !has || seq != 34263 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 34263, seq)
+	}
+	for _, ev := range []string{"Event-Name: CHANNEL_ANSWER\n", "Event-Name: CHANNEL_ANSWER\nEvent-Sequence: -1\n"} {
+		if _, has := ParseFSEvent(ev).Sequence(); has {
+			t.Errorf("Expected no sequence for <%s>", ev)
+		}
+	}
+}
+
+func BenchmarkFSEventGetExact(b *testing.B) {
+	ev := ParseFSEvent(BODY)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ev.Get("Event-Name")
+	}
+}
+
+func BenchmarkFSEventGetFold(b *testing.B) {
+	ev := ParseFSEvent(BODY)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ev.Get("event-name")
+	}
+}
+
+func TestFSEventBodyJSON(t *testing.T) {
+	body := `{"conference":"3000","action":"add-member","members":[{"id":2,"name":"Bob","flags":{"can_speak":true}}]}`
+	ev := ParseFSEvent(fmt.Sprintf("Event-Name: CUSTOM\nEvent-Subclass: conference%%3A%%3Amaintenance\nContent-Length: %d\n\n%s",
+		len(body), body))
+	type member struct {
+		ID    int    `json:"id"`
+		Name  string `json:"name"`
+		Flags struct {
+			CanSpeak bool `json:"can_speak"`
+		} `json:"flags"`
+	}
+	var data struct {
+		Conference string   `json:"conference"`
+		Action     string   `json:"action"`
+		Members    []member `json:"members"`
+	}
+	if err := ev.BodyJSON(&data); err != nil {
+		t.Fatal(err)
+	}
+	if data.Conference != "3000" || data.Action != "add-member" || len(data.Members) != 1 ||
+		data.Members[0].ID != 2 || data.Members[0].Name != "Bob" || !data.Members[0].Flags.CanSpeak {
+		t.Errorf("Unexpected body: %+v", data)
+	}
+	for _, ev := range []*FSEvent{
+		ParseFSEvent("Event-Name: HEARTBEAT\n"),
+		ParseFSEvent("Event-Name: CUSTOM\nContent-Length: 11\n\nplain text\n"),
+	} {
+		if err := ev.BodyJSON(&data); err == nil || err.Error() != "Event body is not json" {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "Event body is not json", err)
+		}
+	}
+	var n int
+	if err := ev.BodyJSON(&n); err == nil {
+		t.Error("Expected error unmarshaling the object into an int")
+	}
+}
+
+func TestFSEventBodyAsEvent(t *testing.T) {
+	inner := "Event-Name: CONFERENCE_DATA\nConference-Name: 3000\nMember-ID: 2\n\nmember body"
+	ev := ParseFSEvent(fmt.Sprintf("Event-Name: CUSTOM\nEvent-Subclass: conference::maintenance\nContent-Length: %d\n\n%s", len(inner), inner))
+	nested, err := ev.BodyAsEvent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nested.Name() != "CONFERENCE_DATA" || nested.Header("Member-ID") != "2" || nested.Body != "member body" {
+		t.Errorf("Unexpected nested event: %+v", nested)
+	}
+	if _, err := nested.BodyAsEvent(); err == nil {
+		t.Error("Expected the text body rejected as event")
+	}
+	if _, err := ParseFSEvent("Event-Name: HEARTBEAT\n").BodyAsEvent(); err == nil {
+		t.Error("Expected the empty body rejected as event")
+	}
+	body := "Event-Name: LEAF\n"
+	for i := 0; i <= maxNestedEvents; i++ {
+		body = fmt.Sprintf("Event-Name: NODE\nContent-Length: %d\n\n%s", len(body), body)
+	}
+	ev = ParseFSEvent(body)
+	for i := 0; i < maxNestedEvents; i++ {
+		if ev, err = ev.BodyAsEvent(); err != nil {
+			t.Fatalf("Depth %d: %v", i+1, err)
+		}
+	}
+	expErr := fmt.Sprintf("Nested events deeper than %d", maxNestedEvents)
+	if _, err = ev.BodyAsEvent(); err == nil || err.Error() != expErr {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", expErr, err)
+	}
+}
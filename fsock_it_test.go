@@ -129,10 +129,10 @@ func testSendEventWithBody(fs *FSock, t *testing.T) {
 	}
 	body := "OK"
 
-	if rply, err := fs.SendEventWithBody(event, args, body); err != nil {
+	if res, err := fs.SendEventWithBody(event, args, body); err != nil {
 		t.Error(err)
-	} else if !strings.HasPrefix(rply, "+OK") {
-		t.Errorf("Event resonse wrong %s", rply)
+	} else if !res.OK || !strings.HasPrefix(res.ReplyText, "+OK") {
+		t.Errorf("Event resonse wrong %+v", res)
 	}
 }
 
@@ -145,10 +145,10 @@ func testSendEvent(fs *FSock, t *testing.T) {
 		"user":         "1005",
 		"host":         "99.157.44.194",
 	}
-	if rply, err := fs.SendEvent(event, args); err != nil {
+	if res, err := fs.SendEvent(event, args); err != nil {
 		t.Error(err)
-	} else if !strings.HasPrefix(rply, "+OK") {
-		t.Errorf("Event resonse wrong %s", rply)
+	} else if !res.OK || !strings.HasPrefix(res.ReplyText, "+OK") {
+		t.Errorf("Event resonse wrong %+v", res)
 	}
 }
 
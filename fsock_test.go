@@ -10,14 +10,30 @@ package fsock
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"io/ioutil"
+	"math/big"
 	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -64,6 +80,68 @@ func TestHeaders(t *testing.T) {
 	}
 }
 
+func TestHeadersFolded(t *testing.T) {
+	fs := &FSock{
+		fsMutex: new(sync.RWMutex),
+		logger:  nopLogger{},
+		buffer: bufio.NewReader(bytes.NewBufferString("Content-Type:\n text/event-plain\nReply-Text: +OK Job-UUID:\r\n\t" +
+			"7f4db78a-17d7-11dd-b7a0-db4edd065621\nContent-Length: 0\n\n")),
+	}
+	h, err := fs.readHeaders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := "Content-Type: text/event-plain\nReply-Text: +OK Job-UUID: 7f4db78a-17d7-11dd-b7a0-db4edd065621\nContent-Length: 0\n"
+	if h != exp {
+		t.Errorf("\nExpected: %q, \nReceived: %q", exp, h)
+	}
+	if rcv := headerVal(h, "Content-Type"); rcv != "text/event-plain" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "text/event-plain", rcv)
+	}
+}
+
+// countingReader counts the bytes read out of the wrapped reader
+type countingReader struct {
+	io.Reader
+	n int
+}
+
+func (cr *countingReader) Read(b []byte) (n int, err error) {
+	n, err = cr.Reader.Read(b)
+	cr.n += n
+	return
+}
+
+func TestHeadersMaxLine(t *testing.T) {
+	rdr := &countingReader{Reader: strings.NewReader("Content-Type: command/reply\nReply-Text: " + strings.Repeat("a", 1<<20))}
+	fs := &FSock{
+		fsMutex:       new(sync.RWMutex),
+		logger:        nopLogger{},
+		buffer:        bufio.NewReaderSize(rdr, 4096),
+		maxHeaderLine: 8192,
+	}
+	if _, err := fs.readHeaders(); err != io.EOF {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", io.EOF, err)
+	}
+	if err := fs.LastError(); err != ErrHeaderLineTooLong {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrHeaderLineTooLong, err)
+	}
+	if rdr.n > 3*8192 {
+		t.Errorf("Expected the reads stopped at the maximum line, read: %d bytes", rdr.n)
+	}
+	fs = &FSock{
+		fsMutex:       new(sync.RWMutex),
+		logger:        nopLogger{},
+		buffer:        bufio.NewReaderSize(strings.NewReader("Reply-Text: "+strings.Repeat("a", 6000)+"\n\n"), 4096),
+		maxHeaderLine: 8192,
+	}
+	if h, err := fs.readHeaders(); err != nil {
+		t.Error(err)
+	} else if len(h) != 6013 {
+		t.Errorf("Expected the line longer than the buffer kept whole, received %d bytes", len(h))
+	}
+}
+
 func TestEvent(t *testing.T) {
 	r, w, err := os.Pipe()
 	if err != nil {
@@ -230,7 +308,7 @@ func (cM *connMock3) Read(b []byte) (n int, err error) {
 }
 
 func (cM *connMock3) Write(b []byte) (n int, err error) {
-	return 0, nil
+	return len(b), nil
 }
 
 func (cM *connMock3) SetDeadline(t time.Time) error {
@@ -284,7 +362,7 @@ func TestFSockAuthFailReply(t *testing.T) {
 		logger:  new(nopLogger),
 	}
 
-	expected := fmt.Sprintf("Unexpected auth reply received: <%s>", strings.TrimSuffix(HEADER, "\n"))
+	expected := "Unexpected auth reply received: <Content-Type: command/reply\nReply-Text: -ERR invalid\n>"
 	err := fs.auth()
 	if err != nil {
 		t.Fatal(err)
@@ -296,11 +374,15 @@ func TestFSockAuthFailReply(t *testing.T) {
 	}
 
 	buf.Reset()
-	fs.buffer = bufio.NewReader(bytes.NewBuffer([]byte(HEADER)))
+	fs.buffer = bufio.NewReader(bytes.NewBuffer([]byte(HEADER + BODY[:564] + // an event is not taken for the reply
+		"Content-Type: command/reply\nReply-Text: -ERR invalid\n\n")))
 	err = fs.auth()
 
 	if err == nil || err.Error() != expected {
-		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", expected, err.Error())
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", expected, err)
+	}
+	if len(fs.earlyFrames) != 1 || fs.earlyFrames[0].body != BODY[:564] {
+		t.Errorf("Expected the event kept for the read loop, received: %+v", fs.earlyFrames)
 	}
 
 	if rcv := buf.String(); rcv != expectedbuf {
@@ -394,6 +476,38 @@ func TestFSockReadEvents(t *testing.T) {
 	}
 }
 
+func TestFSockNotConnected(t *testing.T) {
+	for _, fs := range []*FSock{nil, new(FSock)} {
+		if _, err := fs.SendApiCmd("status"); err != ErrNotConnected {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrNotConnected, err)
+		}
+		if _, err := fs.SendApiCmd("api status"); err != ErrNotConnected { // the redundant verb trimmed after the check
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrNotConnected, err)
+		}
+		if _, err := fs.SendApiCmdContext(context.Background(), "bgapi status"); err != ErrNotConnected {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrNotConnected, err)
+		}
+		if _, err := fs.SendCmd("status"); err != ErrNotConnected {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrNotConnected, err)
+		}
+		if _, err := fs.SendBgapiCmd("status"); err != ErrNotConnected {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrNotConnected, err)
+		}
+		if err := fs.SendMsgCmd("testID", map[string]string{"call-command": "hangup"}); err != ErrNotConnected {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrNotConnected, err)
+		}
+		if err := fs.AddEventHandler("HEARTBEAT", func(string, int) {}); err != ErrNotConnected {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrNotConnected, err)
+		}
+		if err := fs.ReadEvents(); err != ErrNotConnected {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrNotConnected, err)
+		}
+		if fs.Connected() {
+			t.Error("Expected not connected")
+		}
+	}
+}
+
 func TestFSockReadBody(t *testing.T) {
 	fs := &FSock{
 		fsMutex: &sync.RWMutex{},
@@ -411,6 +525,54 @@ func TestFSockReadBody(t *testing.T) {
 	}
 }
 
+func TestFSockReadEventNoContentLength(t *testing.T) {
+	frames := "Content-Type: text/event-plain\n\n" +
+		"Event-Name: BACKGROUND_JOB\nJob-UUID: 7f4db78a-17d7-11dd-b7a0-db4edd065621\nContent-Length: 16\n\n" +
+		"+OK 7f4db78a\n\nok" +
+		"Content-Type: command/reply\nReply-Text: +OK\n\n"
+	fs := &FSock{
+		fsMutex: &sync.RWMutex{},
+		logger:  nopLogger{},
+		buffer:  bufio.NewReader(bytes.NewBufferString(frames)),
+	}
+	expBody := "Event-Name: BACKGROUND_JOB\nJob-UUID: 7f4db78a-17d7-11dd-b7a0-db4edd065621\nContent-Length: 16\n\n+OK 7f4db78a\n\nok"
+	hdr, body, err := fs.readEvent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr != "Content-Type: text/event-plain\n" {
+		t.Errorf("\nExpected: %q, \nReceived: %q", "Content-Type: text/event-plain\n", hdr)
+	}
+	if body != expBody {
+		t.Errorf("\nExpected: %q, \nReceived: %q", expBody, body)
+	}
+	if rcv := headerVal(body, "Job-UUID"); rcv != "7f4db78a-17d7-11dd-b7a0-db4edd065621" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "7f4db78a-17d7-11dd-b7a0-db4edd065621", rcv)
+	}
+	// the following frame is not corrupted
+	if hdr, _, err = fs.readEvent(); err != nil {
+		t.Fatal(err)
+	}
+	if exp := "Content-Type: command/reply\nReply-Text: +OK\n"; hdr != exp {
+		t.Errorf("\nExpected: %q, \nReceived: %q", exp, hdr)
+	}
+}
+
+func TestFSockReadEventLowercaseContentLength(t *testing.T) {
+	fs := &FSock{
+		fsMutex: &sync.RWMutex{},
+		logger:  nopLogger{},
+		buffer:  bufio.NewReader(bytes.NewBufferString("content-type: api/response\ncontent-length: 12\n\n+OK\n\nok body")),
+	}
+	_, body, err := fs.readEvent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := "+OK\n\nok body"; body != exp {
+		t.Errorf("\nExpected: %q, \nReceived: %q", exp, body)
+	}
+}
+
 func TestFSockSendCmdErrSend(t *testing.T) {
 	fs := &FSock{
 		fsMutex:    &sync.RWMutex{},
@@ -487,6 +649,40 @@ func TestFSockSendMsgCmdWithBody(t *testing.T) {
 	}
 }
 
+func TestFSockSendMsgCmdChannelGone(t *testing.T) {
+	m := newFSMock(t)
+	m.cmdReply = func(cmd string) string {
+		if strings.HasPrefix(cmd, "sendmsg ") {
+			return "-ERR invalid session id [" + strings.Fields(cmd)[1] + "]"
+		}
+		return "+OK"
+	}
+	fs := newMockedFSock(t, m, nil)
+	err := fs.SendMsgCmd("d6e5b5ac", map[string]string{"call-command": "execute", "execute-app-name": "playback"})
+	if !errors.Is(err, ErrChannelGone) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrChannelGone, err)
+	}
+}
+
+func TestFSockSendApiCmdRedundantVerb(t *testing.T) {
+	m := newFSMock(t)
+	fs := newMockedFSock(t, m, nil)
+	for _, cmd := range []string{"api status", "bgapi  status"} {
+		if _, err := fs.SendApiCmd(cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := fs.SendApiCmdContext(context.Background(), "api status"); err != nil {
+		t.Fatal(err)
+	}
+	m.waitCommand(t, 0, "api status")
+	for _, cmd := range m.commands(0) {
+		if strings.HasPrefix(cmd, "api ") && cmd != "api status" {
+			t.Errorf("Unexpected command on the wire: %q", cmd)
+		}
+	}
+}
+
 func TestFSockLocalAddr(t *testing.T) {
 	fs := &FSock{
 		conn:    &connMock{},
@@ -525,6 +721,7 @@ func TestFSockreadEvent(t *testing.T) {
 func TestFSockreadEventsStopRead(t *testing.T) {
 	// nothing to check only for coverage
 	fs := &FSock{
+		fsMutex:        new(sync.RWMutex),
 		stopReadEvents: make(chan struct{}, 1),
 	}
 
@@ -704,13 +901,14 @@ func (lM *loggerMock) Warning(event string) error {
 func TestFSockdispatchEvent(t *testing.T) {
 	l := &loggerMock{}
 	fs := &FSock{
-		logger: l,
+		logger:  l,
+		fsMutex: new(sync.RWMutex),
 	}
 	event := "Event-Name: CUSTOM\n"
 	event += "Event-Subclass: test"
 
 	expected := fmt.Sprintf("<FSock> No dispatcher for event: <%+v> with event name: %s", event, "CUSTOM test")
-	fs.dispatchEvent(event)
+	fs.dispatchEvent(event, "")
 
 	if l.msgType != "warning" {
 		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "warning", l.msgType)
@@ -783,6 +981,7 @@ func TestFSockNewFSockPool(t *testing.T) {
 	fsnew := NewFSockPool(maxFSocks, fsaddr, fspw, reconns, maxWait, 0, fibDuration, evHandlers, evFilters, nil, connIdx, true)
 	fsnew.allowedConns = nil
 	fsnew.fSocks = nil
+	fsnew.done = nil
 	fsnew.delayFuncConstructor = nil
 
 	if !reflect.DeepEqual(fspool, fsnew) {
@@ -896,12 +1095,12 @@ func TestFSockPopFSock5(t *testing.T) {
 		logger:               nopLogger{},
 		connIdx:              0,
 		fSocks:               make(chan *FSock, 1),
-		allowedConns:         make(chan struct{}),
+		allowedConns:         make(chan struct{}, 1),
 		maxWaitConn:          20 * time.Millisecond,
 	}
 
 	expected := "dial tcp: address testAddr: missing port in address"
-	close(fs.allowedConns)
+	fs.allowedConns <- struct{}{}
 	fsock, err := fs.PopFSock()
 
 	if err.Error() != expected {
@@ -909,4 +1108,3619 @@ func TestFSockPopFSock5(t *testing.T) {
 	} else if fsock != nil {
 		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", nil, fsock)
 	}
+	if len(fs.allowedConns) != 1 {
+		t.Error("Expected the capacity kept after the failed creation")
+	}
+}
+
+// fsMock is a minimal FreeSWITCH event socket server used to test the connection flows
+type fsMock struct {
+	l         net.Listener
+	passwd    string
+	altPasswd string                         // also accepted by auth if set, eg: as the new password of a ReAuth
+	apiReply  func(cmd string) string        // builds the api/response body, defaults to "+OK\n"
+	cmdReply  func(cmd string) string        // builds the command/reply Reply-Text, defaults to "+OK"
+	apiFrame  func(idx int, cmd string) bool // writes the api/response itself if returning true, eg: in parts
+	rejects   int                            // number of connections closed right after being accepted
+
+	mu     sync.Mutex
+	conns  []net.Conn
+	cmds   [][]string
+	active int // connections not yet closed by the client
+
+	trickle   bool   // under mu, writes the auth banner and reply byte by byte, as fragmented by a slow network
+	afterAuth string // under mu, written right after the auth reply, eg: an event streamed early
+}
+
+func newFSMock(t testing.TB) *fsMock {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &fsMock{l: l, passwd: "ClueCon"}
+	go m.serve()
+	t.Cleanup(m.close)
+	return m
+}
+
+// newTLSFSMock starts a fsMock accepting the TLS connections, returning it with the client config trusting its certificate
+func newTLSFSMock(t testing.TB) (*fsMock, *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "fsMock"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &fsMock{l: tls.NewListener(l, &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}), passwd: "ClueCon"}
+	go m.serve()
+	t.Cleanup(m.close)
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	return m, &tls.Config{RootCAs: roots}
+}
+
+func (m *fsMock) addr() string {
+	return m.l.Addr().String()
+}
+
+func (m *fsMock) close() {
+	m.l.Close()
+	m.mu.Lock()
+	for _, c := range m.conns {
+		c.Close()
+	}
+	m.mu.Unlock()
+}
+
+func (m *fsMock) serve() {
+	for {
+		c, err := m.l.Accept()
+		if err != nil {
+			return
+		}
+		m.mu.Lock()
+		idx := len(m.conns)
+		m.conns = append(m.conns, c)
+		m.cmds = append(m.cmds, nil)
+		reject := idx < m.rejects
+		if !reject {
+			m.active++
+		}
+		m.mu.Unlock()
+		if reject {
+			c.Close()
+			continue
+		}
+		go m.handle(idx, c)
+	}
+}
+
+func (m *fsMock) handle(idx int, c net.Conn) {
+	defer func() {
+		m.mu.Lock()
+		m.active--
+		m.mu.Unlock()
+	}()
+	m.mu.Lock()
+	trickle, afterAuth := m.trickle, m.afterAuth
+	m.mu.Unlock()
+	if trickle {
+		m.writeTrickle(idx, "Content-Type: auth/request\n\n")
+	} else {
+		m.write(idx, "Content-Type: auth/request\n\n")
+	}
+	rdr := bufio.NewReader(c)
+	for {
+		var lns []string
+		for {
+			ln, err := rdr.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if ln = strings.TrimSuffix(ln, "\n"); ln == "" {
+				break
+			}
+			lns = append(lns, ln)
+		}
+		if len(lns) == 0 {
+			continue
+		}
+		cmd := strings.Join(lns, "\n")
+		m.mu.Lock()
+		m.cmds[idx] = append(m.cmds[idx], cmd)
+		apiReply, cmdReply, apiFrame := m.apiReply, m.cmdReply, m.apiFrame
+		m.mu.Unlock()
+		switch {
+		case strings.HasPrefix(cmd, "auth "):
+			if pass := strings.TrimPrefix(cmd, "auth "); pass != m.passwd && (m.altPasswd == "" || pass != m.altPasswd) {
+				m.write(idx, "Content-Type: command/reply\nReply-Text: -ERR invalid\n\n")
+				continue
+			}
+			if trickle {
+				m.writeTrickle(idx, "Content-Type: command/reply\nReply-Text: +OK accepted\n\n")
+				continue
+			}
+			m.write(idx, "Content-Type: command/reply\nReply-Text: +OK accepted\n\n"+afterAuth)
+		case strings.HasPrefix(cmd, "api ") && apiFrame != nil && apiFrame(idx, strings.TrimPrefix(cmd, "api ")):
+		case strings.HasPrefix(cmd, "api "):
+			body := "+OK\n"
+			if apiReply != nil {
+				body = apiReply(strings.TrimPrefix(cmd, "api "))
+			}
+			m.write(idx, fmt.Sprintf("Content-Type: api/response\nContent-Length: %d\n\n%s", len(body), body))
+		case cmd == "exit":
+			rplyText := "+OK bye"
+			if cmdReply != nil {
+				rplyText = cmdReply(cmd)
+			}
+			m.write(idx, "Content-Type: command/reply\nReply-Text: "+rplyText+"\n\n")
+			if rplyText == "+OK bye" {
+				m.write(idx, "Content-Type: text/disconnect-notice\nContent-Length: 8\n\nGood bye")
+				c.Close()
+				return
+			}
+		default:
+			rplyText := "+OK"
+			if cmdReply != nil {
+				rplyText = cmdReply(cmd)
+			}
+			m.write(idx, "Content-Type: command/reply\nReply-Text: "+rplyText+"\n\n")
+		}
+	}
+}
+
+// write sends raw data over the connection with the given index
+func (m *fsMock) write(idx int, data string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.conns[idx].Write([]byte(data))
+}
+
+// writeTrickle sends the data over the connection with the given index one byte per write
+func (m *fsMock) writeTrickle(idx int, data string) {
+	for i := 0; i < len(data); i++ {
+		m.write(idx, data[i:i+1])
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// connCount returns the number of connections accepted so far
+func (m *fsMock) connCount() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.conns)
+}
+
+// activeConns returns the number of connections still open on the client side
+func (m *fsMock) activeConns() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.active
+}
+
+// dropConn closes the connection with the given index from the server side
+func (m *fsMock) dropConn(idx int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.conns[idx].Close()
+}
+
+// sendEvent writes an event-plain frame containing body over the connection with the given index
+func (m *fsMock) sendEvent(idx int, body string) {
+	m.write(idx, fmt.Sprintf("Content-Length: %d\nContent-Type: text/event-plain\n\n%s", len(body), body))
+}
+
+// commands returns the commands received over the connection with the given index
+func (m *fsMock) commands(idx int) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if idx >= len(m.cmds) {
+		return nil
+	}
+	return append([]string{}, m.cmds[idx]...)
+}
+
+// waitCommand waits for cmd to be received over the connection with the given index
+func (m *fsMock) waitCommand(t *testing.T, idx int, cmd string) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		for _, c := range m.commands(idx) {
+			if c == cmd {
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("command %q not received, got: %q", cmd, m.commands(idx))
+}
+
+func TestFSockPoolHandlerFactory(t *testing.T) {
+	m := newFSMock(t)
+	rcv := make(chan [2]string, 2)
+	factory := func(connID string) map[string][]func(string, int) {
+		return map[string][]func(string, int){
+			"HEARTBEAT": {func(ev string, _ int) {
+				rcv <- [2]string{connID, headerVal(ev, "Event-Name")}
+			}},
+		}
+	}
+	pool := NewFSockPool(2, m.addr(), "ClueCon", 0, time.Second, 0, fibDuration,
+		nil, nil, nil, 0, false, WithHandlerFactory(factory))
+	var fSocks []*FSock
+	for i := 0; i < 2; i++ {
+		fsk, err := pool.PopFSock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fsk.Disconnect()
+		fSocks = append(fSocks, fsk)
+	}
+	if fSocks[0].ConnID() == fSocks[1].ConnID() {
+		t.Fatalf("Expected distinct connIDs, received: %q", fSocks[0].ConnID())
+	}
+	for i, fsk := range fSocks {
+		m.sendEvent(i, "Event-Name: HEARTBEAT\n")
+		select {
+		case r := <-rcv:
+			if r[0] != fsk.ConnID() {
+				t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", fsk.ConnID(), r[0])
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Timeout waiting for event")
+		}
+	}
+}
+
+// newMockedFSock connects a new FSock to the mock, disconnecting it at the end of the test
+func newMockedFSock(t testing.TB, m *fsMock, evHandlers map[string][]func(string, int), opts ...FSockOption) *FSock {
+	t.Helper()
+	fs, err := NewFSock(m.addr(), m.passwd, 1, 0, fibDuration, evHandlers, nil, nil, 0, false, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fs.Disconnect() })
+	return fs
+}
+
+func TestFSockSendApiCmdAsync(t *testing.T) {
+	m := newFSMock(t)
+	m.apiReply = func(string) string { return "+OK accepted\n" }
+	fs := newMockedFSock(t, m, map[string][]func(string, int){
+		"CHANNEL_CREATE": {func(string, int) {}},
+	})
+	uuid := "d6e5b5ac-4f54-4b52-9b84-ab2d7c3a0f6e"
+	cmd := "originate {origination_uuid=" + uuid + "}user/1001 &park()"
+	rply, evChan, err := fs.SendApiCmdAsync(cmd, "CHANNEL_CREATE", uuid)
+	if err != nil {
+		t.Fatal(err)
+	} else if rply != "+OK accepted\n" {
+		t.Errorf("\nExpected: %q, \nReceived: %q", "+OK accepted\n", rply)
+	}
+	m.waitCommand(t, 0, "api "+cmd)
+	m.sendEvent(0, "Event-Name: CHANNEL_CREATE\nUnique-ID: other\n")
+	m.sendEvent(0, "Event-Name: CHANNEL_CREATE\nUnique-ID: "+uuid+"\n")
+	select {
+	case ev := <-evChan:
+		if rcv := headerVal(ev, "Unique-ID"); rcv != uuid {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", uuid, rcv)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for CHANNEL_CREATE")
+	}
+	fs.fsMutex.RLock()
+	if len(fs.eventWaiters) != 0 {
+		t.Errorf("Expected no waiters left, received: %+v", fs.eventWaiters)
+	}
+	fs.fsMutex.RUnlock()
+}
+
+func TestFSockRunSequence(t *testing.T) {
+	m := newFSMock(t)
+	fs := newMockedFSock(t, m, map[string][]func(string, int){
+		"CHANNEL_EXECUTE_COMPLETE": {func(string, int) {}},
+		"CHANNEL_HANGUP":           {func(string, int) {}},
+	})
+	uuid := "c1b6a3f0"
+	type seqRply struct {
+		evs []*FSEvent
+		err error
+	}
+	rply := make(chan seqRply, 1)
+	go func() {
+		evs, err := fs.RunSequence(uuid, []AppStep{{App: "playback", Args: "welcome.wav"}, {App: "playback", Args: "menu.wav"}})
+		rply <- seqRply{evs, err}
+	}()
+	var appUUID string
+	for i := 0; i < 100 && appUUID == ""; i++ {
+		for _, cmd := range m.commands(0) {
+			if strings.HasPrefix(cmd, "sendmsg "+uuid) && strings.Contains(cmd, "welcome.wav") {
+				appUUID = headerVal(cmd, "Event-UUID")
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if appUUID == "" {
+		t.Fatalf("First step not executed, received: %q", m.commands(0))
+	}
+	m.sendEvent(0, "Event-Name: CHANNEL_EXECUTE_COMPLETE\nUnique-ID: "+uuid+
+		"\nApplication: playback\nApplication-UUID: "+appUUID+"\n")
+	m.sendEvent(0, "Event-Name: CHANNEL_HANGUP\nUnique-ID: "+uuid+"\n")
+	select {
+	case r := <-rply:
+		if r.err != ErrChannelHangup {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrChannelHangup, r.err)
+		}
+		if len(r.evs) != 1 || r.evs[0].Header("Application-UUID") != appUUID {
+			t.Errorf("Expected only the first step completion, received: %s", toJSON(r.evs))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for the sequence")
+	}
+	fs.fsMutex.RLock()
+	if len(fs.eventWaiters) != 0 {
+		t.Errorf("Expected no waiters left, received: %+v", fs.eventWaiters)
+	}
+	fs.fsMutex.RUnlock()
+}
+
+func TestFSockTeeTo(t *testing.T) {
+	m := newFSMock(t)
+	primary := make(chan string, 4)
+	fs := newMockedFSock(t, m, map[string][]func(string, int){
+		"HEARTBEAT":      {func(ev string, _ int) { primary <- headerVal(ev, "Event-Sequence") }},
+		"CHANNEL_ANSWER": {func(ev string, _ int) { primary <- headerVal(ev, "Event-Sequence") }},
+	})
+	tee := make(chan string, 4)
+	fs.TeeTo(map[string][]func(string, int){
+		"ALL": {func(ev string, _ int) { tee <- headerVal(ev, "Event-Sequence") }},
+	})
+	m.sendEvent(0, "Event-Name: HEARTBEAT\nEvent-Sequence: 1\n")
+	m.sendEvent(0, "Event-Name: CHANNEL_ANSWER\nEvent-Sequence: 2\n")
+	for _, ch := range []chan string{primary, tee} {
+		rcv := make(map[string]bool)
+		for i := 0; i < 2; i++ {
+			select {
+			case seq := <-ch:
+				rcv[seq] = true
+			case <-time.After(time.Second):
+				t.Fatal("Timeout waiting for events")
+			}
+		}
+		if exp := map[string]bool{"1": true, "2": true}; !reflect.DeepEqual(exp, rcv) {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, rcv)
+		}
+	}
+}
+
+func TestFSockWithProxy(t *testing.T) {
+	m := newFSMock(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	connectTo := make(chan string, 1)
+	go func() { // CONNECT proxy fronting the mock
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		rdr := bufio.NewReader(c)
+		req, err := http.ReadRequest(rdr)
+		if err != nil || req.Method != http.MethodConnect {
+			c.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+			return
+		}
+		connectTo <- req.Host + " " + req.Header.Get("Proxy-Authorization")
+		fsConn, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			c.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+			return
+		}
+		defer fsConn.Close()
+		c.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go io.Copy(fsConn, rdr)
+		io.Copy(c, fsConn)
+	}()
+	proxyURL, err := url.Parse("http://user:pass@" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := newMockedFSock(t, m, nil, WithProxy(proxyURL))
+	if exp, rcv := m.addr()+" Basic dXNlcjpwYXNz", <-connectTo; rcv != exp {
+		t.Errorf("\nExpected: %q, \nReceived: %q", exp, rcv)
+	}
+	if rply, err := fs.SendApiCmd("status"); err != nil {
+		t.Error(err)
+	} else if rply != "+OK\n" {
+		t.Errorf("\nExpected: %q, \nReceived: %q", "+OK\n", rply)
+	}
+}
+
+func TestFSockWithProxyRejected(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		http.ReadRequest(bufio.NewReader(c))
+		c.Write([]byte("HTTP/1.1 403 Forbidden\r\n\r\n"))
+	}()
+	proxyURL := &url.URL{Scheme: "http", Host: l.Addr().String()}
+	_, err = NewFSock("127.0.0.1:8021", "ClueCon", 0, 0, fibDuration, nil, nil, nil, 0, false, WithProxy(proxyURL))
+	if exp := "Unexpected proxy reply received: <403 Forbidden>"; err == nil || err.Error() != exp {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, err)
+	}
+}
+
+func TestFSockResetBuffer(t *testing.T) {
+	fs := &FSock{
+		fsMutex: new(sync.RWMutex),
+		logger:  nopLogger{},
+		buffer:  bufio.NewReader(strings.NewReader("Content-Length: 564\nContent-Type: text/ev")), // partial frame of a dead connection
+	}
+	cl, srv := net.Pipe()
+	defer cl.Close()
+	defer srv.Close()
+	fs.conn = cl
+	fs.resetBuffer()
+	go srv.Write([]byte(HEADER + BODY))
+	h, b, err := fs.readEvent()
+	if err != nil {
+		t.Fatal(err)
+	} else if h != HEADER[:len(HEADER)-1] || b != BODY[:564] {
+		t.Errorf("Error parsing event: %q, %q", h, b)
+	}
+}
+
+func TestFSockReconnectDropsPartialFrame(t *testing.T) {
+	m := newFSMock(t)
+	fs := newMockedFSock(t, m, nil)
+	m.write(0, "Content-Length: 564\nContent-Type: text/ev")
+	m.dropConn(0)
+	for i := 0; i < 100 && fs.Connected(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := fs.ReconnectIfNeeded(); err != nil {
+		t.Fatal(err)
+	}
+	if rply, err := fs.SendApiCmd("status"); err != nil {
+		t.Error(err)
+	} else if rply != "+OK\n" {
+		t.Errorf("\nExpected: %q, \nReceived: %q", "+OK\n", rply)
+	}
+}
+
+func TestFSockSubscribeAll(t *testing.T) {
+	m := newFSMock(t)
+	rcv := make(chan string, 3)
+	fs := newMockedFSock(t, m, map[string][]func(string, int){
+		"HEARTBEAT": {func(string, int) {}},
+	})
+	if err := fs.SubscribeAll(func(ev string, _ int) { rcv <- headerVal(ev, "Event-Name") }); err != nil {
+		t.Fatal(err)
+	}
+	if cmds := m.commands(0); cmds[len(cmds)-1] != "event plain ALL" {
+		t.Errorf("\nExpected: %q, \nReceived: %q", "event plain ALL", cmds[len(cmds)-1])
+	}
+	if err := fs.AddEventHandler("CHANNEL_PARK", func(string, int) {}); err != nil {
+		t.Fatal(err)
+	}
+	if cmds := m.commands(0); cmds[len(cmds)-1] != "event plain ALL" {
+		t.Errorf("Expected no narrowing subscription, received: %q", cmds[len(cmds)-1])
+	}
+	for _, evName := range []string{"CHANNEL_CREATE", "PRESENCE_IN", "RE_SCHEDULE"} {
+		m.sendEvent(0, "Event-Name: "+evName+"\n")
+		select {
+		case name := <-rcv:
+			if name != evName {
+				t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", evName, name)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Timeout waiting for " + evName)
+		}
+	}
+	m.dropConn(0)
+	for i := 0; i < 100 && fs.Connected(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := fs.ReconnectIfNeeded(); err != nil {
+		t.Fatal(err)
+	}
+	m.waitCommand(t, 1, "event plain all")
+}
+
+func TestFSockAddEventHandler(t *testing.T) {
+	m := newFSMock(t)
+	fs := newMockedFSock(t, m, nil)
+	rcv := make(chan string, 1)
+	if err := fs.AddEventHandler("CHANNEL_ANSWER", func(ev string, _ int) { rcv <- headerVal(ev, "Unique-ID") }); err != nil {
+		t.Fatal(err)
+	}
+	m.waitCommand(t, 0, "event plain CHANNEL_ANSWER")
+	m.sendEvent(0, "Event-Name: CHANNEL_ANSWER\nUnique-ID: 1234\n")
+	select {
+	case uuid := <-rcv:
+		if uuid != "1234" {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "1234", uuid)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for CHANNEL_ANSWER")
+	}
+}
+
+func TestFSockAddEventHandlerSubscribeFail(t *testing.T) {
+	m := newFSMock(t)
+	var refuse int32 = 1
+	m.cmdReply = func(cmd string) string {
+		if cmd == "event plain CHANNEL_ANSWER" && atomic.LoadInt32(&refuse) == 1 {
+			return "-ERR refused"
+		}
+		return "+OK"
+	}
+	fs := newMockedFSock(t, m, nil)
+	rcv := make(chan string, 1)
+	handler := func(ev string, _ int) { rcv <- headerVal(ev, "Unique-ID") }
+	if err := fs.AddEventHandler("CHANNEL_ANSWER", handler); err == nil {
+		t.Fatal("Expected the subscription to fail")
+	}
+	if events := fs.subscriptions(); len(events) != 0 {
+		t.Errorf("Expected no handler registered, received: %v", events)
+	}
+	atomic.StoreInt32(&refuse, 0)
+	if err := fs.AddEventHandler("CHANNEL_ANSWER", handler); err != nil { // subscribes again
+		t.Fatal(err)
+	}
+	if exp := []string{"auth ClueCon", "event plain", "event plain CHANNEL_ANSWER", "event plain CHANNEL_ANSWER"}; !reflect.DeepEqual(exp, m.commands(0)) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, m.commands(0))
+	}
+	m.sendEvent(0, "Event-Name: CHANNEL_ANSWER\nUnique-ID: 1234\n")
+	select {
+	case <-rcv:
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for CHANNEL_ANSWER")
+	}
+}
+
+func TestFSockAddEventHandlerN(t *testing.T) {
+	m := newFSMock(t)
+	fs := newMockedFSock(t, m, nil)
+	rcv := make(chan string, 3)
+	if err := fs.AddEventHandlerN("CHANNEL_ANSWER", 2, func(ev *FSEvent) { rcv <- ev.UUID() }); err != nil {
+		t.Fatal(err)
+	}
+	m.waitCommand(t, 0, "event plain CHANNEL_ANSWER")
+	for _, uuid := range []string{"1", "2", "3"} {
+		m.sendEvent(0, "Event-Name: CHANNEL_ANSWER\nUnique-ID: "+uuid+"\n")
+	}
+	received := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		select {
+		case uuid := <-rcv:
+			received[uuid] = true
+		case <-time.After(time.Second):
+			t.Fatal("Timeout waiting for CHANNEL_ANSWER")
+		}
+	}
+	if exp := map[string]bool{"1": true, "2": true}; !reflect.DeepEqual(exp, received) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, received)
+	}
+	m.waitCommand(t, 0, "nixevent CHANNEL_ANSWER")
+	select {
+	case uuid := <-rcv:
+		t.Errorf("Unexpected event once exhausted: %s", uuid)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if events := fs.subscriptions(); len(events) != 0 {
+		t.Errorf("Expected no subscriptions left, received: %v", events)
+	}
+	if err := fs.AddEventHandlerN("CHANNEL_ANSWER", 0, func(*FSEvent) {}); err == nil {
+		t.Error("Expected error for a non positive count")
+	}
+}
+
+func TestFSockUnsubscribeUnused(t *testing.T) {
+	m := newFSMock(t)
+	m.cmdReply = func(cmd string) string {
+		if cmd == "nixevent CHANNEL_HANGUP" {
+			return "-ERR refused"
+		}
+		return "+OK"
+	}
+	l := new(loggerMock)
+	fs := newMockedFSock(t, m, nil, WithLogger(l))
+	if err := fs.AddEventHandler("CHANNEL_ANSWER", func(string, int) {}); err != nil {
+		t.Fatal(err)
+	}
+	fs.unsubscribeUnused("CHANNEL_ANSWER") // decided before the handler above was added
+	fs.unsubscribeUnused("CHANNEL_HANGUP")
+	if exp := []string{"auth ClueCon", "event plain", "event plain CHANNEL_ANSWER", "nixevent CHANNEL_HANGUP"}; !reflect.DeepEqual(exp, m.commands(0)) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, m.commands(0))
+	}
+	if exp := "<FSock> Cannot unsubscribe from the CHANNEL_HANGUP events: <-ERR refused>"; l.msgType != "warning" || l.msg != exp {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, l.msg)
+	}
+}
+
+func TestFSockAddCallStateHandler(t *testing.T) {
+	m := newFSMock(t)
+	fs := newMockedFSock(t, m, nil)
+	rcv := make(chan string, 10)
+	if err := fs.AddCallStateHandler([]string{"RINGING", "HANGUP"}, func(ev string, _ int) {
+		rcv <- headerVal(ev, "Channel-Call-State")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	m.waitCommand(t, 0, "event plain CHANNEL_CALLSTATE")
+	for _, state := range []string{"DOWN", "RINGING", "EARLY", "ACTIVE", "HANGUP"} {
+		m.sendEvent(0, "Event-Name: CHANNEL_CALLSTATE\nUnique-ID: 1234\nChannel-Call-State: "+state+"\n")
+	}
+	m.sendEvent(0, "Event-Name: CHANNEL_ANSWER\nUnique-ID: 1234\nChannel-Call-State: RINGING\n")
+	received := make(map[string]int)
+	for i := 0; i < 2; i++ {
+		select {
+		case state := <-rcv:
+			received[state]++
+		case <-time.After(time.Second):
+			t.Fatal("Timeout waiting for CHANNEL_CALLSTATE")
+		}
+	}
+	select {
+	case state := <-rcv:
+		t.Errorf("Unexpected call state delivered: %s", state)
+	case <-time.After(20 * time.Millisecond):
+	}
+	if exp := map[string]int{"RINGING": 1, "HANGUP": 1}; !reflect.DeepEqual(exp, received) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, received)
+	}
+}
+
+func TestFSockPoolBroadcastApiCmd(t *testing.T) {
+	m := newFSMock(t)
+	m.apiReply = func(cmd string) string {
+		if cmd == "status" {
+			return "UP 0 years, 0 days, 1 hour\n"
+		}
+		return "-ERR no reply\n"
+	}
+	pool := NewFSockPool(3, m.addr(), "ClueCon", 0, time.Second, 0, fibDuration, nil, nil, nil, 0, false)
+	defer pool.Close()
+	var fSocks []*FSock
+	for i := 0; i < 3; i++ {
+		fsk, err := pool.PopFSock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fSocks = append(fSocks, fsk)
+	}
+	pool.PushFSock(fSocks[0]) // mix idle with checked-out connections
+	rplys, err := pool.BroadcastApiCmd("status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rplys) != 3 {
+		t.Fatalf("Expected 3 replies, received: %+v", rplys)
+	}
+	for _, fsk := range fSocks {
+		if rply := rplys[fsk.ConnID()]; rply != "UP 0 years, 0 days, 1 hour\n" {
+			t.Errorf("Unexpected reply of %s: %q", fsk.ConnID(), rply)
+		}
+	}
+	if rplys, err = pool.BroadcastApiCmd("bad"); err == nil || len(rplys) != 0 {
+		t.Errorf("Expected only errors, received: %+v, %v", rplys, err)
+	}
+}
+
+func TestFSockPoolForEach(t *testing.T) {
+	m := newFSMock(t)
+	pool := NewFSockPool(3, m.addr(), "ClueCon", 0, time.Second, 0, fibDuration, nil, nil, nil, 0, false)
+	var fSocks []*FSock
+	for i := 0; i < 3; i++ {
+		fsk, err := pool.PopFSock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fsk.Disconnect()
+		fSocks = append(fSocks, fsk)
+	}
+	pool.PushFSock(fSocks[0]) // mix idle with checked-out connections
+	var mux sync.Mutex
+	visited := make(map[string]bool)
+	if err := pool.ForEach(func(fsk *FSock) error {
+		mux.Lock()
+		visited[fsk.ConnID()] = true
+		mux.Unlock()
+		_, err := fsk.SendApiCmd("reloadxml")
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(visited) != 3 {
+		t.Errorf("Expected all 3 connections visited, received: %+v", visited)
+	}
+	for i := range fSocks {
+		m.waitCommand(t, i, "api reloadxml")
+	}
+	expErr := fmt.Sprintf("<%s> test error", fSocks[1].ConnID())
+	if err := pool.ForEach(func(fsk *FSock) error {
+		if fsk == fSocks[1] {
+			return errors.New("test error")
+		}
+		return nil
+	}); err == nil || err.Error() != expErr {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", expErr, err)
+	}
+}
+
+func TestFSockDisconnectAndWait(t *testing.T) {
+	m := newFSMock(t)
+	fs := newMockedFSock(t, m, nil)
+	fs.fsMutex.RLock()
+	readEventsDone := fs.readEventsDone
+	fs.fsMutex.RUnlock()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := fs.DisconnectAndWait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-readEventsDone:
+	default:
+		t.Error("Read loop still running after DisconnectAndWait")
+	}
+	if fs.Connected() {
+		t.Error("Expected disconnected")
+	}
+}
+
+func TestFSockDisconnectAndWaitTimeout(t *testing.T) {
+	fs := &FSock{
+		fsMutex:        new(sync.RWMutex),
+		logger:         nopLogger{},
+		conn:           new(connMock3),
+		readEventsDone: make(chan struct{}), // read loop never exiting
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := fs.DisconnectAndWait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", context.DeadlineExceeded, err)
+	}
+}
+
+func TestFSockSetEventEncoding(t *testing.T) {
+	m := newFSMock(t)
+	rcv := make(chan string, 1)
+	fs := newMockedFSock(t, m, map[string][]func(string, int){
+		"HEARTBEAT": {func(ev string, _ int) { rcv <- ev }},
+	})
+	expErr := "Cannot subscribe with <json> encoding over a <plain> connection, use SetEventEncoding"
+	if _, err := fs.SendCmd("event json CHANNEL_ANSWER"); err == nil || err.Error() != expErr {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", expErr, err)
+	}
+	if err := fs.SetEventEncoding("xml"); err == nil || err.Error() != "Unsupported event encoding <xml>" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "Unsupported event encoding <xml>", err)
+	}
+	if err := fs.SetEventEncoding(EventEncodingJSON); err != nil {
+		t.Fatal(err)
+	}
+	m.waitCommand(t, 0, "event json HEARTBEAT")
+	expErr = "Cannot subscribe with <plain> encoding over a <json> connection, use SetEventEncoding"
+	if _, err := fs.SendCmd("event plain CHANNEL_ANSWER"); err == nil || err.Error() != expErr {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", expErr, err)
+	}
+	body := `{"Event-Name":"HEARTBEAT","Up-Time":"0 years, 0 days, 1 hour"}`
+	m.write(0, fmt.Sprintf("Content-Length: %d\nContent-Type: text/event-json\n\n%s", len(body), body))
+	select {
+	case ev := <-rcv:
+		evMap := EventToMap(ev)
+		if evMap["Event-Name"] != "HEARTBEAT" || evMap["Up-Time"] != "0 years, 0 days, 1 hour" {
+			t.Errorf("Unexpected event received: %q", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for HEARTBEAT")
+	}
+}
+
+// backoffMock counts the delays requested and the resets
+type backoffMock struct {
+	mux           sync.Mutex
+	nexts, resets int
+}
+
+func (b *backoffMock) Next() time.Duration {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.nexts++
+	return time.Millisecond
+}
+
+func (b *backoffMock) Reset() {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.resets++
+}
+
+func TestFSockWithBackoff(t *testing.T) {
+	m := newFSMock(t)
+	b := new(backoffMock)
+	fs := newMockedFSock(t, m, nil, WithBackoff(b))
+	m.dropConn(0)
+	for i := 0; i < 100 && fs.Connected(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := fs.ReconnectIfNeeded(); err != nil {
+		t.Fatal(err)
+	}
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if b.resets != 1 || b.nexts != 0 {
+		t.Errorf("Expected one reset and no delay, received: %+v resets, %+v delays", b.resets, b.nexts)
+	}
+}
+
+func TestFSockAddRawEventHandler(t *testing.T) {
+	m := newFSMock(t)
+	raw := make(chan string, 1)
+	plain := make(chan string, 1)
+	fs := newMockedFSock(t, m, map[string][]func(string, int){
+		"CHANNEL_ANSWER": {func(ev string, _ int) { plain <- ev }},
+	})
+	if err := fs.AddRawEventHandler("CHANNEL_ANSWER", func(frame string, _ int) { raw <- frame }); err != nil {
+		t.Fatal(err)
+	}
+	if exp, cmds := []string{"auth ClueCon", "event plain CHANNEL_ANSWER"}, m.commands(0); !reflect.DeepEqual(exp, cmds) {
+		t.Errorf("Expected no duplicated subscription, received: %q", cmds)
+	}
+	body := "Event-Name: CHANNEL_ANSWER\nCaller-Caller-ID-Name: John%20Doe\n"
+	m.sendEvent(0, body)
+	expFrame := fmt.Sprintf("Content-Length: %d\nContent-Type: text/event-plain\n\n%s", len(body), body)
+	for _, exp := range []struct {
+		ch  chan string
+		exp string
+	}{{raw, expFrame}, {plain, body}} {
+		select {
+		case rcv := <-exp.ch:
+			if rcv != exp.exp {
+				t.Errorf("\nExpected: %q, \nReceived: %q", exp.exp, rcv)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Timeout waiting for CHANNEL_ANSWER")
+		}
+	}
+}
+
+func TestFSockWithDialTimeout(t *testing.T) {
+	m := newFSMock(t)
+	_, err := NewFSock(m.addr(), m.passwd, 0, 0, fibDuration, nil, nil, nil, 0, false,
+		WithDialTimeout(time.Nanosecond))
+	if nerr, canCast := err.(net.Error); !canCast || !nerr.Timeout() {
+		t.Errorf("Expected dial timeout error, received: <%+v>", err)
+	}
+	fs, err := NewFSock(m.addr(), m.passwd, 0, 0, fibDuration, nil, nil, nil, 0, false,
+		WithDialTimeout(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.Disconnect()
+}
+
+func TestFSockOnLog(t *testing.T) {
+	m := newFSMock(t)
+	dispatched := make(chan string, 1)
+	fs := newMockedFSock(t, m, map[string][]func(string, int){
+		"ALL": {func(ev string, _ int) { dispatched <- ev }},
+	})
+	logs := make(chan *LogData, 1)
+	fs.OnLog(func(ld *LogData) { logs <- ld })
+	if err := fs.SubscribeLogs("debug"); err != nil {
+		t.Fatal(err)
+	}
+	m.waitCommand(t, 0, "log debug")
+	msg := "2023-01-23 10:23:28.979524 [DEBUG] switch_core_state_machine.c:710 (sofia/internal/1001@192.168.56.74) State DESTROY going to sleep\n"
+	m.write(0, fmt.Sprintf("Content-Type: log/data\nContent-Length: %d\nLog-Level: 7\nText-Channel: 3\n"+
+		"Log-File: switch_core_state_machine.c\nLog-Func: switch_core_session_destroy_state\nLog-Line: 710\n"+
+		"User-Data: 4c882cc4-cd02-11e6-8b82-395b501876f9\n\n%s", len(msg), msg))
+	exp := &LogData{
+		Level:       7,
+		TextChannel: "3",
+		File:        "switch_core_state_machine.c",
+		Func:        "switch_core_session_destroy_state",
+		Line:        710,
+		UserData:    "4c882cc4-cd02-11e6-8b82-395b501876f9",
+		Message:     msg,
+	}
+	select {
+	case ld := <-logs:
+		if !reflect.DeepEqual(exp, ld) {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, ld)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for log")
+	}
+	select {
+	case ev := <-dispatched:
+		t.Errorf("Log dispatched as event: %q", ev)
+	case <-time.After(20 * time.Millisecond):
+	}
+	m.dropConn(0)
+	for i := 0; i < 100 && fs.Connected(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := fs.ReconnectIfNeeded(); err != nil {
+		t.Fatal(err)
+	}
+	m.waitCommand(t, 1, "log debug")
+}
+
+func TestFSockPoolGetByKey(t *testing.T) {
+	m := newFSMock(t)
+	pool := NewFSockPool(3, m.addr(), "ClueCon", 0, time.Second, 0, fibDuration, nil, nil, nil, 0, false)
+	defer pool.ForEach(func(fsk *FSock) error { return fsk.Disconnect() })
+	key := "4c882cc4-cd02-11e6-8b82-395b501876f9"
+	fsk, err := pool.GetByKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if rcv, err := pool.GetByKey(key); err != nil {
+			t.Fatal(err)
+		} else if rcv != fsk {
+			t.Errorf("Expected the same connection for key <%s>", key)
+		}
+	}
+	m.dropConn(0)
+	for i := 0; i < 100 && fsk.Connected(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	fresh, err := pool.GetByKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fresh == fsk || !fresh.Connected() {
+		t.Error("Expected a fresh connection replacing the dead one")
+	}
+	if rcv, err := pool.GetByKey(key); err != nil {
+		t.Fatal(err)
+	} else if rcv != fresh {
+		t.Error("Expected the fresh connection pinned to the key")
+	}
+}
+
+func TestFSockPoolGetByKeyConcurrent(t *testing.T) {
+	m := newFSMock(t)
+	pool := NewFSockPool(3, m.addr(), "ClueCon", 0, 300*time.Millisecond, 0, fibDuration, nil, nil, nil, 0, false)
+	defer pool.ForEach(func(fsk *FSock) error { return fsk.Disconnect() })
+	slot := func(key string) uint32 {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		return h.Sum32() % 3
+	}
+	pinned, waiting := "pinned", "waiting"
+	for i := 0; slot(waiting) == slot(pinned); i++ {
+		waiting = "waiting" + strconv.Itoa(i)
+	}
+	fsk, err := pool.GetByKey(pinned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ { // the whole pool checked-out
+		if _, err = pool.PopFSock(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	errs := make(chan error, 1)
+	go func() {
+		_, err := pool.GetByKey(waiting) // waiting for a connection up to maxWaitConn
+		errs <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	start := time.Now()
+	if rcv, err := pool.GetByKey(pinned); err != nil {
+		t.Error(err)
+	} else if rcv != fsk {
+		t.Errorf("Expected the same connection for key <%s>", pinned)
+	}
+	if took := time.Since(start); took > 100*time.Millisecond {
+		t.Errorf("The pinned connection waited %v behind the other key", took)
+	}
+	if err := <-errs; err != ErrConnectionPoolTimeout {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrConnectionPoolTimeout, err)
+	}
+}
+
+func TestFSockPoolWithMaxPinnedConns(t *testing.T) {
+	m := newFSMock(t)
+	pool := NewFSockPool(3, m.addr(), "ClueCon", 0, 100*time.Millisecond, 0, fibDuration, nil, nil, nil, 0, false,
+		WithMaxPinnedConns(1))
+	defer pool.ForEach(func(fsk *FSock) error { return fsk.Disconnect() })
+	fsk, err := pool.GetByKey("4c882cc4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ { // sharing the single pinned connection
+		if rcv, err := pool.GetByKey("key" + strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		} else if rcv != fsk {
+			t.Error("Expected the keys sharing the pinned connection")
+		}
+	}
+	for i := 0; i < 2; i++ { // the rest of the pool left to Pop
+		if _, err = pool.PopFSock(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestFSockWithLifecycleEvents(t *testing.T) {
+	m := newFSMock(t)
+	rcv := make(chan string, 2)
+	lifecycle := func(ev string, _ int) { rcv <- headerVal(ev, "Event-Name") + " " + headerVal(ev, "Conn-ID") }
+	fs := newMockedFSock(t, m, map[string][]func(string, int){
+		EventFSockConnected:    {lifecycle},
+		EventFSockDisconnected: {lifecycle},
+	}, WithLifecycleEvents(), WithConnID("conn1"))
+	select {
+	case ev := <-rcv:
+		if exp := "fsock::connected conn1"; ev != exp {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for the connected event")
+	}
+	for _, cmd := range m.commands(0) {
+		if strings.Contains(cmd, "fsock::") {
+			t.Errorf("Synthetic event subscribed: %q", cmd)
+		}
+	}
+	fs.Disconnect()
+	select {
+	case ev := <-rcv:
+		if exp := "fsock::disconnected conn1"; ev != exp {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for the disconnected event")
+	}
+}
+
+func TestFSockCurrentBackoff(t *testing.T) {
+	m := newFSMock(t)
+	fs := newMockedFSock(t, m, nil, WithBackoff(NewFibBackoff(time.Millisecond, 0)))
+	if d := fs.CurrentBackoff(); d != time.Millisecond {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", time.Millisecond, d)
+	}
+	fs.fspaswd = "wrong" // make the reconnects fail
+	m.dropConn(0)
+	for i := 0; i < 100 && fs.Connected(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	var rcv []time.Duration
+	for i := 0; i < 4; i++ {
+		if err := fs.ReconnectIfNeeded(); err == nil {
+			t.Fatal("Expected reconnect failure")
+		}
+		fs.disconnect() // the failed auth leaves the socket open
+		rcv = append(rcv, fs.CurrentBackoff())
+	}
+	if exp := []time.Duration{time.Millisecond, 2 * time.Millisecond, 3 * time.Millisecond, 5 * time.Millisecond}; !reflect.DeepEqual(exp, rcv) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, rcv)
+	}
+	fs.fspaswd = m.passwd
+	if err := fs.ReconnectIfNeeded(); err != nil {
+		t.Fatal(err)
+	}
+	if d := fs.CurrentBackoff(); d != time.Millisecond {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", time.Millisecond, d)
+	}
+}
+
+func TestFSockCurrentBackoffDelayFunc(t *testing.T) {
+	m := newFSMock(t)
+	fs := newMockedFSock(t, m, nil)
+	fs.delayFunc = func(time.Duration, time.Duration) func() time.Duration {
+		return NewFibBackoff(time.Millisecond, 0).Next
+	}
+	fs.fspaswd = "wrong"
+	m.dropConn(0)
+	for i := 0; i < 100 && fs.Connected(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	fs.reconnects = 3
+	if err := fs.ReconnectIfNeeded(); err == nil {
+		t.Fatal("Expected reconnect failure")
+	}
+	if d := fs.CurrentBackoff(); d != 3*time.Millisecond { // after waiting 1, 1 and 2
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 3*time.Millisecond, d)
+	}
+	fs.disconnect() // the failed auth leaves the socket open
+	if err := fs.ReconnectIfNeeded(); err == nil {
+		t.Fatal("Expected reconnect failure")
+	}
+	if d := fs.CurrentBackoff(); d != 13*time.Millisecond { // the delays going on across the calls
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 13*time.Millisecond, d)
+	}
+	fs.fspaswd = m.passwd
+	fs.disconnect()
+	if err := fs.ReconnectIfNeeded(); err != nil {
+		t.Fatal(err)
+	}
+	if d := fs.CurrentBackoff(); d != time.Millisecond {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", time.Millisecond, d)
+	}
+	if d := (&FSock{fsMutex: new(sync.RWMutex)}).CurrentBackoff(); d != time.Second { // FibBackoff without delayFunc
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", time.Second, d)
+	}
+}
+
+func TestFSockInterleavedEventsAndReplies(t *testing.T) {
+	m := newFSMock(t)
+	m.apiReply = func(cmd string) string {
+		if strings.HasPrefix(cmd, "status") {
+			for i := 0; i < 3; i++ { // events received between the command and its reply
+				m.sendEvent(0, fmt.Sprintf("Event-Name: CHANNEL_STATE\nUnique-ID: %d\n\n+OK api/response", i))
+			}
+		}
+		return "+OK " + cmd + "\n"
+	}
+	events := make(chan string, 3)
+	fs := newMockedFSock(t, m, map[string][]func(string, int){
+		"CHANNEL_STATE": {func(ev string, _ int) { events <- headerVal(ev, "Unique-ID") }},
+	})
+	if rply, err := fs.SendApiCmd("status"); err != nil {
+		t.Fatal(err)
+	} else if exp := "+OK status\n"; rply != exp {
+		t.Errorf("\nExpected: %q, \nReceived: %q", exp, rply)
+	}
+	received := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		select {
+		case uuid := <-events:
+			received[uuid] = true
+		case <-time.After(time.Second):
+			t.Fatal("Timeout waiting for CHANNEL_STATE")
+		}
+	}
+	if exp := map[string]bool{"0": true, "1": true, "2": true}; !reflect.DeepEqual(exp, received) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, received)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ { // concurrent commands receive their own replies
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cmd := fmt.Sprintf("uptime %d", i)
+			if rply, err := fs.SendApiCmd(cmd); err != nil {
+				t.Error(err)
+			} else if rply != "+OK "+cmd+"\n" {
+				t.Errorf("\nExpected: %q, \nReceived: %q", "+OK "+cmd+"\n", rply)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestFSockNextEvent(t *testing.T) {
+	m := newFSMock(t)
+	handled := make(chan string, 3)
+	fs := newMockedFSock(t, m, map[string][]func(string, int){
+		"CHANNEL_STATE": {func(ev string, _ int) { handled <- ev }},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := fs.NextEvent(ctx); err != context.DeadlineExceeded {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", context.DeadlineExceeded, err)
+	}
+	for i := 0; i < 3; i++ {
+		m.sendEvent(0, fmt.Sprintf("Event-Name: CHANNEL_STATE\nUnique-ID: %d\n", i))
+	}
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		ev, err := fs.NextEvent(ctx)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ev.UUID() != strconv.Itoa(i) {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", i, ev.UUID())
+		}
+	}
+	for i := 0; i < 3; i++ { // the handlers are not starved
+		select {
+		case <-handled:
+		case <-time.After(time.Second):
+			t.Fatal("Timeout waiting for the handlers")
+		}
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err := fs.NextEvent(ctx); err != context.Canceled {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", context.Canceled, err)
+	}
+	fs.StopNextEvents()
+	for i := 0; i < nextEventsQueue+1; i++ { // not queued anymore, the queue never filling
+		fs.dispatchEvent("Event-Name: HEARTBEAT\n", "")
+	}
+	if rcv := fs.Stats().DroppedEvents; rcv != 0 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 0, rcv)
+	}
+}
+
+// clockMock advances its time only when sleeping
+type clockMock struct {
+	mux sync.Mutex
+	now time.Time
+}
+
+func (c *clockMock) Now() time.Time {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.now
+}
+
+func (c *clockMock) Sleep(d time.Duration) {
+	c.mux.Lock()
+	c.now = c.now.Add(d)
+	c.mux.Unlock()
+}
+
+func TestFSockWithReconnectBudget(t *testing.T) {
+	m := newFSMock(t)
+	fs := newMockedFSock(t, m, nil, WithReconnectBudget(10*time.Second),
+		WithClock(&clockMock{now: time.Now()}), WithBackoff(NewFibBackoff(time.Second, 0)))
+	var failedErr error
+	fs.OnReconnectFailed(func(err error) { failedErr = err })
+	fs.reconnects = -1
+	fs.fspaswd = "wrong" // never recovering
+	m.dropConn(0)
+	for i := 0; i < 100 && fs.Connected(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	err := fs.ReconnectIfNeeded()
+	if err == nil {
+		t.Fatal("Expected reconnect failure")
+	}
+	if failedErr != err {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", err, failedErr)
+	}
+	m.mu.Lock()
+	attempts := len(m.conns) - 1
+	m.mu.Unlock()
+	if attempts != 5 { // after the delays of 1s, 1s, 2s, 3s and 5s
+		t.Errorf("Expected 5 attempts within the budget, received: %d", attempts)
+	}
+}
+
+func TestFSockLastCommandOK(t *testing.T) {
+	m := newFSMock(t)
+	m.apiReply = func(cmd string) string {
+		if cmd == "bad" {
+			return "-ERR bad command\n"
+		}
+		return "+OK\n"
+	}
+	fs := newMockedFSock(t, m, nil)
+	if !fs.LastCommandOK() {
+		t.Error("Expected OK before any command")
+	}
+	if _, err := fs.SendApiCmd("status"); err != nil {
+		t.Fatal(err)
+	}
+	if !fs.LastCommandOK() {
+		t.Error("Expected OK after a successful command")
+	}
+	if _, err := fs.SendApiCmd("bad"); err == nil {
+		t.Fatal("Expected -ERR reply")
+	}
+	if fs.LastCommandOK() {
+		t.Error("Expected not OK after a failed command")
+	}
+	if _, err := fs.SendApiCmd("status"); err != nil {
+		t.Fatal(err)
+	}
+	if !fs.LastCommandOK() {
+		t.Error("Expected OK after a successful command")
+	}
+}
+
+func TestFSockDisconnectDuringReconnect(t *testing.T) {
+	m := newFSMock(t)
+	fs := newMockedFSock(t, m, nil, WithBackoff(NewFibBackoff(time.Millisecond, 0)))
+	fs.reconnects = -1
+	fs.fspaswd = "wrong" // keep the reconnect loop running
+	failed := make(chan error, 1)
+	fs.OnReconnectFailed(func(err error) { failed <- err })
+	m.dropConn(0)
+	for i := 0; i < 100 && fs.Connected(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	done := make(chan error, 1)
+	go func() { done <- fs.ReconnectIfNeeded() }()
+	for i := 0; i < 100 && len(m.commands(1)) == 0; i++ { // wait for the reconnect attempts
+		time.Sleep(time.Millisecond)
+	}
+	if err := fs.Disconnect(); err != nil {
+		t.Error(err)
+	}
+	select {
+	case err := <-done:
+		if err != ErrNotConnected {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrNotConnected, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Reconnect not aborted by Disconnect")
+	}
+	if fs.Connected() {
+		t.Error("Expected disconnected")
+	}
+	for i := 0; i < 100 && m.activeConns() != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := m.activeConns(); n != 0 {
+		t.Errorf("Expected no lingering connection, received: %d", n)
+	}
+	select {
+	case err := <-failed:
+		t.Errorf("Reconnect failure reported after Disconnect: %v", err)
+	default:
+	}
+	dials := m.connCount()
+	fs.fspaswd = m.passwd
+	if err := fs.ReconnectIfNeeded(); err != ErrNotConnected {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrNotConnected, err)
+	}
+	if _, err := fs.SendApiCmd("status"); err != ErrNotConnected {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrNotConnected, err)
+	}
+	if rcv := m.connCount(); rcv != dials {
+		t.Errorf("Expected no reconnect after Disconnect, received %d new connections", rcv-dials)
+	}
+	if err := fs.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if !fs.Connected() {
+		t.Error("Expected connected after Connect")
+	}
+}
+
+func TestFSockReAuth(t *testing.T) {
+	m := newFSMock(t)
+	m.altPasswd = "NewClueCon"
+	fs := newMockedFSock(t, m, nil)
+	if err := fs.ReAuth("wrong"); err == nil {
+		t.Error("Expected the wrong password rejected")
+	}
+	if fs.fspaswd != m.passwd {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", m.passwd, fs.fspaswd)
+	}
+	if err := fs.ReAuth(m.altPasswd); err != nil {
+		t.Fatal(err)
+	}
+	m.waitCommand(t, 0, "auth NewClueCon")
+	if fs.fspaswd != m.altPasswd {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", m.altPasswd, fs.fspaswd)
+	}
+	if !fs.Connected() || m.connCount() != 1 {
+		t.Errorf("Expected the connection kept, connected: %v, connections: %d", fs.Connected(), m.connCount())
+	}
+	if _, err := fs.SendApiCmd("status"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFSockSuspendReconnect(t *testing.T) {
+	m := newFSMock(t)
+	fs := newMockedFSock(t, m, nil)
+	readErr := make(chan error, 1)
+	go func() { readErr <- fs.ReadEvents() }()
+	fs.SuspendReconnect()
+	m.dropConn(0)
+	for i := 0; i < 100 && fs.Connected(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if fs.Connected() {
+		t.Fatal("Expected the disconnect observed")
+	}
+	if err := fs.ReconnectIfNeeded(); err != ErrNotConnected {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrNotConnected, err)
+	}
+	if _, err := fs.SendApiCmd("status"); err != ErrNotConnected {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrNotConnected, err)
+	}
+	select {
+	case err := <-readErr:
+		t.Fatalf("ReadEvents returned while suspended: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	if n := m.connCount(); n != 1 {
+		t.Errorf("Expected no reconnect attempt while suspended, received %d connections", n)
+	}
+	fs.ResumeReconnect() // ReadEvents reconnects
+	for i := 0; i < 100 && !fs.Connected(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !fs.Connected() || m.connCount() != 2 {
+		t.Errorf("Expected reconnected after resume, connected: %v, connections: %d", fs.Connected(), m.connCount())
+	}
+	if _, err := fs.SendApiCmd("status"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFSockSendEvent(t *testing.T) {
+	m := newFSMock(t)
+	m.cmdReply = func(cmd string) string {
+		if strings.Contains(cmd, "Event-Subclass: cgr::rejected") {
+			return "-ERR Invalid%20event"
+		}
+		return "+OK 7f4de4bc-17d7-11dd-b7a0-db4edd065621"
+	}
+	fs := newMockedFSock(t, m, nil)
+	exp := &SendEventResult{OK: true, ReplyText: "+OK 7f4de4bc-17d7-11dd-b7a0-db4edd065621"}
+	if res, err := fs.SendEvent("CUSTOM", map[string]string{"Event-Subclass": "cgr::test"}); err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(exp, res) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, res)
+	}
+	m.waitCommand(t, 0, "sendevent CUSTOM\nEvent-Subclass: cgr::test")
+	exp = &SendEventResult{ReplyText: "-ERR Invalid event"}
+	if res, err := fs.SendEvent("CUSTOM", map[string]string{"Event-Subclass": "cgr::rejected"}); err == nil {
+		t.Error("Expected the rejected event to error")
+	} else if !reflect.DeepEqual(exp, res) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, res)
+	}
+	if _, err := fs.SendEvent("CUSTOM", map[string]string{"profile": "internal"}); err == nil ||
+		err.Error() != "Need Event-Subclass for CUSTOM events" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "Need Event-Subclass for CUSTOM events", err)
+	}
+	if res, err := fs.SendEvent("NOTIFY", map[string]string{"profile": "internal"}); err != nil {
+		t.Error(err)
+	} else if !res.OK {
+		t.Errorf("Unexpected result: %+v", res)
+	}
+	m.waitCommand(t, 0, "sendevent NOTIFY\nEvent-Subclass: NOTIFY\nprofile: internal")
+}
+
+func TestFSockPoolWithSlotMetricsLabels(t *testing.T) {
+	m := newFSMock(t)
+	pool := NewFSockPool(2, m.addr(), "ClueCon", 0, time.Second, 0, fibDuration, nil, nil, nil, 0, false,
+		WithSlotMetricsLabels())
+	defer pool.Close()
+	var fSocks []*FSock
+	for i := 0; i < 2; i++ {
+		fsk, err := pool.PopFSock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fSocks = append(fSocks, fsk)
+	}
+	labels := map[string]string{} // by ConnID
+	for _, st := range pool.ConnectionStates() {
+		labels[st.ConnID] = st.MetricsLabel
+	}
+	if exp := map[string]string{fSocks[0].ConnID(): "slot-0", fSocks[1].ConnID(): "slot-1"}; !reflect.DeepEqual(exp, labels) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, labels)
+	}
+	deadID := fSocks[0].ConnID()
+	fSocks[0].Disconnect()
+	pool.PushFSock(fSocks[0]) // dead, removed from the pool
+	fsk, err := pool.PopFSock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fsk.ConnID() == deadID || fsk.ConnID() == fSocks[1].ConnID() { // the logs still tell the connections apart
+		t.Errorf("Expected a new ConnID, received: %s", fsk.ConnID())
+	}
+	if rcv := fsk.MetricsLabel(); rcv != "slot-0" { // reused
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "slot-0", rcv)
+	}
+	if plain := newMockedFSock(t, m, nil); plain.MetricsLabel() != plain.ConnID() {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", plain.ConnID(), plain.MetricsLabel())
+	}
+}
+
+func TestFSockPoolConnectionStates(t *testing.T) {
+	m := newFSMock(t)
+	pool := NewFSockPool(3, m.addr(), "ClueCon", 0, time.Second, 0, fibDuration, nil, nil, nil, 0, false)
+	var fSocks []*FSock
+	for i := 0; i < 3; i++ {
+		fsk, err := pool.PopFSock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fsk.Disconnect()
+		fSocks = append(fSocks, fsk)
+	}
+	pool.PushFSock(fSocks[0]) // mix idle with checked-out connections
+	fSocks[2].setLastError(io.ErrUnexpectedEOF)
+	states := pool.ConnectionStates()
+	if len(states) != 3 {
+		t.Fatalf("Expected 3 states, received: %+v", states)
+	}
+	byID := make(map[string]ConnState)
+	for i, st := range states {
+		if i != 0 && states[i-1].ConnID > st.ConnID {
+			t.Errorf("Expected the states sorted by ConnID, received: %+v", states)
+		}
+		if !st.Connected || st.Uptime <= 0 || st.PendingCommands != 0 {
+			t.Errorf("Unexpected state: %+v", st)
+		}
+		byID[st.ConnID] = st
+	}
+	for i, exp := range []bool{true, false, false} {
+		if rcv := byID[fSocks[i].ConnID()].Idle; rcv != exp {
+			t.Errorf("Connection %d, expected idle: %v, received: %v", i, exp, rcv)
+		}
+	}
+	if rcv := byID[fSocks[2].ConnID()].LastError; rcv != io.ErrUnexpectedEOF {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", io.ErrUnexpectedEOF, rcv)
+	}
+	if fsk, err := pool.PopFSock(); err != nil {
+		t.Fatal(err)
+	} else if fsk != fSocks[0] {
+		t.Fatal("Expected the idle connection popped")
+	}
+	for _, st := range pool.ConnectionStates() {
+		if st.Idle {
+			t.Errorf("Expected all the connections checked-out, received: %+v", st)
+		}
+	}
+	var wg sync.WaitGroup // concurrent Pop/Push with the snapshots
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(fsk *FSock) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				pool.PushFSock(fsk)
+				if popped, err := pool.PopFSock(); err == nil {
+					fsk = popped
+				}
+			}
+		}(fSocks[i])
+		go pool.ConnectionStates()
+	}
+	wg.Wait()
+}
+
+func TestFSockPoolResize(t *testing.T) {
+	m := newFSMock(t)
+	pool := NewFSockPool(4, m.addr(), "ClueCon", 0, 50*time.Millisecond, 0, fibDuration, nil, nil, nil, 0, false)
+	defer pool.Close()
+	var fSocks []*FSock
+	for i := 0; i < 4; i++ {
+		fsk, err := pool.PopFSock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fSocks = append(fSocks, fsk)
+	}
+	pool.PushFSock(fSocks[0])
+	pool.PushFSock(fSocks[1])
+	if err := pool.Resize(1); err != nil { // closes both idle, retires one checked-out
+		t.Fatal(err)
+	}
+	for _, fsk := range fSocks[:2] {
+		if fsk.Connected() {
+			t.Error("Expected the idle connection closed")
+		}
+	}
+	pool.PushFSock(fSocks[2])
+	if fSocks[2].Connected() {
+		t.Error("Expected the pushed connection retired")
+	}
+	pool.PushFSock(fSocks[3])
+	if fsk, err := pool.PopFSock(); err != nil {
+		t.Fatal(err)
+	} else if fsk != fSocks[3] {
+		t.Error("Expected the remaining connection popped")
+	}
+	if _, err := pool.PopFSock(); err != ErrConnectionPoolTimeout {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrConnectionPoolTimeout, err)
+	}
+	if err := pool.Resize(2); err != nil {
+		t.Fatal(err)
+	}
+	if fsk, err := pool.PopFSock(); err != nil {
+		t.Fatal(err)
+	} else if !fsk.Connected() {
+		t.Error("Expected a new connection once grown")
+	}
+	if err := pool.Resize(5); err == nil || err.Error() != "Invalid pool size 5, expecting 0 to 4" {
+		t.Errorf("Unexpected error: <%v>", err)
+	}
+}
+
+func TestFSockPoolResizeConcurrentPop(t *testing.T) {
+	m := newFSMock(t)
+	pool := NewFSockPool(8, m.addr(), "ClueCon", 0, 10*time.Millisecond, 0, fibDuration, nil, nil, nil, 0, false)
+	defer pool.Close()
+	var wg sync.WaitGroup
+	var closedPopped int32
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				fsk, err := pool.PopFSock()
+				if err != nil {
+					continue
+				}
+				if !fsk.Connected() {
+					atomic.AddInt32(&closedPopped, 1)
+				}
+				pool.PushFSock(fsk)
+			}
+		}()
+	}
+	for _, n := range []int{6, 3, 5, 1} {
+		if err := pool.Resize(n); err != nil {
+			t.Error(err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&closedPopped); n != 0 {
+		t.Errorf("Expected no closed connection popped, received: %d", n)
+	}
+	if states := pool.ConnectionStates(); len(states) > 1 {
+		t.Errorf("Expected at most 1 connection left, received: %d", len(states))
+	}
+}
+
+func TestFSockPoolCreateRetries(t *testing.T) {
+	m := newFSMock(t)
+	m.mu.Lock() // serve is already accepting
+	m.rejects = 2
+	m.mu.Unlock()
+	pool := NewFSockPool(1, m.addr(), "ClueCon", 0, time.Second, 0, fibDuration, nil, nil, nil, 0, false,
+		WithCreateRetries(3, time.Millisecond))
+	fsk, err := pool.PopFSock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fsk.Disconnect()
+	if n := m.connCount(); n != 3 {
+		t.Errorf("Expected 3 connection attempts, received: %d", n)
+	}
+	if _, err := fsk.SendApiCmd("status"); err != nil {
+		t.Error(err)
+	}
+
+	m = newFSMock(t)
+	m.mu.Lock()
+	m.rejects = 2
+	m.mu.Unlock()
+	pool = NewFSockPool(1, m.addr(), "ClueCon", 0, time.Second, 0, fibDuration, nil, nil, nil, 0, false,
+		WithCreateRetries(2, time.Millisecond))
+	if _, err := pool.PopFSock(); err == nil || !strings.HasPrefix(err.Error(), "Cannot create pool connection after 2 attempts") {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if len(pool.allowedConns) != 1 {
+		t.Fatal("Expected the capacity kept after the failed creation")
+	}
+	if fsk, err = pool.PopFSock(); err != nil { // FreeSWITCH back
+		t.Fatal(err)
+	}
+	defer fsk.Disconnect()
+	if !fsk.Connected() {
+		t.Error("Expected a usable connection")
+	}
+}
+
+func TestFSockSetEventHandlers(t *testing.T) {
+	m := newFSMock(t)
+	oldRcv, newRcv := make(chan string, 2), make(chan string, 2)
+	fs := newMockedFSock(t, m, map[string][]func(string, int){
+		"CHANNEL_ANSWER": {func(ev string, _ int) { oldRcv <- headerVal(ev, "Event-Name") }},
+		"HEARTBEAT":      {func(ev string, _ int) { oldRcv <- headerVal(ev, "Event-Name") }},
+	})
+	newHandler := func(ev string, _ int) { newRcv <- headerVal(ev, "Event-Name") }
+	if err := fs.SetEventHandlers(map[string][]func(string, int){
+		"CHANNEL_HANGUP":         {newHandler},
+		"CUSTOM sofia::register": {newHandler},
+		"HEARTBEAT":              {newHandler},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	m.waitCommand(t, 0, "event plain CHANNEL_HANGUP CUSTOM sofia::register")
+	m.waitCommand(t, 0, "nixevent CHANNEL_ANSWER")
+	for _, cmd := range m.commands(0)[2:] {
+		if strings.Contains(cmd, "HEARTBEAT") {
+			t.Errorf("Unexpected delta for the event kept: %q", cmd)
+		}
+	}
+	m.sendEvent(0, "Event-Name: CHANNEL_ANSWER\n")
+	m.sendEvent(0, "Event-Name: HEARTBEAT\n")
+	m.sendEvent(0, "Event-Name: CHANNEL_HANGUP\n")
+	var rcv []string
+	for len(rcv) < 2 {
+		select {
+		case ev := <-newRcv:
+			rcv = append(rcv, ev)
+		case ev := <-oldRcv:
+			t.Fatalf("Old handler fired for %s", ev)
+		case <-time.After(time.Second):
+			t.Fatalf("Timeout waiting for the new handlers, received: %v", rcv)
+		}
+	}
+	sort.Strings(rcv)
+	if exp := []string{"CHANNEL_HANGUP", "HEARTBEAT"}; !reflect.DeepEqual(exp, rcv) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, rcv)
+	}
+	select {
+	case ev := <-oldRcv:
+		t.Errorf("Old handler fired for %s", ev)
+	case <-time.After(20 * time.Millisecond):
+	}
+	if err := fs.SetEventHandlers(map[string][]func(string, int){"ALL": {newHandler}}); err != nil {
+		t.Fatal(err)
+	}
+	m.waitCommand(t, 0, "event plain all")
+	if err := fs.SetEventHandlers(map[string][]func(string, int){"HEARTBEAT": {newHandler}}); err != nil {
+		t.Fatal(err)
+	}
+	m.waitCommand(t, 0, "noevents")
+	m.waitCommand(t, 0, "event plain HEARTBEAT")
+}
+
+func TestFSockSetEventEncodingRejected(t *testing.T) {
+	m := newFSMock(t)
+	rejectReply := "-ERR Unsupported format"
+	m.cmdReply = func(cmd string) string {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if strings.HasPrefix(cmd, "event json") {
+			return rejectReply
+		}
+		return "+OK"
+	}
+	fs := newMockedFSock(t, m, map[string][]func(string, int){
+		"HEARTBEAT": {func(string, int) {}},
+	})
+	if err := fs.SetEventEncoding(EventEncodingJSON); err == nil || err.Error() != "-ERR Unsupported format" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "-ERR Unsupported format", err)
+	}
+	if enc := fs.encoding(); enc != EventEncodingPlain {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", EventEncodingPlain, enc)
+	}
+	m.mu.Lock()
+	rejectReply = "Unknown command"
+	m.mu.Unlock()
+	expErr := "Unexpected event json reply received: <Unknown command>"
+	if err := fs.SetEventEncoding(EventEncodingJSON); err == nil || err.Error() != expErr {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", expErr, err)
+	}
+	if enc := fs.encoding(); enc != EventEncodingPlain {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", EventEncodingPlain, enc)
+	}
+	if err := fs.AddEventHandler("CHANNEL_ANSWER", func(string, int) {}); err != nil {
+		t.Error(err)
+	}
+	m.waitCommand(t, 0, "event plain CHANNEL_ANSWER")
+}
+
+func TestFSockWaitForAll(t *testing.T) {
+	m := newFSMock(t)
+	fs := newMockedFSock(t, m, map[string][]func(string, int){
+		"CHANNEL_ANSWER": {func(string, int) {}},
+	})
+	answered := func(uuid string) func(*FSEvent) bool {
+		return func(ev *FSEvent) bool { return ev.Name() == "CHANNEL_ANSWER" && ev.UUID() == uuid }
+	}
+	type result struct {
+		evs []*FSEvent
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		evs, err := fs.WaitForAll(context.Background(), answered("aleg"), answered("bleg"))
+		done <- result{evs, err}
+	}()
+	waitEventWaiters(t, fs, 1)
+	m.sendEvent(0, "Event-Name: CHANNEL_ANSWER\nUnique-ID: bleg\n")
+	select {
+	case <-done:
+		t.Fatal("Unblocked before both legs answered")
+	case <-time.After(20 * time.Millisecond):
+	}
+	m.sendEvent(0, "Event-Name: CHANNEL_ANSWER\nUnique-ID: aleg\n")
+	select {
+	case res := <-done:
+		if res.err != nil {
+			t.Fatal(res.err)
+		}
+		if len(res.evs) != 2 || res.evs[0].UUID() != "aleg" || res.evs[1].UUID() != "bleg" {
+			t.Errorf("Expected the events in the order of the matchers, received: %+v", res.evs)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for both legs")
+	}
+
+	anyAnswer := func(ev *FSEvent) bool { return ev.Name() == "CHANNEL_ANSWER" }
+	go func() {
+		evs, err := fs.WaitForAll(context.Background(), anyAnswer, anyAnswer)
+		done <- result{evs, err}
+	}()
+	waitEventWaiters(t, fs, 1)
+	m.sendEvent(0, "Event-Name: CHANNEL_ANSWER\nUnique-ID: first\n")
+	select {
+	case <-done:
+		t.Fatal("One event satisfied both matchers")
+	case <-time.After(20 * time.Millisecond):
+	}
+	m.sendEvent(0, "Event-Name: CHANNEL_ANSWER\nUnique-ID: second\n")
+	select {
+	case res := <-done:
+		if res.err != nil || len(res.evs) != 2 || res.evs[0].UUID() != "first" || res.evs[1].UUID() != "second" {
+			t.Errorf("Unexpected result: %+v, %v", res.evs, res.err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for the two answers")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := fs.WaitForAll(ctx, answered("cleg")); err != context.DeadlineExceeded {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", context.DeadlineExceeded, err)
+	}
+	waitEventWaiters(t, fs, 0)
+}
+
+// waitEventWaiters waits for the FSock to have n event waiters registered
+func waitEventWaiters(t *testing.T, fs *FSock, n int) {
+	t.Helper()
+	var rcv int
+	for i := 0; i < 100; i++ {
+		fs.fsMutex.RLock()
+		rcv = len(fs.eventWaiters)
+		fs.fsMutex.RUnlock()
+		if rcv == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("Expected %d event waiters, received: %d", n, rcv)
+}
+
+func benchmarkSendApiCmd(b *testing.B, opts ...FSockOption) {
+	m := newFSMock(b)
+	fs := newMockedFSock(b, m, nil, opts...)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := fs.SendApiCmd("status"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSendApiCmd(b *testing.B) {
+	benchmarkSendApiCmd(b)
+}
+
+func BenchmarkSendApiCmdNoCmdMutex(b *testing.B) {
+	benchmarkSendApiCmd(b, WithoutCmdMutex())
+}
+
+func TestFSockWithoutCmdMutex(t *testing.T) {
+	m := newFSMock(t)
+	m.apiReply = func(cmd string) string { return cmd + "\n" }
+	fs := newMockedFSock(t, m, nil, WithoutCmdMutex())
+	for _, cmd := range []string{"status", "version", "uptime"} {
+		if rply, err := fs.SendApiCmd(cmd); err != nil {
+			t.Error(err)
+		} else if rply != cmd+"\n" {
+			t.Errorf("\nExpected: %q, \nReceived: %q", cmd+"\n", rply)
+		}
+	}
+}
+
+func TestFSockSetReplyTimeout(t *testing.T) {
+	m := newFSMock(t)
+	m.apiReply = func(cmd string) string {
+		if cmd == "slow" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		return cmd + "\n"
+	}
+	fs := newMockedFSock(t, m, nil)
+	if rply, err := fs.SendApiCmd("slow"); err != nil { // no limit by default
+		t.Error(err)
+	} else if rply != "slow\n" {
+		t.Errorf("\nExpected: %q, \nReceived: %q", "slow\n", rply)
+	}
+	fs.SetReplyTimeout(20 * time.Millisecond)
+	if rcv := fs.ReplyTimeout(); rcv != 20*time.Millisecond {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 20*time.Millisecond, rcv)
+	}
+	if _, err := fs.SendApiCmd("slow"); err != ErrReplyTimeout {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrReplyTimeout, err)
+	}
+	fs.SetReplyTimeout(time.Second)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() { // changed concurrently with the commands
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			fs.SetReplyTimeout(time.Second + time.Duration(i)*time.Millisecond)
+		}
+	}()
+	for i := 0; i < 5; i++ { // the late reply is not received by the commands following
+		wg.Add(1)
+		go func(cmd string) {
+			defer wg.Done()
+			if rply, err := fs.SendApiCmd(cmd); err != nil {
+				t.Error(err)
+			} else if rply != cmd+"\n" {
+				t.Errorf("\nExpected: %q, \nReceived: %q", cmd+"\n", rply)
+			}
+		}("status " + strconv.Itoa(i))
+	}
+	wg.Wait()
+	if rply, err := fs.SendApiCmd("slow"); err != nil {
+		t.Error(err)
+	} else if rply != "slow\n" {
+		t.Errorf("\nExpected: %q, \nReceived: %q", "slow\n", rply)
+	}
+}
+
+// debugLogger captures the Debug messages
+type debugLogger struct {
+	nopLogger
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (l *debugLogger) Debug(msg string) error {
+	l.mu.Lock()
+	l.msgs = append(l.msgs, msg)
+	l.mu.Unlock()
+	return nil
+}
+
+func (l *debugLogger) messages() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.msgs...)
+}
+
+func TestFSockCommandTrace(t *testing.T) {
+	m := newFSMock(t)
+	m.apiReply = func(cmd string) string {
+		if cmd == "uuid_kill 00000000" {
+			return "-ERR No such channel!\n"
+		}
+		return "UP 0 years, 0 days\n"
+	}
+	l := new(debugLogger)
+	fs, err := NewFSock(m.addr(), m.passwd, 1, 0, fibDuration, nil, nil, l, 0, false,
+		WithConnID("conn1"), WithCommandTrace())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Disconnect()
+	if len(l.messages()) != 0 { // the connect is not traced
+		t.Errorf("Unexpected trace: %v", l.messages())
+	}
+	if _, err := fs.SendApiCmd("status"); err != nil {
+		t.Fatal(err)
+	}
+	fs.SendApiCmd("uuid_kill 00000000")
+	if err := fs.ReAuth("ClueCon"); err != nil {
+		t.Fatal(err)
+	}
+	msgs := l.messages()
+	if len(msgs) != 3 {
+		t.Fatalf("Expected 3 traces, received: %v", msgs)
+	}
+	for i, exp := range []commandTrace{
+		{ConnID: "conn1", Command: "api status", Reply: "UP 0 years, 0 days\n"},
+		{ConnID: "conn1", Command: "api uuid_kill 00000000", Error: "-ERR No such channel!"},
+		{ConnID: "conn1", Command: "auth <redacted>", Reply: "+OK accepted"},
+	} {
+		var rec commandTrace
+		if !strings.HasPrefix(msgs[i], "<FSock> Command trace: ") {
+			t.Errorf("Unexpected trace: %s", msgs[i])
+		} else if err := json.Unmarshal([]byte(strings.TrimPrefix(msgs[i], "<FSock> Command trace: ")), &rec); err != nil {
+			t.Fatal(err)
+		}
+		if lat, err := time.ParseDuration(rec.Latency); err != nil || lat <= 0 {
+			t.Errorf("Unexpected latency: <%s>, err: %v", rec.Latency, err)
+		}
+		rec.Latency = ""
+		if !reflect.DeepEqual(exp, rec) {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, rec)
+		}
+	}
+	if strings.Contains(strings.Join(msgs, "\n"), "ClueCon") {
+		t.Errorf("Expected the password redacted, received: %v", msgs)
+	}
+}
+
+func TestFSockCommandTraceContext(t *testing.T) {
+	m := newFSMock(t)
+	type traceKey struct{}
+	l := new(debugLogger)
+	fs, err := New(m.addr(), m.passwd, WithLogger(l), WithConnID("conn1"), WithCommandTrace(),
+		WithTraceExtractor(func(ctx context.Context) (string, string) {
+			if ids, has := ctx.Value(traceKey{}).([2]string); has {
+				return ids[0], ids[1]
+			}
+			return "", ""
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Disconnect()
+	ctx := context.WithValue(context.Background(), traceKey{}, [2]string{"4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"})
+	if _, err := fs.SendApiCmdContext(ctx, "status"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.SendApiCmd("status"); err != nil { // without trace
+		t.Fatal(err)
+	}
+	msgs := l.messages()
+	if len(msgs) != 2 {
+		t.Fatalf("Expected 2 traces, received: %v", msgs)
+	}
+	for i, exp := range []commandTrace{
+		{ConnID: "conn1", Command: "api status", Reply: "+OK\n",
+			TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", SpanID: "00f067aa0ba902b7"},
+		{ConnID: "conn1", Command: "api status", Reply: "+OK\n"},
+	} {
+		var rec commandTrace
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(msgs[i], "<FSock> Command trace: ")), &rec); err != nil {
+			t.Fatal(err)
+		}
+		rec.Latency = ""
+		if !reflect.DeepEqual(exp, rec) {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, rec)
+		}
+	}
+}
+
+func TestFSockRedactCommand(t *testing.T) {
+	for cmd, exp := range map[string]string{
+		"auth ClueCon":                     "auth <redacted>",
+		"userauth 1001@cgrates.org:secret": "userauth 1001@cgrates.org:<redacted>",
+		"api status":                       "api status",
+	} {
+		if rcv := redactCommand(cmd); rcv != exp {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, rcv)
+		}
+	}
+}
+
+func TestFSockPoolContextCancel(t *testing.T) {
+	m := newFSMock(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pool := NewFSockPoolContext(ctx, 2, m.addr(), "ClueCon", 0, 5*time.Second, 0, fibDuration, nil, nil, nil, 0, false)
+	var fSocks []*FSock
+	for i := 0; i < 2; i++ {
+		fsk, err := pool.PopFSock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fSocks = append(fSocks, fsk)
+	}
+	pool.PushFSock(fSocks[0]) // one idle, one checked-out
+	if _, err := pool.PopFSock(); err != nil {
+		t.Fatal(err)
+	}
+	popErr := make(chan error, 1)
+	go func() { // waiting for a connection to be pushed back
+		_, err := pool.PopFSock()
+		popErr <- err
+	}()
+	cancel()
+	select {
+	case err := <-popErr:
+		if err != ErrPoolClosed {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrPoolClosed, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for the Pop to be rejected")
+	}
+	for i := 0; i < 100 && m.activeConns() != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if rcv := m.activeConns(); rcv != 0 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 0, rcv)
+	}
+	for i, fsk := range fSocks {
+		if fsk.Connected() {
+			t.Errorf("Expected connection %d disconnected", i)
+		}
+	}
+	if _, err := pool.PopFSock(); err != ErrPoolClosed {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrPoolClosed, err)
+	}
+	if _, err := pool.GetByKey("4c882cc4"); err != ErrPoolClosed {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrPoolClosed, err)
+	}
+	pool.PushFSock(fSocks[1]) // pushed back after the close, not kept
+	if rcv := len(pool.ConnectionStates()); rcv != 0 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 0, rcv)
+	}
+	pool.Close() // already closed
+}
+
+func TestFSockUnknownFrame(t *testing.T) {
+	m := newFSMock(t)
+	frames := make(chan string, 1)
+	events := make(chan string, 1)
+	fs := newMockedFSock(t, m, map[string][]func(string, int){
+		"CHANNEL_ANSWER": {func(ev string, _ int) { events <- headerVal(ev, "Unique-ID") }},
+	}, WithUnknownFrameHandler(func(contentType, frame string) { frames <- contentType + "|" + frame }))
+	body := "Event-Name: CHANNEL_ANSWER\nUnique-ID: hidden\n\n" // looks like an event, must not be dispatched
+	m.write(0, fmt.Sprintf("Content-Type: text/event-future\nContent-Length: %d\n\n%s", len(body), body))
+	m.sendEvent(0, "Event-Name: CHANNEL_ANSWER\nUnique-ID: visible\n")
+	select {
+	case frame := <-frames:
+		exp := fmt.Sprintf("text/event-future|Content-Type: text/event-future\nContent-Length: %d\n\n%s", len(body), body)
+		if frame != exp {
+			t.Errorf("\nExpected: %q, \nReceived: %q", exp, frame)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for the unknown frame")
+	}
+	select {
+	case uuid := <-events: // the stream stayed aligned
+		if uuid != "visible" {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "visible", uuid)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for the event")
+	}
+	if _, err := fs.SendApiCmd("status"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFSockAddEventHandlerContext(t *testing.T) {
+	m := newFSMock(t)
+	fs := newMockedFSock(t, m, map[string][]func(string, int){
+		"CHANNEL_ANSWER": {func(string, int) {}},
+	}, WithSerialDispatch(), WithHandlerTimeout(50*time.Millisecond))
+	cancelled := make(chan error, 1)
+	if err := fs.AddEventHandlerContext("CHANNEL_PARK", func(ctx context.Context, _ string, _ int) {
+		<-ctx.Done() // stuck until cancelled
+		cancelled <- ctx.Err()
+	}); err != nil {
+		t.Fatal(err)
+	}
+	slow := make(chan string, 1)
+	if err := fs.AddEventHandler(EventFSockSlowHandler, func(ev string, _ int) { slow <- headerVal(ev, "Handler-Event") }); err != nil {
+		t.Fatal(err)
+	}
+	hungup := make(chan struct{}, 1)
+	if err := fs.AddEventHandlerContext("CHANNEL_HANGUP", func(ctx context.Context, _ string, _ int) {
+		if ctx.Err() == nil {
+			hungup <- struct{}{}
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	m.sendEvent(0, "Event-Name: CHANNEL_PARK\n")
+	m.sendEvent(0, "Event-Name: CHANNEL_HANGUP\n") // dispatched once the stuck handler is given up
+	select {
+	case err := <-cancelled:
+		if err != context.DeadlineExceeded {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", context.DeadlineExceeded, err)
+		} else if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+			t.Errorf("Cancelled before the timeout: <%s>", elapsed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for the cancellation")
+	}
+	select {
+	case evName := <-slow:
+		if evName != "CHANNEL_PARK" {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "CHANNEL_PARK", evName)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for the slow handler event")
+	}
+	select {
+	case <-hungup:
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for CHANNEL_HANGUP")
+	}
+}
+
+func TestFSockFragmentedAuth(t *testing.T) {
+	m := newFSMock(t)
+	m.mu.Lock()
+	m.trickle = true
+	m.mu.Unlock()
+	fs := newMockedFSock(t, m, nil)
+	if !fs.Connected() {
+		t.Fatal("Expected the auth completed")
+	}
+	if _, err := fs.SendApiCmd("status"); err != nil {
+		t.Error(err)
+	}
+	if exp, rcv := []string{"auth ClueCon", "event plain", "api status"}, m.commands(0); !reflect.DeepEqual(exp, rcv) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, rcv)
+	}
+}
+
+func TestFSockEventDuringAuth(t *testing.T) {
+	m := newFSMock(t)
+	event := "Event-Name: CHANNEL_ANSWER\nUnique-ID: early\n"
+	m.mu.Lock()
+	m.afterAuth = fmt.Sprintf("Content-Length: %d\nContent-Type: text/event-plain\n\n%s", len(event), event)
+	m.mu.Unlock()
+	answers := make(chan string, 1)
+	fs := newMockedFSock(t, m, map[string][]func(string, int){
+		"CHANNEL_ANSWER": {func(ev string, _ int) { answers <- headerVal(ev, "Unique-ID") }},
+	})
+	if !fs.Connected() {
+		t.Fatal("Expected the auth completed")
+	}
+	if exp, rcv := []string{"auth ClueCon", "event plain CHANNEL_ANSWER"}, m.commands(0); !reflect.DeepEqual(exp, rcv) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, rcv)
+	}
+	select {
+	case uuid := <-answers:
+		if uuid != "early" {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "early", uuid)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for the early event")
+	}
+	if rply, err := fs.SendApiCmd("status"); err != nil || rply != "+OK\n" { // the replies stayed aligned
+		t.Errorf("\nExpected: <%q, %+v>, \nReceived: <%q, %+v>", "+OK\n", nil, rply, err)
+	}
+}
+
+func TestFSockWithCommandAllowList(t *testing.T) {
+	m := newFSMock(t)
+	fs := newMockedFSock(t, m, nil, WithBgapi(true), WithCommandAllowList("status", "uuid_*", "sendmsg"))
+	if _, err := fs.SendApiCmd("status"); err != nil {
+		t.Error(err)
+	}
+	if _, err := fs.SendApiCmd("uuid_kill 4c882cc4"); err != nil {
+		t.Error(err)
+	}
+	if err := fs.SendMsgCmd("4c882cc4", map[string]string{"call-command": "hangup"}); err != nil {
+		t.Error(err)
+	}
+	sent := len(m.commands(0))
+	for _, send := range []func() error{
+		func() (err error) { _, err = fs.SendApiCmd("shutdown"); return },
+		func() (err error) { _, err = fs.SendApiCmd("api fsctl shutdown"); return },
+		func() (err error) { _, err = fs.SendBgapiCmd("originate user/1001 &park()"); return },
+		func() (err error) { _, err = fs.SendCmdWithArgs("exit", nil, ""); return },
+	} {
+		if err := send(); err != ErrCommandNotAllowed {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrCommandNotAllowed, err)
+		}
+	}
+	if rcv := len(m.commands(0)); rcv != sent { // never hit the socket
+		t.Errorf("Expected no command sent, received: %+v", m.commands(0)[sent:])
+	}
+	if !fs.Connected() {
+		t.Error("Expected the connection kept")
+	}
+}
+
+func TestFSockStrayReply(t *testing.T) {
+	m := newFSMock(t)
+	m.apiReply = func(cmd string) string { return "+OK " + strings.TrimPrefix(cmd, "api ") + "\n" }
+	answered := make(chan struct{}, 1)
+	fs := newMockedFSock(t, m, map[string][]func(string, int){
+		"CHANNEL_ANSWER": {func(string, int) { answered <- struct{}{} }},
+	})
+	if rply, err := fs.SendApiCmd("status"); err != nil {
+		t.Fatal(err)
+	} else if rply != "+OK status\n" {
+		t.Errorf("\nExpected: %q, \nReceived: %q", "+OK status\n", rply)
+	}
+	m.write(0, "Content-Type: command/reply\nReply-Text: +OK stray\n\n") // duplicated by a proxy
+	m.write(0, "Content-Type: api/response\nContent-Length: 10\n\n+OK stray\n")
+	m.sendEvent(0, "Event-Name: CHANNEL_ANSWER\n") // read after the stray replies
+	select {
+	case <-answered:
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for CHANNEL_ANSWER")
+	}
+	if rply, err := fs.SendApiCmd("version"); err != nil {
+		t.Fatal(err)
+	} else if rply != "+OK version\n" {
+		t.Errorf("\nExpected: %q, \nReceived: %q", "+OK version\n", rply)
+	}
+	frames := make(chan string, 1)
+	fs = newMockedFSock(t, m, nil, WithUnknownFrameHandler(func(contentType, frame string) { frames <- contentType }))
+	m.write(1, "Content-Type: command/reply\nReply-Text: +OK stray\n\n")
+	select {
+	case contentType := <-frames:
+		if contentType != "command/reply" {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "command/reply", contentType)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for the stray reply")
+	}
+	if rply, err := fs.SendApiCmd("status"); err != nil {
+		t.Fatal(err)
+	} else if rply != "+OK status\n" {
+		t.Errorf("\nExpected: %q, \nReceived: %q", "+OK status\n", rply)
+	}
+}
+
+func TestFSockOnConnect(t *testing.T) {
+	m := newFSMock(t)
+	m.apiReply = func(cmd string) string { return "+OK\n" }
+	var calls int32
+	var failNext int32
+	fs, err := NewFSock(m.addr(), m.passwd, 3, 0, func(time.Duration, time.Duration) func() time.Duration {
+		return func() time.Duration { return time.Millisecond }
+	}, nil, nil, nil, 0, false, WithOnConnect(func(fs *FSock) error {
+		atomic.AddInt32(&calls, 1)
+		if atomic.CompareAndSwapInt32(&failNext, 1, 0) {
+			return errors.New("setup failed")
+		}
+		_, err := fs.SendApiCmd("global_setvar cgr_conn=1") // commands work from within
+		return err
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Disconnect()
+	if rcv := atomic.LoadInt32(&calls); rcv != 1 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 1, rcv)
+	}
+	m.waitCommand(t, 0, "api global_setvar cgr_conn=1")
+	atomic.StoreInt32(&failNext, 1)
+	m.dropConn(0)
+	for i := 0; i < 100 && fs.Connected(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := fs.ReconnectIfNeeded(); err != nil { // the failed setup is retried on a new connection
+		t.Fatal(err)
+	}
+	if rcv := atomic.LoadInt32(&calls); rcv != 3 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 3, rcv)
+	}
+	if rcv := m.connCount(); rcv != 3 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 3, rcv)
+	}
+	m.waitCommand(t, 2, "api global_setvar cgr_conn=1")
+	if _, err := fs.SendApiCmd("status"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFSockWithRawConn(t *testing.T) {
+	m := newFSMock(t)
+	fs, err := NewFSock(m.addr(), m.passwd, 3, 0, func(time.Duration, time.Duration) func() time.Duration {
+		return func() time.Duration { return time.Millisecond }
+	}, nil, nil, nil, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Disconnect()
+	var calls int32
+	var failNext int32
+	if err = fs.WithRawConn(func(conn net.Conn) error {
+		atomic.AddInt32(&calls, 1)
+		if atomic.CompareAndSwapInt32(&failNext, 1, 0) {
+			return errors.New("tuning failed")
+		}
+		return conn.(*net.TCPConn).SetReadBuffer(1 << 16)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if rcv := atomic.LoadInt32(&calls); rcv != 1 { // on the current connection
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 1, rcv)
+	}
+	atomic.StoreInt32(&failNext, 1)
+	m.dropConn(0)
+	for i := 0; i < 100 && fs.Connected(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := fs.ReconnectIfNeeded(); err != nil { // the failed customization retried on a new connection
+		t.Fatal(err)
+	}
+	if rcv := atomic.LoadInt32(&calls); rcv != 3 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 3, rcv)
+	}
+	if _, err := fs.SendApiCmd("status"); err != nil {
+		t.Error(err)
+	}
+	if err := (*FSock)(nil).WithRawConn(nil); err != ErrNotConnected {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrNotConnected, err)
+	}
+}
+
+func TestFSockMaxEventBodySize(t *testing.T) {
+	m := newFSMock(t)
+	answers := make(chan string, 2)
+	fs := newMockedFSock(t, m, map[string][]func(string, int){
+		"CHANNEL_ANSWER": {func(ev string, _ int) { answers <- ev }},
+	}, WithMaxEventBodySize(256))
+	out, err := fs.SendBgapiCmd("show channels")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmds := m.commands(0)
+	jobUUID := headerVal(cmds[len(cmds)-1], "Job-UUID")
+	jobHdr := "Event-Name: BACKGROUND_JOB\nJob-UUID: " + jobUUID + "\nContent-Length: 1048576\n\n"
+	m.sendEvent(0, jobHdr+strings.Repeat("x", 1048576))
+	select {
+	case rcv := <-out:
+		if exp := strings.Repeat("x", 256-len(jobHdr)); rcv != exp {
+			t.Errorf("\nExpected: %d bytes, \nReceived: %d bytes", len(exp), len(rcv))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for the job result")
+	}
+	bigEv := "Event-Name: CHANNEL_ANSWER\nUnique-ID: big\nvariable_big: " + strings.Repeat("y", 1000) + "\n"
+	m.sendEvent(0, bigEv)
+	m.sendEvent(0, "Event-Name: CHANNEL_ANSWER\nUnique-ID: small\n") // the stream stayed aligned
+	truncated := make(map[string]string)                             // dispatched concurrently
+	for i := 0; i < 2; i++ {
+		select {
+		case ev := <-answers:
+			truncated[headerVal(ev, "Unique-ID")] = headerVal(ev, EventTruncatedHeader)
+		case <-time.After(time.Second):
+			t.Fatal("Timeout waiting for the events")
+		}
+	}
+	if exp := map[string]string{"big": strconv.Itoa(len(bigEv)), "small": ""}; !reflect.DeepEqual(exp, truncated) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, truncated)
+	}
+	job, err := fs.SendBgapiJob("show calls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmds = m.commands(0)
+	jobUUID = headerVal(cmds[len(cmds)-1], "Job-UUID")
+	jsonJob := `{"Event-Name":"BACKGROUND_JOB","Job-UUID":"` + jobUUID + `","_body":"` + strings.Repeat("z", 1000) + `"}`
+	m.write(0, fmt.Sprintf("Content-Length: %d\nContent-Type: text/event-json\n\n%s", len(jsonJob), jsonJob))
+	select {
+	case rcv := <-job: // only the _body cut, the json still decoding
+		if exp := (&BgapiResult{Body: strings.Repeat("z", 256), TruncatedSize: len(jsonJob)}); !reflect.DeepEqual(exp, rcv) {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, rcv)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for the json job result")
+	}
+	if rcv := fs.Stats().TruncatedEvents; rcv != 3 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 3, rcv)
+	}
+}
+
+func TestFSockHalfClose(t *testing.T) {
+	m := newFSMock(t)
+	unblock := make(chan struct{})
+	defer close(unblock)
+	m.apiReply = func(cmd string) string {
+		if cmd == "slow" {
+			<-unblock // never replied on the half-closed connection
+		}
+		return "+OK\n"
+	}
+	fs := newMockedFSock(t, m, nil)
+	errs := make(chan error, 1)
+	go func() {
+		_, err := fs.SendApiCmd("slow")
+		errs <- err
+	}()
+	m.waitCommand(t, 0, "api slow")
+	m.mu.Lock()
+	m.conns[0].(*net.TCPConn).CloseWrite() // FIN, FreeSWITCH still reading
+	m.mu.Unlock()
+	select {
+	case err := <-errs:
+		if err != ErrDisconnected {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrDisconnected, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The pending command hangs after the read EOF")
+	}
+	if fs.Connected() {
+		t.Error("Expected the connection unusable after the read EOF")
+	}
+	go func() { // over a new connection
+		_, err := fs.SendApiCmd("status")
+		errs <- err
+	}()
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The command hangs after the read EOF")
+	}
+	if rcv := m.connCount(); rcv != 2 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 2, rcv)
+	}
+}
+
+func TestFSockSerialDispatchOrder(t *testing.T) {
+	m := newFSMock(t)
+	var running int32
+	var mu sync.Mutex
+	var rcv []string
+	record := func(handler string) func(string, int) {
+		return func(ev string, _ int) {
+			if atomic.AddInt32(&running, 1) != 1 {
+				t.Error("Handlers running concurrently")
+			}
+			if handler == "first" && headerVal(ev, "Event-Sequence") == "1" {
+				time.Sleep(20 * time.Millisecond) // a slow handler does not let the later events overtake
+			}
+			mu.Lock()
+			rcv = append(rcv, handler+":"+headerVal(ev, "Event-Sequence"))
+			mu.Unlock()
+			atomic.AddInt32(&running, -1)
+		}
+	}
+	newMockedFSock(t, m, map[string][]func(string, int){
+		"CHANNEL_ANSWER": {record("first"), record("second")},
+		"CHANNEL_HANGUP": {record("hangup")},
+	}, WithSerialDispatch(), WithParseWorkers(4))
+	var exp []string
+	for i := 1; i <= 100; i++ {
+		seq := strconv.Itoa(i)
+		if i%10 == 0 {
+			m.sendEvent(0, "Event-Name: CHANNEL_HANGUP\nEvent-Sequence: "+seq+"\n")
+			exp = append(exp, "hangup:"+seq)
+			continue
+		}
+		m.sendEvent(0, "Event-Name: CHANNEL_ANSWER\nEvent-Sequence: "+seq+"\n")
+		exp = append(exp, "first:"+seq, "second:"+seq)
+	}
+	for i := 0; i < 200; i++ {
+		mu.Lock()
+		n := len(rcv)
+		mu.Unlock()
+		if n == len(exp) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(exp, rcv) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, rcv)
+	}
+}
+
+func TestFSockSerialDispatchHandlerDisconnected(t *testing.T) {
+	m := newFSMock(t)
+	unblock := make(chan struct{})
+	defer close(unblock)
+	m.apiReply = func(cmd string) string {
+		if cmd == "slow" {
+			<-unblock // never replied before the connection drops
+		}
+		return "+OK\n"
+	}
+	var fs *FSock
+	errs := make(chan error, 1)
+	fs = newMockedFSock(t, m, map[string][]func(string, int){
+		"CHANNEL_ANSWER": {func(string, int) {
+			_, err := fs.SendApiCmd("slow")
+			errs <- err
+		}},
+	}, WithSerialDispatch())
+	m.sendEvent(0, "Event-Name: CHANNEL_ANSWER\n")
+	m.waitCommand(t, 0, "api slow")
+	m.dropConn(0)
+	select {
+	case err := <-errs:
+		if err != ErrDisconnected {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrDisconnected, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The command of the handler hangs after the connection drops")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := fs.DisconnectAndWait(ctx); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFSockSerialDispatchHandlerCommand(t *testing.T) {
+	m := newFSMock(t)
+	var fs *FSock
+	proceed := make(chan struct{})
+	errs := make(chan error, 1)
+	fs = newMockedFSock(t, m, map[string][]func(string, int){
+		"CHANNEL_ANSWER": {func(ev string, _ int) {
+			if headerVal(ev, "Event-Sequence") != "1" {
+				return
+			}
+			<-proceed
+			_, err := fs.SendApiCmd("status") // the reply follows the events blocking the reads
+			errs <- err
+		}},
+	}, WithSerialDispatch(), WithEventSpool(2, 0, SpoolBlock, nil))
+	for i := 1; i <= 6; i++ {
+		m.sendEvent(0, "Event-Name: CHANNEL_ANSWER\nEvent-Sequence: "+strconv.Itoa(i)+"\n")
+	}
+	time.Sleep(50 * time.Millisecond) // the spool full, the reads blocked
+	close(proceed)
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The command of the handler hangs behind the full spool")
+	}
+}
+
+func TestFSockSerialDispatchLifecycle(t *testing.T) {
+	m := newFSMock(t)
+	var running int32
+	var mu sync.Mutex
+	var rcv []string
+	record := func(ev string, _ int) {
+		if atomic.AddInt32(&running, 1) != 1 {
+			t.Error("Handlers running concurrently")
+		}
+		name := headerVal(ev, "Event-Name")
+		if name == "CHANNEL_ANSWER" {
+			time.Sleep(50 * time.Millisecond) // still running once disconnected
+		}
+		mu.Lock()
+		rcv = append(rcv, name)
+		mu.Unlock()
+		atomic.AddInt32(&running, -1)
+	}
+	newMockedFSock(t, m, map[string][]func(string, int){
+		"CHANNEL_ANSWER":       {record},
+		EventFSockDisconnected: {record},
+	}, WithSerialDispatch(), WithLifecycleEvents())
+	m.sendEvent(0, "Event-Name: CHANNEL_ANSWER\n")
+	time.Sleep(10 * time.Millisecond)
+	m.dropConn(0)
+	exp := []string{"CHANNEL_ANSWER", EventFSockDisconnected}
+	for i := 0; i < 100; i++ {
+		mu.Lock()
+		n := len(rcv)
+		mu.Unlock()
+		if n >= len(exp) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(exp, rcv) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, rcv)
+	}
+}
+
+func TestFSockSerialDispatchWithEventSpool(t *testing.T) {
+	for _, opts := range [][]FSockOption{
+		{WithSerialDispatch(), WithEventSpool(5, 0, SpoolDropOldest, nil)},
+		{WithEventSpool(5, 0, SpoolDropOldest, nil), WithSerialDispatch()},
+	} {
+		fs := &FSock{fsMutex: new(sync.RWMutex)}
+		for _, opt := range opts {
+			opt(fs)
+		}
+		pl := fs.newEventPipeline()
+		if pl.spool.capacity != 5 || pl.spool.policy != SpoolDropOldest {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "5 SpoolDropOldest", strconv.Itoa(pl.spool.capacity)+" "+strconv.Itoa(int(pl.spool.policy)))
+		}
+		pl.stop()
+	}
+	fs := &FSock{fsMutex: new(sync.RWMutex)}
+	WithSerialDispatch()(fs)
+	pl := fs.newEventPipeline()
+	if pl.spool.capacity != serialDispatchQueue || pl.spool.policy != SpoolBlock {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", serialDispatchQueue, pl.spool.capacity)
+	}
+	pl.stop()
+}
+
+func TestFSockSendWhileDisconnecting(t *testing.T) {
+	m := newFSMock(t)
+	fs := newMockedFSock(t, m, nil)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if rply, err := fs.SendApiCmd("status"); err == nil {
+					if rply != "+OK\n" {
+						t.Errorf("\nExpected: %q, \nReceived: %q", "+OK\n", rply)
+					}
+				} else if err != ErrDisconnected && err != ErrNotConnected {
+					t.Errorf("Unexpected error: <%+v>", err)
+				}
+			}
+		}()
+	}
+	for i := 0; i < 50; i++ {
+		time.Sleep(time.Millisecond)
+		fs.Disconnect()
+		time.Sleep(time.Millisecond)
+		if err := fs.Connect(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestFSockNilLogger(t *testing.T) {
+	m := newFSMock(t)
+	for _, l := range []logger{nil, (*debugLogger)(nil)} {
+		fs, err := NewFSock(m.addr(), m.passwd, 1, 0, fibDuration, map[string][]func(string, int){
+			"CHANNEL_ANSWER": {func(string, int) {}},
+		}, nil, l, 0, false, WithCommandTrace())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = fs.SendApiCmd("api status"); err != nil { // the debug logs of the trace and the redundant verb
+			t.Error(err)
+		}
+		m.sendEvent(m.connCount()-1, "Event-Name: HEARTBEAT\n") // logged without dispatcher
+		if err = fs.Disconnect(); err != nil {
+			t.Error(err)
+		}
+		pool := NewFSockPool(1, m.addr(), m.passwd, 0, time.Second, 0, fibDuration, nil, nil, l, 0, false)
+		if _, isNop := pool.logger.(nopLogger); !isNop {
+			t.Errorf("\nExpected: <%T>, \nReceived: <%T>", nopLogger{}, pool.logger)
+		}
+		srv, err := NewOutboundServer("127.0.0.1:0", func(*FSock, map[string]string) {}, nil, l, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, isNop := srv.logger.(nopLogger); !isNop {
+			t.Errorf("\nExpected: <%T>, \nReceived: <%T>", nopLogger{}, srv.logger)
+		}
+		srv.Close()
+	}
+}
+
+func TestFSockNew(t *testing.T) {
+	m := newFSMock(t)
+	rcv := make(chan int, 1)
+	fs, err := New(m.addr(), m.passwd,
+		WithReconnects(2),
+		WithMaxReconnectInterval(time.Minute),
+		WithDelayFunc(func(time.Duration, time.Duration) func() time.Duration {
+			return func() time.Duration { return time.Millisecond }
+		}),
+		WithHandlers(map[string][]func(string, int){
+			"CHANNEL_ANSWER": {func(_ string, connIdx int) { rcv <- connIdx }},
+		}),
+		WithFilters(map[string][]string{"Call-Direction": {"inbound"}}),
+		WithLogger(nil),
+		WithConnIdx(3),
+		WithBgapi(true),
+		WithReplyTimeout(time.Second),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Disconnect()
+	cmds := m.commands(0)
+	sort.Strings(cmds) // the filters are sent in the map order
+	if exp := []string{"auth ClueCon", "event plain CHANNEL_ANSWER BACKGROUND_JOB", "filter Call-Direction inbound",
+		"filter Event-Name BACKGROUND_JOB"}; !reflect.DeepEqual(exp, cmds) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, cmds)
+	}
+	if fs.reconnects != 2 || fs.maxReconnectInterval != time.Minute || fs.ReplyTimeout() != time.Second {
+		t.Errorf("Options not applied: <%d>, <%s>, <%s>", fs.reconnects, fs.maxReconnectInterval, fs.ReplyTimeout())
+	}
+	if _, isNop := fs.logger.(nopLogger); !isNop {
+		t.Errorf("\nExpected: <%T>, \nReceived: <%T>", nopLogger{}, fs.logger)
+	}
+	m.sendEvent(0, "Event-Name: CHANNEL_ANSWER\n")
+	select {
+	case connIdx := <-rcv:
+		if connIdx != 3 {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 3, connIdx)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("event not dispatched")
+	}
+	m.dropConn(0) // reconnected with the delayFunc of the options
+	for i := 0; i < 100 && fs.Connected(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := fs.SendApiCmd("status"); err != nil {
+		t.Error(err)
+	}
+	if rcv := m.connCount(); rcv != 2 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 2, rcv)
+	}
+}
+
+func TestFSockNewDeprecated(t *testing.T) {
+	m := newFSMock(t)
+	evHandlers := map[string][]func(string, int){"HEARTBEAT": {func(string, int) {}}}
+	fs, err := NewFSock(m.addr(), m.passwd, 5, time.Minute, fibDuration, evHandlers, nil, nil, 7, true,
+		WithReconnects(1)) // the options override the positional parameters
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Disconnect()
+	if fs.reconnects != 1 || fs.maxReconnectInterval != time.Minute || fs.connIdx != 7 || !fs.bgapiSup {
+		t.Errorf("Parameters not applied: <%d>, <%s>, <%d>, <%t>", fs.reconnects, fs.maxReconnectInterval, fs.connIdx, fs.bgapiSup)
+	}
+	if exp, cmds := []string{"auth ClueCon", "event plain HEARTBEAT BACKGROUND_JOB"}, m.commands(0); !reflect.DeepEqual(exp, cmds) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, cmds)
+	}
+}
+
+func TestFSockWithTLS(t *testing.T) {
+	m, cfg := newTLSFSMock(t)
+	m.apiReply = func(string) string { return "+OK secured\n" }
+	fs, err := New(m.addr(), m.passwd, WithTLS(cfg), WithReconnects(1), WithDialTimeout(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Disconnect()
+	if rply, err := fs.SendApiCmd("status"); err != nil {
+		t.Fatal(err)
+	} else if rply != "+OK secured\n" {
+		t.Errorf("\nExpected: %q, \nReceived: %q", "+OK secured\n", rply)
+	}
+	var rawConn net.Conn
+	if err := fs.WithRawConn(func(conn net.Conn) error { // the socket under TLS
+		rawConn = conn
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	} else if _, isTCP := rawConn.(*net.TCPConn); !isTCP {
+		t.Errorf("\nExpected: <%T>, \nReceived: <%T>", new(net.TCPConn), rawConn)
+	}
+	if _, err := New(m.addr(), m.passwd, WithTLS(&tls.Config{}), WithDialTimeout(time.Second)); err == nil { // untrusted certificate
+		t.Error("Expected the TLS handshake to fail")
+	}
+}
+
+func TestFSockWithEventCharset(t *testing.T) {
+	latin1 := "Event-Name: MESSAGE\nCaller-Caller-ID-Name: Jos\xe9\nContent-Length: 10\n\nCa\xe7a va\xa0\x80!"
+	for _, tc := range []struct {
+		charset string
+		exp     string
+	}{
+		{"", latin1}, // passthrough by default
+		{"UTF-8", latin1},
+		{"latin1", "Event-Name: MESSAGE\nCaller-Caller-ID-Name: José\nContent-Length: 10\n\nCaça va\u00a0\u0080!"},
+		{"windows-1252", "Event-Name: MESSAGE\nCaller-Caller-ID-Name: José\nContent-Length: 10\n\nCaça va\u00a0€!"},
+	} {
+		m := newFSMock(t)
+		rcv := make(chan string, 1)
+		newMockedFSock(t, m, map[string][]func(string, int){
+			"MESSAGE": {func(ev string, _ int) { rcv <- ev }},
+		}, WithEventCharset(tc.charset))
+		m.sendEvent(0, latin1)
+		select {
+		case ev := <-rcv:
+			if ev != tc.exp {
+				t.Errorf("%q: \nExpected: %q, \nReceived: %q", tc.charset, tc.exp, ev)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%q: Timeout waiting for MESSAGE", tc.charset)
+		}
+	}
+}
+
+func TestFSockWithEventCharsetUnsupported(t *testing.T) {
+	m := newFSMock(t)
+	expErr := "Unsupported event charset: <latin-x>"
+	if fs, err := New(m.addr(), m.passwd, WithEventCharset("latin-x")); err == nil || err.Error() != expErr {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", expErr, err)
+	} else if fs != nil {
+		t.Errorf("Expected no FSock, received: %+v", fs)
+	}
+	if cmds := m.commands(0); len(cmds) != 0 {
+		t.Errorf("Expected no connection, received the commands: %q", cmds)
+	}
+}
+
+func TestFSockWithURLDecode(t *testing.T) {
+	m := newFSMock(t)
+	fs := newMockedFSock(t, m, nil, WithURLDecode(false))
+	decoded := newMockedFSock(t, newFSMock(t), nil)
+	rcv := make(chan *FSEvent, 1)
+	if err := fs.AddEventHandlerN("CUSTOM conference::maintenance", 1, func(ev *FSEvent) { rcv <- ev }); err != nil {
+		t.Fatal(err)
+	}
+	m.sendEvent(0, "Event-Name: CUSTOM\nEvent-Subclass: conference%3A%3Amaintenance\nCaller-Caller-ID-Name: John%20Doe\n")
+	select {
+	case ev := <-rcv: // routed on the decoded subclass
+		if exp := "John%20Doe"; ev.Header("Caller-Caller-ID-Name") != exp {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, ev.Header("Caller-Caller-ID-Name"))
+		} else if exp := "conference%3A%3Amaintenance"; ev.Header("Event-Subclass") != exp {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, ev.Header("Event-Subclass"))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for CUSTOM conference::maintenance")
+	}
+	if fs.Config().URLDecode || !decoded.Config().URLDecode {
+		t.Error("Expected the url-decoding disabled only on the first FSock")
+	}
+	if ev := decoded.eventMap("Caller-Caller-ID-Name: John%20Doe\n"); ev["Caller-Caller-ID-Name"] != "John Doe" { // per FSock
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "John Doe", ev["Caller-Caller-ID-Name"])
+	}
+}
+
+func TestFSockTransportInfo(t *testing.T) {
+	m, cfg := newTLSFSMock(t)
+	cfg = cfg.Clone()
+	cfg.MinVersion, cfg.MaxVersion = tls.VersionTLS12, tls.VersionTLS12
+	cfg.CipherSuites = []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}
+	fs, err := New(m.addr(), m.passwd, WithTLS(cfg), WithReconnects(1), WithDialTimeout(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := &TransportInfo{Network: "tcp", TLS: true, TLSVersion: "TLS 1.2",
+		CipherSuite: "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}
+	if rcv := fs.TransportInfo(); !reflect.DeepEqual(exp, rcv) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, rcv)
+	}
+	fs.Disconnect()
+	if rcv := fs.TransportInfo(); rcv != nil {
+		t.Errorf("\nExpected: <nil>, \nReceived: <%+v>", rcv)
+	}
+	plain := newMockedFSock(t, newFSMock(t), nil)
+	if exp, rcv := (&TransportInfo{Network: "tcp"}), plain.TransportInfo(); !reflect.DeepEqual(exp, rcv) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, rcv)
+	}
+}
+
+func TestFSockBatchedPlainEvents(t *testing.T) {
+	m := newFSMock(t)
+	rcv := make(chan map[string]string, 3)
+	fs := newMockedFSock(t, m, map[string][]func(string, int){
+		"CHANNEL_ANSWER": {func(event string, _ int) { rcv <- EventToMap(event) }},
+		"CUSTOM":         {func(event string, _ int) { rcv <- EventToMap(event) }},
+	}, WithSerialDispatch())
+	m.sendEvent(0, "Event-Name: CHANNEL_ANSWER\nUnique-ID: 1\n\n"+
+		"Event-Name: CUSTOM\nUnique-ID: 2\nContent-Length: 20\n\nline1\n\nEvent-Name: x\n\n"+
+		"Event-Name: CHANNEL_ANSWER\nUnique-ID: 3\n\n")
+	for _, exp := range []string{"1", "2", "3"} {
+		select {
+		case ev := <-rcv:
+			if ev["Unique-ID"] != exp {
+				t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, ev["Unique-ID"])
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("event %s not dispatched", exp)
+		}
+	}
+	select {
+	case ev := <-rcv:
+		t.Errorf("Unexpected event: <%+v>", ev)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, err := fs.SendApiCmd("status"); err != nil { // the stream stays aligned
+		t.Error(err)
+	}
+}
+
+func TestFSockOnParseError(t *testing.T) {
+	m := newFSMock(t)
+	rcv := make(chan string, 1)
+	fs := newMockedFSock(t, m, map[string][]func(string, int){
+		"HEARTBEAT": {func(event string, _ int) { rcv <- EventToMap(event)["Event-Name"] }},
+	})
+	type parseErr struct {
+		raw string
+		err error
+	}
+	errs := make(chan parseErr, 3)
+	fs.OnParseError(func(raw string, err error) { errs <- parseErr{raw, err} })
+	expectErr := func(raw, errPrefix string) {
+		t.Helper()
+		select {
+		case pe := <-errs:
+			if pe.raw != raw {
+				t.Errorf("\nExpected: %q, \nReceived: %q", raw, pe.raw)
+			}
+			if pe.err == nil || !strings.HasPrefix(pe.err.Error(), errPrefix) {
+				t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", errPrefix, pe.err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("parse error not reported for %q", raw)
+		}
+	}
+	body := "Event-Name: HEARTBEAT\n"
+	m.write(0, fmt.Sprintf("Content-Length: %d\nContent-Type: text/event-plain\ngarbage\n\n%s", len(body), body))
+	expectErr(fmt.Sprintf("Content-Length: %d\nContent-Type: text/event-plain\ngarbage\n", len(body)),
+		"Malformed frame headers: <garbage>")
+	select {
+	case ev := <-rcv: // processed, the frame still usable
+		if ev != "HEARTBEAT" {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "HEARTBEAT", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("event not dispatched")
+	}
+	m.write(0, "Content-Length: 5\nContent-Type: text/event-json\n\n{\"a\":")
+	expectErr("{\"a\":", "unexpected end of JSON input")
+	m.write(0, "Content-Length: -1\nContent-Type: text/event-plain\n\n")
+	expectErr("Content-Length: -1\nContent-Type: text/event-plain\n", "Cannot extract content length")
+}
+
+func TestFSockPoolGracefulClose(t *testing.T) {
+	m := newFSMock(t)
+	pool := NewFSockPool(3, m.addr(), m.passwd, 1, time.Second, 0, fibDuration, nil, nil, nil, 0, false,
+		WithGracefulClose(time.Second))
+	var fSocks []*FSock
+	for i := 0; i < 3; i++ {
+		fsk, err := pool.PopFSock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fSocks = append(fSocks, fsk)
+	}
+	pool.PushFSock(fSocks[0]) // idle, the others checked-out
+	pool.PushFSock(fSocks[1])
+	start := time.Now()
+	if err := pool.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Closed in <%s>", elapsed)
+	}
+	for i := 0; i < 3; i++ {
+		if cmds := m.commands(i); cmds[len(cmds)-1] != "exit" {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "exit", cmds)
+		}
+	}
+	for i := 0; i < 100 && m.activeConns() != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if rcv := m.activeConns(); rcv != 0 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 0, rcv)
+	}
+	for _, fsk := range fSocks {
+		if fsk.Connected() {
+			t.Error("Connection left open")
+		} else if err := fsk.LastError(); err != nil {
+			t.Errorf("Unexpected error: <%v>", err)
+		}
+	}
+
+	m.mu.Lock()
+	m.cmdReply = func(cmd string) string { // exit refused, the connections closed anyway
+		if cmd == "exit" {
+			return "-ERR denied"
+		}
+		return "+OK"
+	}
+	m.mu.Unlock()
+	pool = NewFSockPool(2, m.addr(), m.passwd, 1, time.Second, 0, fibDuration, nil, nil, nil, 0, false,
+		WithGracefulClose(time.Second))
+	for i := 0; i < 2; i++ {
+		if _, err := pool.PopFSock(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pool.Close(); err == nil || err.Error() != "Cannot close 2 connections: <-ERR denied>, <-ERR denied>" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "Cannot close 2 connections", err)
+	}
+	for i := 0; i < 100 && m.activeConns() != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if rcv := m.activeConns(); rcv != 0 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 0, rcv)
+	}
+	if err := pool.Close(); err != nil { // already closed
+		t.Error(err)
+	}
+}
+
+func TestFSockSnapshotSubscriptions(t *testing.T) {
+	m := newFSMock(t)
+	rcv := make(chan string, 1)
+	fs, err := New(m.addr(), m.passwd,
+		WithHandlers(map[string][]func(string, int){
+			"CHANNEL_ANSWER": {func(string, int) { rcv <- "CHANNEL_ANSWER" }},
+			"CHANNEL_HANGUP": {func(string, int) {}},
+		}),
+		WithFilters(map[string][]string{"Call-Direction": {"inbound"}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Disconnect()
+	snap := fs.SnapshotSubscriptions()
+	if exp, rcv := []string{"CHANNEL_ANSWER", "CHANNEL_HANGUP"}, snap.Events(); !reflect.DeepEqual(exp, rcv) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, rcv)
+	}
+	if exp, rcv := map[string][]string{"Call-Direction": {"inbound"}}, snap.Filters(); !reflect.DeepEqual(exp, rcv) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, rcv)
+	}
+	if err := fs.SetEventHandlers(map[string][]func(string, int){"HEARTBEAT": {func(string, int) {}}}); err != nil { // narrowed
+		t.Fatal(err)
+	}
+	sent := len(m.commands(0))
+	if err := fs.RestoreSubscriptions(snap); err != nil {
+		t.Fatal(err)
+	}
+	if exp, cmds := []string{"noevents", "filter delete all", "filter Call-Direction inbound",
+		"event plain CHANNEL_ANSWER CHANNEL_HANGUP"}, m.commands(0)[sent:]; !reflect.DeepEqual(exp, cmds) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, cmds)
+	}
+	m.sendEvent(0, "Event-Name: CHANNEL_ANSWER\n") // dispatched again to the restored handlers
+	select {
+	case ev := <-rcv:
+		if ev != "CHANNEL_ANSWER" {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "CHANNEL_ANSWER", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("event not dispatched")
+	}
+	if err := fs.RestoreSubscriptions(nil); err == nil {
+		t.Error("Expected error for the missing snapshot")
+	}
+	if snap := (*FSock)(nil).SnapshotSubscriptions(); snap != nil {
+		t.Errorf("Unexpected snapshot: <%+v>", snap)
+	}
+}
+
+func TestFSockWaitUntilConnected(t *testing.T) {
+	m := newFSMock(t)
+	fs, err := New(m.addr(), m.passwd, WithReconnects(3),
+		WithDelayFunc(func(time.Duration, time.Duration) func() time.Duration {
+			return func() time.Duration { return time.Millisecond }
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Disconnect()
+	if err := fs.WaitUntilConnected(context.Background()); err != nil { // already connected
+		t.Fatal(err)
+	}
+	m.dropConn(0)
+	for i := 0; i < 100 && fs.Connected(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := fs.WaitUntilConnected(ctx); err != context.DeadlineExceeded {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", context.DeadlineExceeded, err)
+	}
+	waited := make(chan error, 1)
+	go func() { waited <- fs.WaitUntilConnected(context.Background()) }()
+	select {
+	case err := <-waited:
+		t.Fatalf("Returned before the reconnect: <%v>", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	go fs.ReconnectIfNeeded()
+	select {
+	case err := <-waited:
+		if err != nil {
+			t.Error(err)
+		}
+		if !fs.Connected() {
+			t.Error("Not connected")
+		} else if cmds := m.commands(1); len(cmds) == 0 || cmds[0] != "auth ClueCon" {
+			t.Errorf("Unexpected commands: <%+v>", cmds)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("WaitUntilConnected not unblocked by the reconnect")
+	}
+	if err := (*FSock)(nil).WaitUntilConnected(context.Background()); err != ErrNotConnected {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrNotConnected, err)
+	}
+}
+
+func TestFSockWithBgJobMaxAge(t *testing.T) {
+	m := newFSMock(t)
+	fs := newMockedFSock(t, m, nil, WithBgJobMaxAge(50*time.Millisecond))
+	out, err := fs.SendBgapiCmd("originate user/1001 &park") // BACKGROUND_JOB never sent
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err := fs.SendBgapiJob("show calls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	select {
+	case rcv := <-job:
+		if rcv.Err != ErrBgJobTimeout {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrBgJobTimeout, rcv.Err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for the job to expire")
+	}
+	select {
+	case _, ok := <-out:
+		if ok {
+			t.Error("Expected the channel closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for the job to expire")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Expired after %s", elapsed)
+	}
+	fs.fsMutex.RLock()
+	pending := len(fs.backgroundChans) + len(fs.backgroundJobs)
+	fs.fsMutex.RUnlock()
+	if pending != 0 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 0, pending)
+	}
+}
+
+func TestFSockCollectEvents(t *testing.T) {
+	m := newFSMock(t)
+	handled := make(chan string, 4)
+	fs := newMockedFSock(t, m, map[string][]func(string, int){
+		"CHANNEL_STATE":  {func(ev string, _ int) { handled <- ev }},
+		"CHANNEL_ANSWER": {func(ev string, _ int) { handled <- ev }},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	collected := make(chan []*FSEvent, 1)
+	go func() {
+		evs, err := fs.CollectEvents(ctx, func(ev *FSEvent) bool { return ev.Name() == "CHANNEL_STATE" })
+		if err != nil {
+			t.Error(err)
+		}
+		collected <- evs
+	}()
+	for started := false; !started; time.Sleep(time.Millisecond) {
+		fs.fsMutex.RLock()
+		started = len(fs.eventCollectors) != 0
+		fs.fsMutex.RUnlock()
+	}
+	m.sendEvent(0, "Event-Name: CHANNEL_STATE\nUnique-ID: 1\n")
+	m.sendEvent(0, "Event-Name: CHANNEL_ANSWER\nUnique-ID: 2\n")
+	m.sendEvent(0, "Event-Name: CHANNEL_STATE\nUnique-ID: 3\n")
+	for i := 0; i < 3; i++ { // the handlers still receiving all of them
+		select {
+		case <-handled:
+		case <-time.After(time.Second):
+			t.Fatal("Timeout waiting for the handlers")
+		}
+	}
+	cancel()
+	var evs []*FSEvent
+	select {
+	case evs = <-collected:
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for the collected events")
+	}
+	var uuids []string
+	for _, ev := range evs {
+		uuids = append(uuids, ev.UUID())
+	}
+	if exp := []string{"1", "3"}; !reflect.DeepEqual(exp, uuids) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, uuids)
+	}
+	m.sendEvent(0, "Event-Name: CHANNEL_STATE\nUnique-ID: 4\n") // out of the window
+	select {
+	case <-handled:
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for the handlers")
+	}
+	if len(evs) != 2 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 2, len(evs))
+	}
+}
+
+func TestFSockCollectEventsFilterCallsFSock(t *testing.T) {
+	m := newFSMock(t)
+	fs := newMockedFSock(t, m, map[string][]func(string, int){
+		"CHANNEL_STATE": {func(string, int) {}},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	collected := make(chan []*FSEvent, 1)
+	filtered := make(chan struct{}, 1)
+	go func() {
+		evs, err := fs.CollectEvents(ctx, func(ev *FSEvent) bool {
+			defer func() { filtered <- struct{}{} }()
+			return fs.Connected() // takes the FSock lock
+		})
+		if err != nil {
+			t.Error(err)
+		}
+		collected <- evs
+	}()
+	for started := false; !started; time.Sleep(time.Millisecond) {
+		fs.fsMutex.RLock()
+		started = len(fs.eventCollectors) != 0
+		fs.fsMutex.RUnlock()
+	}
+	m.sendEvent(0, "Event-Name: CHANNEL_STATE\nUnique-ID: 1\n")
+	select {
+	case <-filtered:
+	case <-time.After(time.Second):
+		t.Fatal("The filter calling the FSock deadlocks the read loop")
+	}
+	cancel()
+	select {
+	case evs := <-collected:
+		if len(evs) != 1 || evs[0].UUID() != "1" {
+			t.Errorf("Unexpected events: %+v", evs)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for the collected events")
+	}
+}
+
+func TestFSockCancelGrace(t *testing.T) {
+	for _, deliverLate := range []bool{false, true} {
+		m := newFSMock(t)
+		release := make(chan struct{})
+		m.apiReply = func(cmd string) string {
+			if cmd == "slow" {
+				<-release
+			}
+			return "+OK " + cmd + "\n"
+		}
+		var opts []FSockOption
+		if deliverLate {
+			opts = append(opts, WithCancelGrace(time.Second, true))
+		}
+		fs := newMockedFSock(t, m, nil, opts...)
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			m.waitCommand(t, 0, "api slow")
+			cancel() // once written
+			time.Sleep(20 * time.Millisecond)
+			close(release) // the late reply, within the grace
+		}()
+		rply, err := fs.SendApiCmdContext(ctx, "slow")
+		if deliverLate {
+			if err != nil || rply != "+OK slow\n" {
+				t.Errorf("\nExpected: <%q, %+v>, \nReceived: <%q, %+v>", "+OK slow\n", nil, rply, err)
+			}
+		} else if err != context.Canceled {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", context.Canceled, err)
+		}
+		fs.replyMux.Lock()
+		stale := fs.staleReplies
+		fs.replyMux.Unlock()
+		if stale != 0 { // consumed within the grace
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 0, stale)
+		}
+		if rply, err := fs.SendApiCmd("status"); err != nil {
+			t.Fatal(err)
+		} else if exp := "+OK status\n"; rply != exp {
+			t.Errorf("\nExpected: %q, \nReceived: %q", exp, rply)
+		}
+	}
+}
+
+func TestFSockMatchFilters(t *testing.T) {
+	filters := map[string][]string{
+		"Event-Name":     {"CHANNEL_ANSWER", "CHANNEL_HANGUP"},
+		"Call-Direction": {"inbound"},
+	}
+	for _, tc := range []struct {
+		evMap    map[string]string
+		any, all bool
+	}{
+		{map[string]string{"Event-Name": "CHANNEL_ANSWER", "Call-Direction": "inbound"}, true, true},
+		{map[string]string{"Event-Name": "CHANNEL_HANGUP", "Call-Direction": "inbound"}, true, true},
+		{map[string]string{"Event-Name": "CHANNEL_HANGUP", "Call-Direction": "outbound"}, true, false},
+		{map[string]string{"Event-Name": "CHANNEL_STATE", "Call-Direction": "inbound"}, true, false},
+		{map[string]string{"Event-Name": "CHANNEL_ANSWER"}, true, false},
+		{map[string]string{"Event-Name": "CHANNEL_STATE", "Call-Direction": "outbound"}, false, false},
+	} {
+		if rcv := matchFilters(tc.evMap, filters, false); rcv != tc.any {
+			t.Errorf("ANY %+v \nExpected: <%+v>, \nReceived: <%+v>", tc.evMap, tc.any, rcv)
+		}
+		if rcv := matchFilters(tc.evMap, filters, true); rcv != tc.all {
+			t.Errorf("ALL %+v \nExpected: <%+v>, \nReceived: <%+v>", tc.evMap, tc.all, rcv)
+		}
+	}
+	if !matchFilters(map[string]string{"Event-Name": "HEARTBEAT"}, nil, true) {
+		t.Error("Expected the events matched without filters")
+	}
+}
+
+func TestFSockWithFilterMatchAll(t *testing.T) {
+	m := newFSMock(t)
+	filters := map[string][]string{
+		"Event-Name":     {"CHANNEL_ANSWER", "CHANNEL_HANGUP"},
+		"Call-Direction": {"inbound"},
+	}
+	received := make(chan string, 4)
+	handler := func(ev string, _ int) { received <- headerVal(ev, "Unique-ID") }
+	newMockedFSock(t, m, map[string][]func(string, int){
+		"CHANNEL_ANSWER": {handler},
+		"CHANNEL_HANGUP": {handler},
+	}, WithFilters(filters), WithFilterMatchAll(true), WithBgapi(true), WithSerialDispatch())
+	cmds := m.commands(0)
+	if exp := []string{"auth ClueCon", "filter Call-Direction inbound", "filter Event-Name BACKGROUND_JOB",
+		"filter Event-Name CHANNEL_ANSWER", "filter Event-Name CHANNEL_HANGUP"}; len(cmds) != 6 || !reflect.DeepEqual(exp, cmds[:5]) {
+		t.Fatalf("\nExpected: <%+v>, \nReceived: <%+v>", exp, cmds)
+	}
+	evNames := strings.Fields(strings.TrimPrefix(cmds[5], "event plain ")) // in the map order of the handlers
+	sort.Strings(evNames)
+	if exp := []string{"BACKGROUND_JOB", "CHANNEL_ANSWER", "CHANNEL_HANGUP"}; !reflect.DeepEqual(exp, evNames) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, cmds[5])
+	}
+	if exp := []string{"CHANNEL_ANSWER", "CHANNEL_HANGUP"}; !reflect.DeepEqual(exp, filters["Event-Name"]) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, filters["Event-Name"]) // left untouched
+	}
+	m.sendEvent(0, "Event-Name: CHANNEL_HANGUP\nUnique-ID: 1\nCall-Direction: outbound\n") // passed by FreeSWITCH
+	m.sendEvent(0, "Event-Name: CHANNEL_ANSWER\nUnique-ID: 2\nCall-Direction: inbound\n")
+	select {
+	case uuid := <-received:
+		if uuid != "2" {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "2", uuid)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for the event")
+	}
+}
+
+func TestFSockWaitBgJob(t *testing.T) {
+	m := newFSMock(t)
+	fs := newMockedFSock(t, m, nil, WithBgapi(true))
+	for _, body := range []string{"+OK 7f4db78a\n", "-ERR NO_ROUTE_DESTINATION\n"} {
+		jobUUID, err := fs.SubmitBgapiJob("originate user/1001 &park")
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.sendEvent(0, fmt.Sprintf("Event-Name: BACKGROUND_JOB\nJob-UUID: %s\nContent-Length: %d\n\n%s", jobUUID, len(body), body))
+		time.Sleep(10 * time.Millisecond) // completed before being awaited
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		res, err := fs.WaitBgJob(ctx, jobUUID)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exp := (&BgJobResult{JobUUID: jobUUID, Success: body[0] == '+', Body: body}); !reflect.DeepEqual(exp, res) {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, res)
+		}
+	}
+	jobUUID, err := fs.SubmitBgapiJob("originate user/1002 &park") // never completed
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err = fs.WaitBgJob(ctx, jobUUID); err != context.DeadlineExceeded {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", context.DeadlineExceeded, err)
+	}
+	fs.fsMutex.RLock()
+	pending := len(fs.backgroundJobs) + len(fs.submittedJobs)
+	fs.fsMutex.RUnlock()
+	if pending != 0 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 0, pending)
+	}
+	if _, err = fs.WaitBgJob(context.Background(), jobUUID); err == nil {
+		t.Error("Expected error for the forgotten job")
+	}
+}
+
+func TestFSockPoolSurplusPush(t *testing.T) {
+	m := newFSMock(t)
+	pool := NewFSockPool(1, m.addr(), "ClueCon", 0, 50*time.Millisecond, 0, fibDuration, nil, nil, nil, 0, false)
+	defer pool.Close()
+	fsk, err := pool.PopFSock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pool.PushFSock(fsk)
+		pool.PushFSock(fsk) // double push, queued once
+		foreign := newMockedFSock(t, m, nil)
+		pool.PushFSock(foreign) // beyond the capacity
+		if foreign.Connected() {
+			t.Error("Expected the surplus connection closed")
+		}
+		lost := newMockedFSock(t, m, nil)
+		lost.Disconnect()
+		pool.PushFSock(lost) // its slot released beyond the capacity
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("PushFSock blocked")
+	}
+	if !fsk.Connected() {
+		t.Error("Expected the pooled connection kept")
+	}
+	if rcv, err := pool.PopFSock(); err != nil || rcv != fsk {
+		t.Errorf("\nExpected: <%p, %+v>, \nReceived: <%p, %+v>", fsk, nil, rcv, err)
+	}
+	if _, err := pool.PopFSock(); err != ErrConnectionPoolTimeout { // handed out once, the pool size kept
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrConnectionPoolTimeout, err)
+	}
+	pool.PushFSock(fsk)
+	if rcv, err := pool.PopFSock(); err != nil || rcv != fsk { // still usable
+		t.Errorf("\nExpected: <%p, %+v>, \nReceived: <%p, %+v>", fsk, nil, rcv, err)
+	}
+}
+
+func TestFSockOnCommand(t *testing.T) {
+	m := newFSMock(t)
+	m.altPasswd = "NewClueCon"
+	m.apiReply = func(cmd string) string {
+		if cmd == "slow" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		return "+OK\n"
+	}
+	type outcome struct {
+		cmd, rply string
+		latency   time.Duration
+		err       error
+	}
+	outcomes := make(chan outcome, 3)
+	fs := newMockedFSock(t, m, nil, WithCancelGrace(0, false))
+	fs.OnCommand(func(cmd, rply string, latency time.Duration, err error) {
+		outcomes <- outcome{cmd, rply, latency, err}
+	})
+	next := func() (o outcome) {
+		t.Helper()
+		select {
+		case o = <-outcomes:
+		case <-time.After(time.Second):
+			t.Fatal("Timeout waiting for the command outcome")
+		}
+		return
+	}
+	start := time.Now()
+	if _, err := fs.SendApiCmd("status"); err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+	if o := next(); o.cmd != "api status" || o.rply != "+OK\n" || o.err != nil || o.latency <= 0 || o.latency > elapsed {
+		t.Errorf("Unexpected outcome: %+v", o)
+	}
+	fs.SetReplyTimeout(20 * time.Millisecond)
+	if _, err := fs.SendApiCmd("slow"); err != ErrReplyTimeout {
+		t.Fatalf("\nExpected: <%+v>, \nReceived: <%+v>", ErrReplyTimeout, err)
+	}
+	if o := next(); o.cmd != "api slow" || o.rply != "" || o.err != ErrReplyTimeout || o.latency < 20*time.Millisecond {
+		t.Errorf("Unexpected outcome: %+v", o)
+	}
+	fs.SetReplyTimeout(time.Second)
+	if err := fs.ReAuth("NewClueCon"); err != nil {
+		t.Fatal(err)
+	}
+	if o := next(); o.cmd != "auth <redacted>" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "auth <redacted>", o.cmd)
+	}
 }
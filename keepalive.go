@@ -0,0 +1,55 @@
+/*
+keepalive.go is released under the MIT License <http://www.opensource.org/licenses/mit-license.php
+Copyright (C) ITsysCOM. All Rights Reserved.
+
+Provides FreeSWITCH socket communication.
+*/
+package fsock
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// WithKeepalive sends the api command cmd (status if empty) once no frame was read nor command sent for interval,
+// keeping the NAT and firewall state of the idle connection alive and detecting its death early.
+// The traffic of the events and the other commands postpones it.
+func WithKeepalive(interval time.Duration, cmd string) FSockOption {
+	return func(fs *FSock) {
+		if cmd == "" {
+			cmd = "status"
+		}
+		fs.keepaliveInterval, fs.keepaliveCmd = interval, cmd
+	}
+}
+
+// touchTraffic records a frame read or a command sent over the connection
+func (fs *FSock) touchTraffic() {
+	atomic.StoreInt64(&fs.lastTrafficAt, fs.getClock().Now().UnixNano())
+}
+
+// keepAlive sends the keepalive command once the connection is idle for keepaliveInterval,
+// until done is closed with the read loop
+func (fs *FSock) keepAlive(done chan struct{}) {
+	interval := fs.keepaliveInterval / 4
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		last := atomic.LoadInt64(&fs.lastTrafficAt)
+		if !fs.Connected() || fs.getClock().Now().Sub(time.Unix(0, last)) < fs.keepaliveInterval {
+			continue
+		}
+		if _, err := fs.SendApiCmd(fs.keepaliveCmd); err != nil { // sending it touches the traffic
+			fs.logger.Warning(fmt.Sprintf("<FSock> Keepalive failed: <%s>", err.Error()))
+		}
+	}
+}
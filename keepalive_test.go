@@ -0,0 +1,41 @@
+/*
+keepalive_test.go is released under the MIT License <http://www.opensource.org/licenses/mit-license.php
+Copyright (C) ITsysCOM. All Rights Reserved.
+
+Provides FreeSWITCH socket communication.
+*/
+package fsock
+
+import (
+	"testing"
+	"time"
+)
+
+// countCommands returns the number of times cmd was received over the connection with the given index
+func countCommands(m *fsMock, idx int, cmd string) (n int) {
+	for _, rcv := range m.commands(idx) {
+		if rcv == cmd {
+			n++
+		}
+	}
+	return
+}
+
+func TestFSockWithKeepalive(t *testing.T) {
+	m := newFSMock(t)
+	fs := newMockedFSock(t, m, nil, WithKeepalive(50*time.Millisecond, "version"))
+	for end := time.Now().Add(150 * time.Millisecond); time.Now().Before(end); { // busy, no keepalive needed
+		if _, err := fs.SendApiCmd("status"); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := countCommands(m, 0, "api version"); n != 0 {
+		t.Errorf("Expected no keepalive while busy, received: %d", n)
+	}
+	m.waitCommand(t, 0, "api version") // sent once idle
+	time.Sleep(200 * time.Millisecond)
+	if n := countCommands(m, 0, "api version"); n < 2 || n > 5 { // one per idle interval
+		t.Errorf("Unexpected number of keepalives: %d", n)
+	}
+}
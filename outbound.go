@@ -0,0 +1,178 @@
+/*
+outbound.go is released under the MIT License <http://www.opensource.org/licenses/mit-license.php
+Copyright (C) ITsysCOM. All Rights Reserved.
+
+Provides FreeSWITCH socket communication.
+*/
+package fsock
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// OutboundServer accepts the connections of the FreeSWITCH socket application (outbound mode),
+// one per channel, running the handler for each of them.
+// Each session starts with: connect -> linger (optional) -> myevents (optional) -> event <subscriptions>.
+type OutboundServer struct {
+	listener      net.Listener
+	handler       func(fs *FSock, chanData map[string]string)
+	eventHandlers map[string][]func(string, int)
+	linger        bool // keep the socket after the hangup to receive the remaining events
+	myEvents      bool // receive only the events of the session channel
+	logger        logger
+	connIdx       int
+	wg            sync.WaitGroup
+}
+
+// OutboundOption customizes the OutboundServer
+type OutboundOption func(*OutboundServer)
+
+// WithLinger enables (default) or disables the linger command at the start of each session
+func WithLinger(enabled bool) OutboundOption {
+	return func(srv *OutboundServer) {
+		srv.linger = enabled
+	}
+}
+
+// WithMyEvents enables (default) or disables the myevents command at the start of each session.
+// Disabled, the sessions receive all the subscribed events, not only the ones of their channel.
+func WithMyEvents(enabled bool) OutboundOption {
+	return func(srv *OutboundServer) {
+		srv.myEvents = enabled
+	}
+}
+
+// NewOutboundServer listens on addr for the FreeSWITCH outbound connections. The handler receives the session,
+// subscribed to the events of eventHandlers, and the channel data out of the connect reply.
+// The session is disconnected once the handler returns. It is never reconnected: once FreeSWITCH closes it
+// (eg: on hangup), the commands fail with ErrSessionEnded.
+func NewOutboundServer(addr string, handler func(fs *FSock, chanData map[string]string),
+	eventHandlers map[string][]func(string, int), l logger, connIdx int, opts ...OutboundOption) (srv *OutboundServer, err error) {
+	l = orNopLogger(l)
+	srv = &OutboundServer{
+		handler:       handler,
+		eventHandlers: eventHandlers,
+		linger:        true,
+		myEvents:      true,
+		logger:        l,
+		connIdx:       connIdx,
+	}
+	for _, opt := range opts {
+		opt(srv)
+	}
+	if srv.listener, err = net.Listen("tcp", addr); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Addr returns the address the server listens on
+func (srv *OutboundServer) Addr() net.Addr {
+	return srv.listener.Addr()
+}
+
+// Serve accepts the connections until the server is closed, waiting then for the running sessions
+func (srv *OutboundServer) Serve() error {
+	defer srv.wg.Wait()
+	for {
+		conn, err := srv.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		srv.wg.Add(1)
+		go func() {
+			defer srv.wg.Done()
+			srv.handleConn(conn)
+		}()
+	}
+}
+
+// Close stops accepting new connections, the running sessions end with their handlers
+func (srv *OutboundServer) Close() error {
+	return srv.listener.Close()
+}
+
+// handleConn runs one outbound session
+func (srv *OutboundServer) handleConn(conn net.Conn) {
+	fs := &FSock{
+		conn:            conn,
+		fsMutex:         new(sync.RWMutex),
+		connIdx:         srv.connIdx,
+		connID:          genUUID(),
+		eventHandlers:   srv.eventHandlers,
+		backgroundChans: make(map[string]chan string),
+		cmdChan:         make(chan string),
+		delayFunc:       fibDuration,
+		logger:          srv.logger,
+		stopReadEvents:  make(chan struct{}),
+		errReadEvents:   make(chan error, 1),
+		readEventsDone:  make(chan struct{}),
+		repliesLost:     make(chan struct{}),
+		outbound:        true,
+		cancelGrace:     defaultCancelGrace,
+	}
+	defer fs.Disconnect()
+	fs.resetBuffer()
+	chanData, err := fs.startOutbound(srv.linger, srv.myEvents)
+	if err != nil {
+		srv.logger.Err(fmt.Sprintf("<FSock> Cannot start the outbound session: <%s>", err.Error()))
+		return
+	}
+	go fs.readEvents()
+	srv.handler(fs, chanData)
+}
+
+// startOutbound sends the commands starting the outbound session, before the read loop,
+// returning the channel data received with the connect reply
+func (fs *FSock) startOutbound(linger, myEvents bool) (chanData map[string]string, err error) {
+	var rply string
+	if rply, err = fs.outboundCmd("connect"); err != nil {
+		return
+	}
+	var malformed []string
+	if chanData, malformed = eventToMap(rply, fs.parseHdrVal); len(malformed) != 0 { // keep the session, with what could be parsed
+		fs.chanDataWarning = fmt.Errorf("Malformed channel data headers: <%s>", strings.Join(malformed, ">, <"))
+		fs.logger.Warning(fmt.Sprintf("<FSock> %s", fs.chanDataWarning.Error()))
+	}
+	if linger {
+		if _, err = fs.outboundCmd("linger"); err != nil {
+			return
+		}
+	}
+	if myEvents {
+		if _, err = fs.outboundCmd("myevents"); err != nil {
+			return
+		}
+	}
+	if events := fs.subscriptions(); len(events) != 0 {
+		err = fs.eventsPlain(events, false)
+	}
+	return
+}
+
+// ChannelDataWarning returns the problem met parsing the channel data of the outbound session,
+// nil if they were parsed entirely. The channel data passed to the handler hold the headers which could be parsed.
+func (fs *FSock) ChannelDataWarning() error {
+	return fs.chanDataWarning
+}
+
+// outboundCmd sends one of the session start commands and reads its reply headers
+func (fs *FSock) outboundCmd(cmd string) (rply string, err error) {
+	if err = fs.send(cmd + "\n\n"); err != nil {
+		return
+	}
+	if rply, err = fs.readHandshakeReply(); err != nil { // the events of myevents may precede the replies
+		return
+	}
+	if !strings.Contains(rply, "Reply-Text: +OK") {
+		return "", fmt.Errorf("Unexpected %s reply received: <%s>", cmd, rply)
+	}
+	return
+}
@@ -0,0 +1,205 @@
+/*
+outbound_test.go is released under the MIT License <http://www.opensource.org/licenses/mit-license.php
+Copyright (C) ITsysCOM. All Rights Reserved.
+
+Provides FreeSWITCH socket communication.
+*/
+package fsock
+
+import (
+	"bufio"
+	"net"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newOutboundServer starts an OutboundServer on a random local port, closed on cleanup
+func newOutboundServer(t *testing.T, handler func(*FSock, map[string]string),
+	evHandlers map[string][]func(string, int), opts ...OutboundOption) *OutboundServer {
+	t.Helper()
+	srv, err := NewOutboundServer("127.0.0.1:0", handler, evHandlers, nil, 0, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve()
+	t.Cleanup(func() { srv.Close() })
+	return srv
+}
+
+// dialOutbound connects to the server as FreeSWITCH would for the channel, replying +OK to the commands
+// and returning them once the session is closed by the server
+func dialOutbound(t *testing.T, srv *OutboundServer, uuid string) []string {
+	t.Helper()
+	c, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(time.Second))
+	rdr := bufio.NewReader(c)
+	var cmds []string
+	for {
+		var lns []string
+		for {
+			ln, err := rdr.ReadString('\n')
+			if err != nil {
+				return cmds
+			}
+			if ln = strings.TrimSuffix(ln, "\n"); ln == "" {
+				break
+			}
+			lns = append(lns, ln)
+		}
+		cmd := strings.Join(lns, "\n")
+		cmds = append(cmds, cmd)
+		rply := "Content-Type: command/reply\nReply-Text: +OK\n\n"
+		if cmd == "connect" {
+			rply = "Content-Type: command/reply\nReply-Text: +OK\nEvent-Name: CHANNEL_DATA\n" +
+				"Unique-ID: " + uuid + "\nCaller-Caller-ID-Number: 1001\nvariable_sip_from_uri: 1001%40192.168.56.74\n\n"
+		}
+		if _, err := c.Write([]byte(rply)); err != nil {
+			return cmds
+		}
+	}
+}
+
+func TestOutboundServerMyEvents(t *testing.T) {
+	chanDatas := make(chan map[string]string, 1)
+	srv := newOutboundServer(t, func(_ *FSock, chanData map[string]string) { chanDatas <- chanData },
+		map[string][]func(string, int){"CHANNEL_HANGUP": {func(string, int) {}}})
+	cmds := dialOutbound(t, srv, "4c882cc4-cd02-11e6-8b82-395b501876f9")
+	if exp := []string{"connect", "linger", "myevents", "event plain CHANNEL_HANGUP"}; !reflect.DeepEqual(exp, cmds) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, cmds)
+	}
+	select {
+	case chanData := <-chanDatas:
+		if chanData["Unique-ID"] != "4c882cc4-cd02-11e6-8b82-395b501876f9" ||
+			chanData["variable_sip_from_uri"] != "1001@192.168.56.74" {
+			t.Errorf("Unexpected channel data: %+v", chanData)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for the session handler")
+	}
+}
+
+func TestOutboundServerNoMyEvents(t *testing.T) {
+	srv := newOutboundServer(t, func(*FSock, map[string]string) {},
+		map[string][]func(string, int){"CHANNEL_HANGUP": {func(string, int) {}}}, WithMyEvents(false))
+	cmds := dialOutbound(t, srv, "4c882cc4-cd02-11e6-8b82-395b501876f9")
+	if exp := []string{"connect", "linger", "event plain CHANNEL_HANGUP"}; !reflect.DeepEqual(exp, cmds) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, cmds)
+	}
+	srv = newOutboundServer(t, func(*FSock, map[string]string) {}, nil, WithMyEvents(false), WithLinger(false))
+	cmds = dialOutbound(t, srv, "4c882cc4-cd02-11e6-8b82-395b501876f9")
+	if exp := []string{"connect"}; !reflect.DeepEqual(exp, cmds) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, cmds)
+	}
+}
+
+func TestOutboundServerCommands(t *testing.T) {
+	rplys := make(chan string, 1)
+	srv := newOutboundServer(t, func(fs *FSock, _ map[string]string) {
+		rply, err := fs.SendApiCmd("uuid_getvar 4c882cc4 cgr_reqtype")
+		if err != nil {
+			rply = err.Error()
+		}
+		rplys <- rply
+	}, nil)
+	dialOutbound(t, srv, "4c882cc4")
+	select {
+	case rply := <-rplys:
+		if rply != "+OK" {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "+OK", rply)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for the command reply")
+	}
+}
+
+func TestOutboundServerMalformedChannelData(t *testing.T) {
+	type session struct {
+		chanData map[string]string
+		warning  error
+		rply     string
+	}
+	sessions := make(chan session, 1)
+	srv := newOutboundServer(t, func(fs *FSock, chanData map[string]string) {
+		rply, err := fs.SendApiCmd("uuid_getvar 4c882cc4 cgr_reqtype")
+		if err != nil {
+			rply = err.Error()
+		}
+		sessions <- session{chanData, fs.ChannelDataWarning(), rply}
+	}, nil)
+	dialOutbound(t, srv, "4c882cc4\nCaller-Caller-ID-Name") // header line without value
+	select {
+	case sess := <-sessions:
+		if sess.rply != "+OK" {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "+OK", sess.rply)
+		}
+		if sess.chanData["Unique-ID"] != "4c882cc4" || sess.chanData["Caller-Caller-ID-Number"] != "1001" {
+			t.Errorf("Unexpected channel data: %+v", sess.chanData)
+		}
+		if exp := "Malformed channel data headers: <Caller-Caller-ID-Name>"; sess.warning == nil || sess.warning.Error() != exp {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, sess.warning)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for the session handler")
+	}
+	warnings := make(chan error, 1)
+	srv = newOutboundServer(t, func(fs *FSock, _ map[string]string) { warnings <- fs.ChannelDataWarning() }, nil)
+	dialOutbound(t, srv, "4c882cc4")
+	if err := <-warnings; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOutboundServerSessionEnded(t *testing.T) {
+	ready := make(chan struct{})
+	type result struct{ readErr, cmdErr error }
+	results := make(chan result, 1)
+	var attempts int32
+	srv := newOutboundServer(t, func(fs *FSock, _ map[string]string) {
+		fs.OnReconnectAttempt(func(int) error {
+			atomic.AddInt32(&attempts, 1)
+			return nil
+		})
+		close(ready)
+		var res result
+		res.readErr = fs.ReadEvents() // until FreeSWITCH closes the session
+		_, res.cmdErr = fs.SendApiCmd("uuid_getvar 4c882cc4 cgr_reqtype")
+		results <- res
+	}, nil, WithLinger(false), WithMyEvents(false))
+	c, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = bufio.NewReader(c).ReadString('\n'); err != nil { // connect
+		t.Fatal(err)
+	}
+	if _, err = c.Write([]byte("Content-Type: command/reply\nReply-Text: +OK\nUnique-ID: 4c882cc4\n\n")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ready:
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for the session handler")
+	}
+	c.Close() // hangup
+	select {
+	case res := <-results:
+		if res.readErr != ErrSessionEnded {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrSessionEnded, res.readErr)
+		}
+		if res.cmdErr != ErrSessionEnded {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrSessionEnded, res.cmdErr)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for the session end")
+	}
+	if n := atomic.LoadInt32(&attempts); n != 0 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 0, n)
+	}
+}
@@ -0,0 +1,158 @@
+/*
+pause.go is released under the MIT License <http://www.opensource.org/licenses/mit-license.php
+Copyright (C) ITsysCOM. All Rights Reserved.
+
+Provides FreeSWITCH socket communication.
+*/
+package fsock
+
+import (
+	"fmt"
+	"sync"
+)
+
+// PauseOverflow decides which events the pause buffer keeps once full
+type PauseOverflow int
+
+// Overflow policies of the pause buffer
+const (
+	PauseDropOldest PauseOverflow = iota // the oldest buffered event is dropped to make room, the latest ones are dispatched on resume
+	PauseDropNewest                      // the new events are dropped, the first ones are dispatched on resume
+)
+
+// pauseFrame is an event held while paused, with its frame headers
+type pauseFrame struct {
+	hdr, body string
+}
+
+// eventPause holds the event dispatching while paused, either blocking the read loop (TCP backpressure)
+// or buffering up to capacity events, dispatched in order on resume
+type eventPause struct {
+	mu       sync.Mutex
+	paused   bool
+	flushing bool          // resumed, the buffered events being dispatched still
+	resumed  chan struct{} // closed on resume and on disconnect, waking the read loop blocked by the backpressure
+	capacity int           // of the buffer, 0 for the TCP backpressure
+	overflow PauseOverflow
+	buffer   []pauseFrame
+	dropped  uint64 // by the overflow policy since paused
+}
+
+// WithPauseBuffer keeps reading the events while paused (see Pause), buffering up to capacity of them instead of
+// relying on the TCP backpressure, so the commands still receive their replies. Once full the overflow policy
+// decides which of them are dispatched on resume, the others are dropped (counted by Stats.PauseDropped).
+func WithPauseBuffer(capacity int, overflow PauseOverflow) FSockOption {
+	return func(fs *FSock) {
+		fs.pause.capacity = capacity
+		fs.pause.overflow = overflow
+	}
+}
+
+// Pause holds the dispatching of the events until Resume. By default the read loop stops reading, leaving the
+// events queued by the TCP backpressure, the commands waiting for their replies meanwhile up to their reply timeout.
+// With WithPauseBuffer the events are buffered instead, the commands being served.
+func (fs *FSock) Pause() error {
+	if !fs.initialized() {
+		return ErrNotConnected
+	}
+	fs.pause.mu.Lock()
+	if !fs.pause.paused {
+		fs.pause.paused = true
+		fs.pause.resumed = make(chan struct{})
+	}
+	fs.pause.mu.Unlock()
+	return nil
+}
+
+// Paused checks if the event dispatching is paused
+func (fs *FSock) Paused() bool {
+	if !fs.initialized() {
+		return false
+	}
+	fs.pause.mu.Lock()
+	defer fs.pause.mu.Unlock()
+	return fs.pause.paused
+}
+
+// Resume dispatches again the events, the ones buffered while paused first, in order
+func (fs *FSock) Resume() error {
+	if !fs.initialized() {
+		return ErrNotConnected
+	}
+	fs.pause.mu.Lock()
+	if !fs.pause.paused || fs.pause.flushing {
+		fs.pause.mu.Unlock()
+		return nil
+	}
+	fs.pause.flushing = true
+	close(fs.pause.resumed)
+	if dropped := fs.pause.dropped; dropped != 0 {
+		fs.pause.dropped = 0
+		fs.logger.Warning(fmt.Sprintf("<FSock> %d events dropped while paused", dropped))
+	}
+	for len(fs.pause.buffer) != 0 { // the read loop buffers meanwhile, keeping the order
+		frm := fs.pause.buffer[0]
+		fs.pause.buffer[0] = pauseFrame{}
+		fs.pause.buffer = fs.pause.buffer[1:]
+		fs.pause.mu.Unlock()
+		fs.currentProcess()(frm.hdr, frm.body)
+		fs.pause.mu.Lock()
+	}
+	fs.pause.buffer = nil
+	fs.pause.paused, fs.pause.flushing = false, false
+	fs.pause.mu.Unlock()
+	return nil
+}
+
+// currentProcess returns the processing of the events read by the current connection
+func (fs *FSock) currentProcess() func(hdr, body string) {
+	fs.fsMutex.RLock()
+	pipeline := fs.pipeline
+	fs.fsMutex.RUnlock()
+	if pipeline != nil {
+		return pipeline.process
+	}
+	return fs.processEvent
+}
+
+// holdEvent holds the event read if paused, returning false if it should be processed right away.
+// Blocks the read loop until resumed or disconnected with the TCP backpressure.
+func (fs *FSock) holdEvent(hdr, body string) bool {
+	ep := &fs.pause
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	if !ep.paused {
+		return false
+	}
+	if ep.capacity <= 0 {
+		if ep.flushing { // nothing buffered, resumed
+			return false
+		}
+		resumed := ep.resumed
+		ep.mu.Unlock()
+		<-resumed // the event read is processed then, on disconnect as well
+		ep.mu.Lock()
+		return false
+	}
+	if len(ep.buffer) >= ep.capacity {
+		ep.dropped++
+		fs.stats.addPauseDropped()
+		if ep.overflow == PauseDropNewest {
+			return true
+		}
+		ep.buffer[0] = pauseFrame{}
+		ep.buffer = ep.buffer[1:]
+	}
+	ep.buffer = append(ep.buffer, pauseFrame{hdr: hdr, body: body})
+	return true
+}
+
+// wakePaused releases the read loop blocked by the TCP backpressure, so it notices the connection lost
+func (fs *FSock) wakePaused() {
+	fs.pause.mu.Lock()
+	if fs.pause.paused && fs.pause.capacity <= 0 && !fs.pause.flushing {
+		close(fs.pause.resumed)
+		fs.pause.resumed = make(chan struct{})
+	}
+	fs.pause.mu.Unlock()
+}
@@ -0,0 +1,109 @@
+/*
+pause_test.go is released under the MIT License <http://www.opensource.org/licenses/mit-license.php
+Copyright (C) ITsysCOM. All Rights Reserved.
+
+Provides FreeSWITCH socket communication.
+*/
+package fsock
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFSockPauseBuffer(t *testing.T) {
+	for _, tc := range []struct {
+		overflow PauseOverflow
+		exp      []string
+	}{
+		{PauseDropOldest, []string{"3", "4", "5"}},
+		{PauseDropNewest, []string{"1", "2", "3"}},
+	} {
+		m := newFSMock(t)
+		rcv := make(chan string, 5)
+		fs := newMockedFSock(t, m, map[string][]func(string, int){
+			"CHANNEL_ANSWER": {func(event string, _ int) { rcv <- EventToMap(event)["Unique-ID"] }},
+		}, WithSerialDispatch(), WithPauseBuffer(3, tc.overflow))
+		if err := fs.Pause(); err != nil {
+			t.Fatal(err)
+		} else if !fs.Paused() {
+			t.Error("Not paused")
+		}
+		for i := 1; i <= 5; i++ {
+			m.sendEvent(0, fmt.Sprintf("Event-Name: CHANNEL_ANSWER\nUnique-ID: %d\n", i))
+		}
+		if _, err := fs.SendApiCmd("status"); err != nil { // served while paused, the events before it read
+			t.Fatal(err)
+		}
+		select {
+		case id := <-rcv:
+			t.Fatalf("Event %s dispatched while paused", id)
+		case <-time.After(20 * time.Millisecond):
+		}
+		if err := fs.Resume(); err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for len(ids) != len(tc.exp) {
+			select {
+			case id := <-rcv:
+				ids = append(ids, id)
+			case <-time.After(time.Second):
+				t.Fatalf("Events not dispatched on resume, received: %v", ids)
+			}
+		}
+		if !reflect.DeepEqual(tc.exp, ids) {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", tc.exp, ids)
+		}
+		if rcv := fs.Stats().PauseDropped; rcv != 2 {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 2, rcv)
+		}
+		m.sendEvent(0, "Event-Name: CHANNEL_ANSWER\nUnique-ID: 6\n") // dispatched right away once resumed
+		select {
+		case id := <-rcv:
+			if id != "6" {
+				t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "6", id)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Event not dispatched after resume")
+		}
+	}
+}
+
+func TestFSockPauseBackpressure(t *testing.T) {
+	m := newFSMock(t)
+	rcv := make(chan string, 1)
+	fs := newMockedFSock(t, m, map[string][]func(string, int){
+		"CHANNEL_ANSWER": {func(event string, _ int) { rcv <- EventToMap(event)["Unique-ID"] }},
+	})
+	fs.Pause()
+	m.sendEvent(0, "Event-Name: CHANNEL_ANSWER\nUnique-ID: 1\n")
+	select {
+	case id := <-rcv:
+		t.Fatalf("Event %s dispatched while paused", id)
+	case <-time.After(20 * time.Millisecond):
+	}
+	fs.Resume()
+	select {
+	case id := <-rcv:
+		if id != "1" {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "1", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Event not dispatched on resume")
+	}
+	fs.Pause()
+	m.sendEvent(0, "Event-Name: CHANNEL_ANSWER\nUnique-ID: 2\n")
+	time.Sleep(20 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := fs.DisconnectAndWait(ctx); err != nil { // the read loop blocked by the pause exits
+		t.Error(err)
+	}
+	if err := (*FSock)(nil).Pause(); err != ErrNotConnected {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrNotConnected, err)
+	}
+}
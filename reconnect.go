@@ -0,0 +1,85 @@
+/*
+reconnect.go is released under the MIT License <http://www.opensource.org/licenses/mit-license.php
+Copyright (C) ITsysCOM. All Rights Reserved.
+
+Provides FreeSWITCH socket communication.
+*/
+package fsock
+
+// ReconnectEventKind is the step of the reconnect lifecycle a ReconnectEvent reports
+type ReconnectEventKind int
+
+// Steps of the reconnect lifecycle
+const (
+	ReconnectAttempt ReconnectEventKind = iota // a reconnect attempt starts
+	ReconnectSuccess                           // the attempt connected, ending the reconnect
+	ReconnectFailed                            // the attempt failed, Err holding why
+)
+
+func (k ReconnectEventKind) String() string {
+	switch k {
+	case ReconnectAttempt:
+		return "attempt"
+	case ReconnectSuccess:
+		return "success"
+	case ReconnectFailed:
+		return "failed"
+	}
+	return "unknown"
+}
+
+// ReconnectEvent is a step of the reconnect lifecycle, as emitted on ReconnectEvents
+type ReconnectEvent struct {
+	Kind    ReconnectEventKind
+	Attempt int   // number of the attempt within the reconnect, from 1
+	Err     error // of the failed attempts
+}
+
+// reconnectEventsQueue is the number of reconnect events kept unread before dropping the oldest ones
+const reconnectEventsQueue = 64
+
+// ReconnectEvents returns the channel emitting the reconnect lifecycle, as an alternative to OnReconnectFailed.
+// The events are emitted from the first call on, the oldest ones dropped once reconnectEventsQueue wait unread
+// so the reconnects never block on it. Closed by Disconnect, a later call returning a new channel.
+func (fs *FSock) ReconnectEvents() <-chan ReconnectEvent {
+	if !fs.initialized() {
+		return nil
+	}
+	fs.fsMutex.Lock()
+	defer fs.fsMutex.Unlock()
+	if fs.reconnectEvents == nil {
+		fs.reconnectEvents = make(chan ReconnectEvent, reconnectEventsQueue)
+	}
+	return fs.reconnectEvents
+}
+
+// emitReconnectEvent queues the event on ReconnectEvents once used, dropping the oldest one if full
+func (fs *FSock) emitReconnectEvent(kind ReconnectEventKind, attempt int, err error) {
+	ev := ReconnectEvent{Kind: kind, Attempt: attempt, Err: err}
+	fs.fsMutex.Lock() // held while sending so the channel is not closed meanwhile
+	defer fs.fsMutex.Unlock()
+	if fs.reconnectEvents == nil {
+		return
+	}
+	for {
+		select {
+		case fs.reconnectEvents <- ev:
+			return
+		default:
+		}
+		select {
+		case <-fs.reconnectEvents: // drop the oldest to make room
+		default:
+		}
+	}
+}
+
+// closeReconnectEvents closes the ReconnectEvents channel, if any, on Disconnect
+func (fs *FSock) closeReconnectEvents() {
+	fs.fsMutex.Lock()
+	if fs.reconnectEvents != nil {
+		close(fs.reconnectEvents)
+		fs.reconnectEvents = nil
+	}
+	fs.fsMutex.Unlock()
+}
@@ -0,0 +1,192 @@
+/*
+reconnect_test.go is released under the MIT License <http://www.opensource.org/licenses/mit-license.php
+Copyright (C) ITsysCOM. All Rights Reserved.
+
+Provides FreeSWITCH socket communication.
+*/
+package fsock
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFSockReconnectEvents(t *testing.T) {
+	m := newFSMock(t)
+	fs := newMockedFSock(t, m, nil, WithBackoff(NewFibBackoff(time.Millisecond, 0)))
+	m.mu.Lock()
+	m.rejects = 3 // the first two reconnect attempts closed once accepted
+	m.mu.Unlock()
+	fs.reconnects = 5
+	evs := fs.ReconnectEvents()
+	m.dropConn(0)
+	for i := 0; i < 100 && fs.Connected(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := fs.ReconnectIfNeeded(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Disconnect(); err != nil {
+		t.Fatal(err)
+	}
+	var rcv []string
+	for ev := range evs {
+		if ev.Kind == ReconnectFailed && ev.Err == nil {
+			t.Errorf("Expected the error of the failed attempt %d", ev.Attempt)
+		}
+		rcv = append(rcv, fmt.Sprintf("%s#%d", ev.Kind, ev.Attempt))
+	}
+	exp := []string{"attempt#1", "failed#1", "attempt#2", "failed#2", "attempt#3", "success#3"}
+	if !reflect.DeepEqual(exp, rcv) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, rcv)
+	}
+	if evs = fs.ReconnectEvents(); evs == nil {
+		t.Error("Expected a new channel after Disconnect")
+	}
+}
+
+func TestFSockReconnectEventsDropOldest(t *testing.T) {
+	m := newFSMock(t)
+	fs := newMockedFSock(t, m, nil)
+	evs := fs.ReconnectEvents()
+	for i := 1; i <= reconnectEventsQueue+2; i++ {
+		fs.emitReconnectEvent(ReconnectAttempt, i, nil)
+	}
+	if ev := <-evs; ev.Attempt != 3 {
+		t.Errorf("Expected the oldest events dropped, received attempt: %d", ev.Attempt)
+	}
+	if n := len(evs); n != reconnectEventsQueue-1 {
+		t.Errorf("Expected %d events queued, received: %d", reconnectEventsQueue-1, n)
+	}
+}
+
+func TestFSockOnReconnectAttempt(t *testing.T) {
+	m := newFSMock(t)
+	clk := &clockMock{now: time.Now()}
+	fs := newMockedFSock(t, m, nil, WithClock(clk), WithBackoff(NewFibBackoff(time.Second, 0)))
+	fs.reconnects = 5
+	errBreakerOpen := errors.New("circuit breaker open")
+	var attempts []int
+	fs.OnReconnectAttempt(func(attempt int) error {
+		attempts = append(attempts, attempt)
+		if attempt <= 2 {
+			return errBreakerOpen
+		}
+		return nil
+	})
+	m.dropConn(0)
+	for i := 0; i < 100 && fs.Connected(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	start := clk.Now()
+	if err := fs.ReconnectIfNeeded(); err != nil {
+		t.Fatal(err)
+	}
+	if exp := []int{1, 2, 3}; !reflect.DeepEqual(exp, attempts) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, attempts)
+	}
+	if dials := m.connCount(); dials != 2 { // the vetoed attempts never dialed
+		t.Errorf("Expected 2 connections, received: %d", dials)
+	}
+	if waited := clk.Now().Sub(start); waited != 2*time.Second { // backed off after each veto
+		t.Errorf("Expected 2s of backoff, received: %v", waited)
+	}
+
+	m.dropConn(1)
+	for i := 0; i < 100 && fs.Connected(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	attempts = nil
+	fs.OnReconnectAttempt(func(attempt int) error {
+		attempts = append(attempts, attempt)
+		return fmt.Errorf("maintenance: %w", ErrStopReconnect)
+	})
+	if err := fs.ReconnectIfNeeded(); !errors.Is(err, ErrStopReconnect) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrStopReconnect, err)
+	}
+	if exp := []int{1}; !reflect.DeepEqual(exp, attempts) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, attempts)
+	}
+}
+
+func TestFSockWithFastRetry(t *testing.T) {
+	m := newFSMock(t)
+	clk := &clockMock{now: time.Now()}
+	fs := newMockedFSock(t, m, nil, WithClock(clk), WithBackoff(NewFibBackoff(time.Second, 0)),
+		WithFastRetry(2, 10*time.Millisecond))
+	m.mu.Lock()
+	m.rejects = 3 // the momentary drop, the first two reconnect attempts closed once accepted
+	m.mu.Unlock()
+	fs.reconnects = 5
+	m.dropConn(0)
+	for i := 0; i < 100 && fs.Connected(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	start := clk.Now()
+	if err := fs.ReconnectIfNeeded(); err != nil {
+		t.Fatal(err)
+	}
+	if waited := clk.Now().Sub(start); waited != 30*time.Millisecond { // 10ms, then 20ms
+		t.Errorf("Expected 30ms of fast retries, received: %v", waited)
+	}
+	if d := fs.CurrentBackoff(); d != time.Second { // never consumed
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", time.Second, d)
+	}
+
+	m.mu.Lock()
+	m.rejects = 8 // lasting past the fast retries, four attempts closed
+	m.mu.Unlock()
+	m.dropConn(3)
+	for i := 0; i < 100 && fs.Connected(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	start = clk.Now()
+	if err := fs.ReconnectIfNeeded(); err != nil {
+		t.Fatal(err)
+	}
+	if waited := clk.Now().Sub(start); waited != 30*time.Millisecond+2*time.Second { // then backed off 1s, 1s
+		t.Errorf("Expected 2.03s of retries, received: %v", waited)
+	}
+}
+
+func TestFSockOnServerRestart(t *testing.T) {
+	m := newFSMock(t)
+	var uptime atomic.Value
+	uptime.Store("1 hour, 2 minutes, 3 seconds")
+	m.apiReply = func(cmd string) string {
+		return "UP 0 years, 0 days, " + uptime.Load().(string) + ", 456 milliseconds, 789 microseconds\n" +
+			"FreeSWITCH (Version 1.10.9) is ready\n"
+	}
+	fs := newMockedFSock(t, m, nil, WithBackoff(NewFibBackoff(time.Millisecond, 0)))
+	fs.reconnects = 5
+	restarts := make(chan struct{}, 2)
+	fs.OnServerRestart(func() { restarts <- struct{}{} })
+	reconnect := func(idx int) {
+		t.Helper()
+		m.dropConn(idx)
+		for i := 0; i < 100 && fs.Connected(); i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err := fs.ReconnectIfNeeded(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	uptime.Store("1 hour, 2 minutes, 4 seconds") // the same FreeSWITCH, up for longer
+	reconnect(0)
+	select {
+	case <-restarts:
+		t.Error("Unexpected restart detected")
+	default:
+	}
+	uptime.Store("0 hours, 0 minutes, 5 seconds") // restarted meanwhile
+	reconnect(1)
+	select {
+	case <-restarts:
+	default:
+		t.Error("Expected the restart detected")
+	}
+}
@@ -0,0 +1,164 @@
+/*
+spool.go is released under the MIT License <http://www.opensource.org/licenses/mit-license.php
+Copyright (C) ITsysCOM. All Rights Reserved.
+
+Provides FreeSWITCH socket communication.
+*/
+package fsock
+
+import (
+	"sync"
+)
+
+// SpoolPolicy decides what the event spool does with a new event once full
+type SpoolPolicy int
+
+// Overflow policies of the event spool
+const (
+	SpoolBlock      SpoolPolicy = iota // the read loop waits for the handlers to make room, unless a command waits its reply
+	SpoolDropOldest                    // the oldest spooled event is dropped to make room
+)
+
+// eventSpool buffers the event frames in a bounded ring between the read loop and the handlers,
+// feeding them in order to process out of its own goroutine
+type eventSpool struct {
+	mu          sync.Mutex
+	cond        *sync.Cond // signaled on push, pop, stop and wake
+	ring        []eventFrame
+	capacity    int // frames spooled before applying the policy, the ring growing past it only when not allowed to block
+	head, count int // position of the oldest frame and number of frames spooled
+	stopped     bool
+	exited      bool        // the feeding exited, nothing is processed anymore
+	mayBlock    func() bool // if not nil, checked before blocking the push, which spools past capacity if false
+	policy      SpoolPolicy
+	highWater   int // depth reporting the backlog, 0 to disable
+	onHighWater func(depth int)
+	aboveHigh   bool // backlog reported, rearmed once the depth falls below highWater
+	onDrop      func()
+	done        chan struct{} // closed when the spooled frames were processed after stop
+}
+
+// newEventSpool starts feeding the frames spooled, up to capacity, to process
+func newEventSpool(capacity, highWater int, policy SpoolPolicy, onHighWater func(int), onDrop func(),
+	mayBlock func() bool, process func(hdr, body string)) (sp *eventSpool) {
+	if capacity < 1 {
+		capacity = 1
+	}
+	sp = &eventSpool{
+		ring:        make([]eventFrame, capacity),
+		capacity:    capacity,
+		mayBlock:    mayBlock,
+		policy:      policy,
+		highWater:   highWater,
+		onHighWater: onHighWater,
+		onDrop:      onDrop,
+		done:        make(chan struct{}),
+	}
+	sp.cond = sync.NewCond(&sp.mu)
+	go sp.feed(process)
+	return
+}
+
+// push spools the frame, applying the overflow policy if full
+func (sp *eventSpool) push(hdr, body string) {
+	sp.mu.Lock()
+	var dropped bool
+	for sp.count >= sp.capacity && !sp.stopped {
+		if sp.policy == SpoolDropOldest {
+			sp.head = (sp.head + 1) % len(sp.ring)
+			sp.count--
+			dropped = true
+			break
+		}
+		if sp.mayBlock != nil && !sp.mayBlock() { // blocking would hold the reply awaited by a handler
+			break
+		}
+		sp.cond.Wait()
+	}
+	if sp.count >= sp.capacity && sp.stopped { // stopped while full
+		sp.mu.Unlock()
+		return
+	}
+	sp.append(eventFrame{hdr: hdr, body: body})
+	depth := sp.count
+	reportHigh := sp.highWater > 0 && depth >= sp.highWater && !sp.aboveHigh
+	if reportHigh {
+		sp.aboveHigh = true
+	}
+	sp.cond.Broadcast()
+	sp.mu.Unlock()
+	if dropped && sp.onDrop != nil {
+		sp.onDrop()
+	}
+	if reportHigh && sp.onHighWater != nil {
+		sp.onHighWater(depth)
+	}
+}
+
+// append spools the frame, growing the ring if full
+func (sp *eventSpool) append(frm eventFrame) {
+	if sp.count == len(sp.ring) {
+		ring := make([]eventFrame, 2*len(sp.ring))
+		for i := 0; i < sp.count; i++ {
+			ring[i] = sp.ring[(sp.head+i)%len(sp.ring)]
+		}
+		sp.ring, sp.head = ring, 0
+	}
+	sp.ring[(sp.head+sp.count)%len(sp.ring)] = frm
+	sp.count++
+}
+
+// enqueue spools the frame without ever blocking or dropping, even past capacity or once stopped,
+// returning false if the feeding exited already
+func (sp *eventSpool) enqueue(hdr, body string) bool {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if sp.exited {
+		return false
+	}
+	sp.append(eventFrame{hdr: hdr, body: body})
+	sp.cond.Broadcast()
+	return true
+}
+
+// wake makes the blocked push check again if it may block
+func (sp *eventSpool) wake() {
+	sp.mu.Lock()
+	sp.cond.Broadcast()
+	sp.mu.Unlock()
+}
+
+// feed processes the spooled frames in order until stopped and drained
+func (sp *eventSpool) feed(process func(hdr, body string)) {
+	defer close(sp.done)
+	for {
+		sp.mu.Lock()
+		for sp.count == 0 && !sp.stopped {
+			sp.cond.Wait()
+		}
+		if sp.count == 0 { // stopped and drained
+			sp.exited = true
+			sp.mu.Unlock()
+			return
+		}
+		frm := sp.ring[sp.head]
+		sp.ring[sp.head] = eventFrame{}
+		sp.head = (sp.head + 1) % len(sp.ring)
+		sp.count--
+		if sp.count < sp.highWater {
+			sp.aboveHigh = false
+		}
+		sp.cond.Broadcast()
+		sp.mu.Unlock()
+		process(frm.hdr, frm.body)
+	}
+}
+
+// stop waits for the spooled frames to be processed and the feeding to exit
+func (sp *eventSpool) stop() {
+	sp.mu.Lock()
+	sp.stopped = true
+	sp.cond.Broadcast()
+	sp.mu.Unlock()
+	<-sp.done
+}
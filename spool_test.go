@@ -0,0 +1,142 @@
+/*
+spool_test.go is released under the MIT License <http://www.opensource.org/licenses/mit-license.php
+Copyright (C) ITsysCOM. All Rights Reserved.
+
+Provides FreeSWITCH socket communication.
+*/
+package fsock
+
+import (
+	"reflect"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFSockWithEventSpoolDropOldest(t *testing.T) {
+	m := newFSMock(t)
+	entered := make(chan string, 10)
+	release := make(chan struct{})
+	highWater := make(chan int, 2)
+	fs := newMockedFSock(t, m, map[string][]func(string, int){
+		"CUSTOM": {func(ev string, _ int) {
+			entered <- headerVal(ev, "Event-Sequence")
+			<-release
+		}},
+	}, WithEventSpool(3, 3, SpoolDropOldest, func(depth int) { highWater <- depth }))
+	m.sendEvent(0, "Event-Name: CUSTOM\nEvent-Sequence: 1\n")
+	select {
+	case <-entered: // the slow handler holds the first event
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for the first event")
+	}
+	for i := 2; i <= 6; i++ {
+		m.sendEvent(0, "Event-Name: CUSTOM\nEvent-Sequence: "+strconv.Itoa(i)+"\n")
+	}
+	for i := 0; i < 100 && fs.Stats().SpoolDropped != 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if rcv := fs.Stats().SpoolDropped; rcv != 2 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 2, rcv)
+	}
+	select {
+	case depth := <-highWater:
+		if depth != 3 {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 3, depth)
+		}
+	default:
+		t.Error("Expected the high water mark reported")
+	}
+	if _, err := fs.SendApiCmd("status"); err != nil { // the reads go on despite the slow handler
+		t.Error(err)
+	}
+	close(release)
+	var rcv []string
+	for len(rcv) < 3 {
+		select {
+		case seq := <-entered:
+			rcv = append(rcv, seq)
+		case <-time.After(time.Second):
+			t.Fatalf("Timeout waiting for the spooled events, received: %v", rcv)
+		}
+	}
+	if exp := []string{"4", "5", "6"}; !reflect.DeepEqual(exp, rcv) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, rcv)
+	}
+}
+
+func TestEventSpoolBlock(t *testing.T) {
+	processed := make(chan string, 10)
+	release := make(chan struct{})
+	sp := newEventSpool(2, 0, SpoolBlock, nil, func() { t.Error("Unexpected drop") }, nil,
+		func(_, body string) {
+			<-release
+			processed <- body
+		})
+	pushed := make(chan struct{})
+	go func() {
+		for i := 1; i <= 4; i++ { // 1 processing, 2 and 3 spooled, 4 blocked
+			sp.push("", strconv.Itoa(i))
+		}
+		close(pushed)
+	}()
+	for i := 0; i < 100; i++ {
+		sp.mu.Lock()
+		full := sp.count == 2
+		sp.mu.Unlock()
+		if full {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case <-pushed:
+		t.Fatal("Expected the push blocked by the full spool")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	<-pushed
+	sp.stop()
+	close(processed)
+	var rcv []string
+	for body := range processed {
+		rcv = append(rcv, body)
+	}
+	if exp := []string{"1", "2", "3", "4"}; !reflect.DeepEqual(exp, rcv) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, rcv)
+	}
+}
+
+func TestEventSpoolCommandPending(t *testing.T) {
+	release := make(chan struct{})
+	var pending int32 = 1
+	sp := newEventSpool(1, 0, SpoolBlock, nil, nil, func() bool { return atomic.LoadInt32(&pending) == 0 },
+		func(_, _ string) { <-release })
+	for i := 1; i <= 4; i++ { // past capacity, never blocking while the command is pending
+		sp.push("", strconv.Itoa(i))
+	}
+	atomic.StoreInt32(&pending, 0)
+	pushed := make(chan struct{})
+	go func() {
+		sp.push("", "5")
+		close(pushed)
+	}()
+	select {
+	case <-pushed:
+		t.Fatal("Expected the push blocked by the full spool")
+	case <-time.After(20 * time.Millisecond):
+	}
+	atomic.StoreInt32(&pending, 1)
+	sp.wake()
+	select {
+	case <-pushed:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the push unblocked by the pending command")
+	}
+	close(release)
+	sp.stop()
+	if sp.enqueue("", "6") {
+		t.Error("Expected the enqueue refused once the feeding exited")
+	}
+}
@@ -0,0 +1,45 @@
+/*
+stall.go is released under the MIT License <http://www.opensource.org/licenses/mit-license.php
+Copyright (C) ITsysCOM. All Rights Reserved.
+
+Provides FreeSWITCH socket communication.
+*/
+package fsock
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// touchEvents records the reception of an event
+func (fs *FSock) touchEvents() {
+	atomic.StoreInt64(&fs.lastEventAt, fs.getClock().Now().UnixNano())
+}
+
+// watchStall reports the silences of the events longer than stallTimeout, until done is closed with the read loop
+func (fs *FSock) watchStall(done chan struct{}) {
+	interval := fs.stallTimeout / 4
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var reported int64 // lastEventAt of the silence already reported
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		last := atomic.LoadInt64(&fs.lastEventAt)
+		if last == reported || !fs.Connected() {
+			continue
+		}
+		if silence := fs.getClock().Now().Sub(time.Unix(0, last)); silence > fs.stallTimeout {
+			reported = last
+			if fs.onStall != nil {
+				fs.onStall(silence)
+			}
+		}
+	}
+}
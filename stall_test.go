@@ -0,0 +1,53 @@
+/*
+stall_test.go is released under the MIT License <http://www.opensource.org/licenses/mit-license.php
+Copyright (C) ITsysCOM. All Rights Reserved.
+
+Provides FreeSWITCH socket communication.
+*/
+package fsock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFSockWithStallDetection(t *testing.T) {
+	m := newFSMock(t)
+	stalls := make(chan time.Duration, 2)
+	fs := newMockedFSock(t, m, map[string][]func(string, int){
+		"HEARTBEAT": {func(string, int) {}},
+	}, WithStallDetection(40*time.Millisecond, func(silence time.Duration) { stalls <- silence }))
+	select {
+	case silence := <-stalls:
+		if silence <= 40*time.Millisecond {
+			t.Errorf("Expected silence over the timeout, received: %v", silence)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for the stall")
+	}
+	if !fs.Connected() {
+		t.Error("Expected the stalled socket to stay connected")
+	}
+	select {
+	case <-stalls:
+		t.Error("Expected the silence reported only once")
+	case <-time.After(100 * time.Millisecond):
+	}
+	m.sendEvent(0, "Event-Name: HEARTBEAT\n") // rearms the detection
+	select {
+	case <-stalls:
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for the second stall")
+	}
+}
+
+func TestFSockWithStallDetectionNoSubscriptions(t *testing.T) {
+	m := newFSMock(t)
+	stalls := make(chan time.Duration, 1)
+	newMockedFSock(t, m, nil, WithStallDetection(10*time.Millisecond, func(silence time.Duration) { stalls <- silence }))
+	select {
+	case <-stalls:
+		t.Error("Unexpected stall without subscriptions")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
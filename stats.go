@@ -0,0 +1,227 @@
+/*
+stats.go is released under the MIT License <http://www.opensource.org/licenses/mit-license.php
+Copyright (C) ITsysCOM. All Rights Reserved.
+
+Provides FreeSWITCH socket communication.
+*/
+package fsock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// latencySamples is the number of most recent replies the latency distribution is computed on
+const latencySamples = 1024
+
+// Stats is a snapshot of the connection counters
+type Stats struct {
+	Events           uint64        // events dispatched, sampled over time it gives the event throughput
+	DuplicateEvents  uint64        // events suppressed by the de-duplication window
+	Replies          uint64        // command replies received
+	ReplyLatencyP50  time.Duration // median command round-trip, over the last latencySamples replies
+	ReplyLatencyP95  time.Duration
+	ReplyLatencyMax  time.Duration
+	SpoolDropped     uint64        // events dropped by the full event spool
+	DroppedEvents    uint64        // events not delivered for backpressure: spool and pause overflow, duplicates, full NextEvent queue and unparsable json
+	TruncatedEvents  uint64        // events with the body truncated by WithMaxEventBodySize
+	SequenceGaps     uint64        // gaps in the Event-Sequence of the events read, with WithSequenceCheck
+	OutOfOrderEvents uint64        // events read with an Event-Sequence not above the previous one, with WithSequenceCheck
+	PauseDropped     uint64        // events dropped by the full pause buffer, with WithPauseBuffer
+	TimeToFirstEvent time.Duration // from the last connect to the first event read after it, 0 until then
+	URLDecodeErrors  uint64        // header values of the events parsed by the FSock failing to url-decode, kept as received
+}
+
+// fsockStats holds the counters of a connection
+type fsockStats struct {
+	sync.Mutex
+	Stats
+	latencies [latencySamples]time.Duration // ring of the last round-trips, populated up to Replies
+	connectAt time.Time                     // of the connection waiting for its first event, zero once received
+}
+
+// resetFirstEvent starts measuring the TimeToFirstEvent of the connection established at now
+func (st *fsockStats) resetFirstEvent(now time.Time) {
+	st.Lock()
+	st.connectAt = now
+	st.TimeToFirstEvent = 0
+	st.Unlock()
+}
+
+// addFirstEvent records the TimeToFirstEvent if the event read at now is the first one of the connection
+func (st *fsockStats) addFirstEvent(now time.Time) {
+	st.Lock()
+	if !st.connectAt.IsZero() {
+		st.TimeToFirstEvent = now.Sub(st.connectAt)
+		st.connectAt = time.Time{}
+	}
+	st.Unlock()
+}
+
+// addReplyLatency records the round-trip of one command
+func (st *fsockStats) addReplyLatency(d time.Duration) {
+	st.Lock()
+	st.latencies[st.Replies%latencySamples] = d
+	st.Replies++
+	st.Unlock()
+}
+
+// addSpoolDropped counts one event dropped by the event spool
+func (st *fsockStats) addSpoolDropped() {
+	st.Lock()
+	st.SpoolDropped++
+	st.DroppedEvents++
+	st.Unlock()
+}
+
+// addPauseDropped counts one event dropped by the full pause buffer
+func (st *fsockStats) addPauseDropped() {
+	st.Lock()
+	st.PauseDropped++
+	st.DroppedEvents++
+	st.Unlock()
+}
+
+// addDuplicate counts one event suppressed by the de-duplication
+func (st *fsockStats) addDuplicate() {
+	st.Lock()
+	st.DuplicateEvents++
+	st.DroppedEvents++
+	st.Unlock()
+}
+
+// addTruncated counts one event with the body truncated
+func (st *fsockStats) addTruncated() {
+	st.Lock()
+	st.TruncatedEvents++
+	st.Unlock()
+}
+
+// addSequenceGap counts one gap in the Event-Sequence
+func (st *fsockStats) addSequenceGap() {
+	st.Lock()
+	st.SequenceGaps++
+	st.Unlock()
+}
+
+// addOutOfOrder counts one event received out of its Event-Sequence order
+func (st *fsockStats) addOutOfOrder() {
+	st.Lock()
+	st.OutOfOrderEvents++
+	st.Unlock()
+}
+
+// addURLDecodeError counts one header value failing to url-decode
+func (st *fsockStats) addURLDecodeError() {
+	st.Lock()
+	st.URLDecodeErrors++
+	st.Unlock()
+}
+
+// addDropped counts one event dropped for any other backpressure reason
+func (st *fsockStats) addDropped() {
+	st.Lock()
+	st.DroppedEvents++
+	st.Unlock()
+}
+
+// Stats returns a snapshot of the connection counters
+func (fs *FSock) Stats() Stats {
+	fs.stats.Lock()
+	defer fs.stats.Unlock()
+	stats := fs.stats.Stats
+	n := stats.Replies
+	if n > latencySamples {
+		n = latencySamples
+	}
+	if n == 0 {
+		return stats
+	}
+	lats := make([]time.Duration, n)
+	copy(lats, fs.stats.latencies[:n])
+	sort.Slice(lats, func(i, j int) bool { return lats[i] < lats[j] })
+	stats.ReplyLatencyP50 = lats[percentileIdx(len(lats), 50)]
+	stats.ReplyLatencyP95 = lats[percentileIdx(len(lats), 95)]
+	stats.ReplyLatencyMax = lats[len(lats)-1]
+	return stats
+}
+
+// percentileIdx returns the nearest-rank index of the percentile p within n sorted samples
+func percentileIdx(n, p int) int {
+	idx := (n*p+99)/100 - 1
+	if idx < 0 {
+		idx = 0
+	}
+	return idx
+}
+
+// sequenceCheck remembers the highest Event-Sequence read on the connection
+type sequenceCheck struct {
+	sync.Mutex
+	last uint64 // 0 until the first event of the connection
+}
+
+// follow records the sequence, returning the highest one before it
+func (sc *sequenceCheck) follow(seq uint64) (last uint64) {
+	sc.Lock()
+	defer sc.Unlock()
+	last = sc.last
+	if seq > sc.last {
+		sc.last = seq
+	}
+	return
+}
+
+// reset forgets the sequence of the previous connection
+func (sc *sequenceCheck) reset() {
+	sc.Lock()
+	sc.last = 0
+	sc.Unlock()
+}
+
+// eventDedup remembers the keys of the recently dispatched events, within a time and size window
+type eventDedup struct {
+	sync.Mutex               // the events can be dispatched by concurrent parse workers
+	window     time.Duration // how long a key is remembered, 0 for no time limit
+	size       int           // maximum number of keys remembered, 0 for no size limit
+	seen       map[string]time.Time
+	order      []string // keys in the order they were seen, for eviction
+}
+
+func newEventDedup(window time.Duration, size int) *eventDedup {
+	return &eventDedup{window: window, size: size, seen: make(map[string]time.Time)}
+}
+
+// isDuplicate checks if the event with the given key was seen within the window, remembering it otherwise
+func (ed *eventDedup) isDuplicate(key string, now time.Time) bool {
+	ed.Lock()
+	defer ed.Unlock()
+	for len(ed.order) != 0 && // evict the expired keys
+		ed.window > 0 && now.Sub(ed.seen[ed.order[0]]) > ed.window {
+		delete(ed.seen, ed.order[0])
+		ed.order = ed.order[1:]
+	}
+	if _, has := ed.seen[key]; has {
+		return true
+	}
+	if ed.size > 0 && len(ed.order) >= ed.size {
+		delete(ed.seen, ed.order[0])
+		ed.order = ed.order[1:]
+	}
+	ed.seen[key] = now
+	ed.order = append(ed.order, key)
+	return false
+}
+
+// eventDedupKey identifies an event by its Event-UUID, falling back on Core-UUID and Event-Sequence
+func eventDedupKey(event string) string {
+	if evUUID := headerVal(event, "Event-UUID"); evUUID != "" {
+		return evUUID
+	}
+	coreUUID, evSeq := headerVal(event, "Core-UUID"), headerVal(event, "Event-Sequence")
+	if coreUUID == "" || evSeq == "" {
+		return ""
+	}
+	return coreUUID + ":" + evSeq
+}
@@ -0,0 +1,290 @@
+/*
+stats_test.go is released under the MIT License <http://www.opensource.org/licenses/mit-license.php
+Copyright (C) ITsysCOM. All Rights Reserved.
+
+Provides FreeSWITCH socket communication.
+*/
+package fsock
+
+import (
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStatsEventDedup(t *testing.T) {
+	m := newFSMock(t)
+	var answered int32
+	fs := newMockedFSock(t, m, map[string][]func(string, int){
+		"CHANNEL_ANSWER": {func(string, int) { atomic.AddInt32(&answered, 1) }},
+	}, WithEventDedup(time.Minute, 100))
+	ev := "Event-Name: CHANNEL_ANSWER\nCore-UUID: 792e181c\nEvent-Sequence: 34263\n"
+	m.sendEvent(0, ev)
+	m.sendEvent(0, ev) // relayed twice
+	m.sendEvent(0, "Event-Name: CHANNEL_ANSWER\nCore-UUID: 792e181c\nEvent-Sequence: 34264\n")
+	for i := 0; i < 100 && atomic.LoadInt32(&answered) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if rcv := atomic.LoadInt32(&answered); rcv != 2 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 2, rcv)
+	}
+	if rcv := fs.Stats().DuplicateEvents; rcv != 1 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 1, rcv)
+	}
+}
+
+func TestStatsSequenceCheck(t *testing.T) {
+	m := newFSMock(t)
+	handled := make(chan struct{}, 10)
+	fs := newMockedFSock(t, m, map[string][]func(string, int){
+		"CHANNEL_ANSWER": {func(string, int) { handled <- struct{}{} }},
+	}, WithSequenceCheck())
+	for _, seq := range []int{10, 11, 14, 15, 12} { // 12 and 13 missing, 12 arriving late
+		m.sendEvent(0, "Event-Name: CHANNEL_ANSWER\nEvent-Sequence: "+strconv.Itoa(seq)+"\n")
+	}
+	json := `{"Event-Name":"CHANNEL_ANSWER","Event-Sequence":"18"}`
+	m.write(0, "Content-Length: "+strconv.Itoa(len(json))+"\nContent-Type: text/event-json\n\n"+json)
+	for i := 0; i < 6; i++ {
+		select {
+		case <-handled:
+		case <-time.After(time.Second):
+			t.Fatal("Timeout waiting for the events")
+		}
+	}
+	if rcv := fs.Stats(); rcv.SequenceGaps != 2 || rcv.OutOfOrderEvents != 1 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "2 gaps, 1 out of order", rcv)
+	}
+	m.dropConn(0)
+	for i := 0; i < 100 && fs.Connected(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := fs.SendApiCmd("status"); err != nil { // reconnected
+		t.Fatal(err)
+	}
+	m.sendEvent(1, "Event-Name: CHANNEL_ANSWER\nEvent-Sequence: 40\n") // following again from the new connection
+	select {
+	case <-handled:
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for the event")
+	}
+	if rcv := fs.Stats().SequenceGaps; rcv != 2 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 2, rcv)
+	}
+}
+
+func TestStatsDroppedEvents(t *testing.T) {
+	m := newFSMock(t)
+	entered := make(chan string, 10)
+	release := make(chan struct{})
+	fs := newMockedFSock(t, m, map[string][]func(string, int){
+		"CUSTOM": {func(ev string, _ int) {
+			entered <- headerVal(ev, "Event-Sequence")
+			<-release
+		}},
+	}, WithEventSpool(2, 0, SpoolDropOldest, nil), WithEventDedup(time.Minute, 100))
+	ev := func(seq int) string {
+		return "Event-Name: CUSTOM\nCore-UUID: 792e181c\nEvent-Sequence: " + strconv.Itoa(seq) + "\n"
+	}
+	m.sendEvent(0, ev(1))
+	select {
+	case <-entered: // the slow handler holds the first event
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for the first event")
+	}
+	for i := 2; i <= 6; i++ { // 5 and 6 spooled, the older ones dropped
+		m.sendEvent(0, ev(i))
+	}
+	for i := 0; i < 100 && fs.Stats().SpoolDropped != 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(release)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-entered:
+		case <-time.After(time.Second):
+			t.Fatal("Timeout waiting for the spooled events")
+		}
+	}
+	m.sendEvent(0, ev(6)) // relayed twice
+	for i := 0; i < 100 && fs.Stats().DuplicateEvents != 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	stats := fs.Stats()
+	if stats.DroppedEvents != 4 || stats.SpoolDropped != 3 || stats.DuplicateEvents != 1 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "4 dropped, 3 by the spool and 1 duplicate", stats)
+	}
+	select {
+	case seq := <-entered:
+		t.Errorf("Unexpected event dispatched: %s", seq)
+	default:
+	}
+}
+
+func TestStatsPoolDroppedEvents(t *testing.T) {
+	m := newFSMock(t)
+	pool := NewFSockPool(2, m.addr(), "ClueCon", 0, time.Second, 0, fibDuration, nil, nil, nil, 0, false)
+	var fSocks []*FSock
+	for i := 0; i < 2; i++ {
+		fsk, err := pool.PopFSock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fsk.Disconnect()
+		fSocks = append(fSocks, fsk)
+	}
+	for i := 0; i < 3; i++ {
+		fSocks[0].stats.addDropped()
+	}
+	fSocks[1].stats.addSpoolDropped()
+	if rcv := pool.DroppedEvents(); rcv != 4 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 4, rcv)
+	}
+	for _, st := range pool.ConnectionStates() {
+		exp := uint64(1)
+		if st.ConnID == fSocks[0].ConnID() {
+			exp = 3
+		}
+		if st.DroppedEvents != exp {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, st.DroppedEvents)
+		}
+	}
+	fSocks[0].Disconnect()
+	pool.PushFSock(fSocks[0]) // replaced, its drops stay in the aggregate
+	if rcv := pool.DroppedEvents(); rcv != 4 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 4, rcv)
+	}
+	if rcv := len(pool.ConnectionStates()); rcv != 1 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 1, rcv)
+	}
+}
+
+func TestStatsEventDedupWindow(t *testing.T) {
+	now := time.Now()
+	ed := newEventDedup(time.Second, 2)
+	if ed.isDuplicate("a", now) {
+		t.Error("Expected first occurrence")
+	} else if !ed.isDuplicate("a", now.Add(500*time.Millisecond)) {
+		t.Error("Expected duplicate within the window")
+	} else if ed.isDuplicate("a", now.Add(2*time.Second)) {
+		t.Error("Expected expired out of the time window")
+	}
+	ed.isDuplicate("b", now.Add(2*time.Second))
+	ed.isDuplicate("c", now.Add(2*time.Second)) // evicts a out of the size window
+	if ed.isDuplicate("a", now.Add(2*time.Second)) {
+		t.Error("Expected evicted out of the size window")
+	}
+	if eventDedupKey("Event-Name: HEARTBEAT\n") != "" {
+		t.Error("Expected no key for events without identifiers")
+	} else if key := eventDedupKey("Event-Name: API\nEvent-UUID: 9f4d\n"); key != "9f4d" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "9f4d", key)
+	}
+}
+
+func TestStatsReplyLatency(t *testing.T) {
+	m := newFSMock(t)
+	m.apiReply = func(cmd string) string {
+		if cmd == "sleep" {
+			time.Sleep(50 * time.Millisecond)
+		}
+		return "+OK\n"
+	}
+	fs := newMockedFSock(t, m, nil)
+	base := fs.Stats().Replies // the connect commands
+	for i := 0; i < 38; i++ {
+		if _, err := fs.SendApiCmd("status"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := fs.SendApiCmd("sleep"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats := fs.Stats()
+	if stats.Replies != base+40 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", base+40, stats.Replies)
+	}
+	if stats.ReplyLatencyP50 >= 50*time.Millisecond {
+		t.Errorf("Expected p50 below the mock delay, received: %v", stats.ReplyLatencyP50)
+	}
+	if stats.ReplyLatencyMax < 50*time.Millisecond {
+		t.Errorf("Expected max reflecting the mock delay, received: %v", stats.ReplyLatencyMax)
+	}
+	if stats.ReplyLatencyP95 > stats.ReplyLatencyMax || stats.ReplyLatencyP95 < stats.ReplyLatencyP50 {
+		t.Errorf("Unordered percentiles: %+v", stats)
+	}
+}
+
+func TestStatsPercentileIdx(t *testing.T) {
+	for _, tc := range []struct{ n, p, exp int }{{1, 50, 0}, {1, 95, 0}, {20, 50, 9}, {20, 95, 18}, {100, 95, 94}} {
+		if rcv := percentileIdx(tc.n, tc.p); rcv != tc.exp {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", tc.exp, rcv)
+		}
+	}
+}
+
+func TestStatsTimeToFirstEvent(t *testing.T) {
+	m := newFSMock(t)
+	handled := make(chan struct{}, 2)
+	fs := newMockedFSock(t, m, map[string][]func(string, int){
+		"CHANNEL_ANSWER": {func(string, int) { handled <- struct{}{} }},
+	})
+	if rcv := fs.Stats().TimeToFirstEvent; rcv != 0 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 0, rcv)
+	}
+	time.Sleep(50 * time.Millisecond)
+	var ttfe time.Duration
+	for i := 0; i < 2; i++ {
+		m.sendEvent(0, "Event-Name: CHANNEL_ANSWER\n")
+		select {
+		case <-handled:
+		case <-time.After(time.Second):
+			t.Fatal("Timeout waiting for CHANNEL_ANSWER")
+		}
+		if i == 0 {
+			if ttfe = fs.Stats().TimeToFirstEvent; ttfe < 50*time.Millisecond || ttfe > time.Second {
+				t.Errorf("Unexpected TimeToFirstEvent: <%s>", ttfe)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	if rcv := fs.Stats().TimeToFirstEvent; rcv != ttfe { // the second event does not count
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ttfe, rcv)
+	}
+	fs.stats.resetFirstEvent(time.Now()) // as on reconnect
+	if rcv := fs.Stats().TimeToFirstEvent; rcv != 0 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 0, rcv)
+	}
+}
+
+func TestStatsURLDecodeErrors(t *testing.T) {
+	m := newFSMock(t)
+	offending := make(chan string, 2)
+	fs := newMockedFSock(t, m, nil, WithURLDecodeErrorHandler(func(hdrVal string, _ error) { offending <- hdrVal }))
+	other := newMockedFSock(t, newFSMock(t), nil)
+	rcv := make(chan *FSEvent, 1)
+	if err := fs.AddEventHandlerN("CUSTOM", 1, func(ev *FSEvent) { rcv <- ev }); err != nil {
+		t.Fatal(err)
+	}
+	m.sendEvent(0, "Event-Name: CUSTOM\nCaller-Caller-ID-Name: 100%zz\nVariable: a%20b\n")
+	select {
+	case ev := <-rcv:
+		if ev.Header("Caller-Caller-ID-Name") != "100%zz" || ev.Header("Variable") != "a b" {
+			t.Errorf("Unexpected event: %+v", ev.Headers)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for CUSTOM")
+	}
+	if hdrVal := <-offending; hdrVal != "100%zz" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "100%zz", hdrVal)
+	}
+	if rcv := fs.Stats().URLDecodeErrors; rcv != 1 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 1, rcv)
+	}
+	if rcv := other.Stats().URLDecodeErrors; rcv != 0 { // counted per connection
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 0, rcv)
+	}
+}
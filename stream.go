@@ -0,0 +1,219 @@
+/*
+stream.go is released under the MIT License <http://www.opensource.org/licenses/mit-license.php
+Copyright (C) ITsysCOM. All Rights Reserved.
+
+Provides FreeSWITCH socket communication.
+*/
+package fsock
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrStreamClosed is returned when reading the reply of SendApiCmdStream once closed
+var ErrStreamClosed = errors.New("Reply stream closed")
+
+// replyStream is the api/response body handed over by the read loop to SendApiCmdStream,
+// read straight off the socket until drained or closed
+type replyStream struct {
+	fs     *FSock
+	mu     sync.Mutex // serializes the reads with Close, after which the read loop owns the socket again
+	body   io.Reader  // the body left, limited to its Content-Length
+	closed bool
+	done   chan struct{} // closed with the stream, resuming the read loop
+}
+
+// Read reads the body, closing the stream once drained
+func (rs *replyStream) Read(p []byte) (n int, err error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.closed {
+		return 0, ErrStreamClosed
+	}
+	n, err = rs.body.Read(p)
+	if rs.fs.keepaliveInterval > 0 {
+		rs.fs.touchTraffic()
+	}
+	if err == io.EOF {
+		rs.close()
+	}
+	return
+}
+
+// Close gives the socket back to the read loop, which discards the body left
+func (rs *replyStream) Close() error {
+	rs.mu.Lock()
+	rs.close()
+	rs.mu.Unlock()
+	return nil
+}
+
+// close closes the stream, rs.mu being held
+func (rs *replyStream) close() {
+	if !rs.closed {
+		rs.closed = true
+		close(rs.done)
+	}
+}
+
+// streamReply is the SendApiCmdStream reader, buffered to check the reply for errors first
+type streamReply struct {
+	rdr    *bufio.Reader
+	rs     *replyStream
+	closed int32 // the buffered bytes are not returned either once closed
+}
+
+// Read reads the reply, ErrStreamClosed once closed
+func (sr *streamReply) Read(p []byte) (int, error) {
+	if atomic.LoadInt32(&sr.closed) == 1 {
+		return 0, ErrStreamClosed
+	}
+	return sr.rdr.Read(p)
+}
+
+// Close closes the reply stream
+func (sr *streamReply) Close() error {
+	atomic.StoreInt32(&sr.closed, 1)
+	return sr.rs.Close()
+}
+
+// SendApiCmdStream sends the api command as SendApiCmd, returning its reply as it is read off the socket once its
+// headers are received, so the large outputs (eg: show channels) are parsed as they arrive instead of buffered whole.
+// The read loop holds until the reply is drained or closed: the events and the other replies wait meanwhile,
+// so read it promptly and always close it. The replies starting with -ERR or -USAGE are returned as the error.
+// The command is not reported to OnCommand nor traced, its reply not being known.
+func (fs *FSock) SendApiCmdStream(cmdStr string) (rdr io.ReadCloser, err error) {
+	if !fs.initialized() {
+		return nil, ErrNotConnected
+	}
+	frame := "api " + fs.trimApiVerb(cmdStr) + "\n\n"
+	if fs.allowedCmds != nil && !fs.commandAllowed(frame) {
+		return nil, ErrCommandNotAllowed
+	}
+	if fs.dryRun != nil {
+		var rply string
+		if rply, err = fs.sendFrame(frame); err != nil {
+			return
+		}
+		return io.NopCloser(strings.NewReader(rply)), nil
+	}
+	if err = fs.ReconnectIfNeeded(); err != nil {
+		atomic.StoreInt32(&fs.lastCmdFailed, 1)
+		return
+	}
+	defer func() { atomic.StoreInt32(&fs.lastCmdFailed, boolToInt32(err != nil)) }()
+	atomic.AddInt32(&fs.pendingCmds, 1)
+	defer atomic.AddInt32(&fs.pendingCmds, -1)
+	fs.wakeSpool()
+	if !fs.noCmdMux {
+		fs.cmdMux.Lock() // released once the stream is received, the read loop holding the next replies anyway
+		defer fs.cmdMux.Unlock()
+	}
+	streamReq := make(chan *replyStream, 1)
+	fs.replyMux.Lock()
+	fs.streamReq = streamReq
+	fs.replyMux.Unlock()
+	sentAt := time.Now()
+	var repliesLost chan struct{}
+	if repliesLost, err = fs.sendCommand(frame); err != nil {
+		fs.cancelStream(streamReq)
+		return
+	}
+	var rs *replyStream
+	if rs, err = fs.waitStream(streamReq, repliesLost); err != nil {
+		return
+	}
+	fs.stats.addReplyLatency(time.Since(sentAt))
+	rply := &streamReply{rdr: bufio.NewReader(rs), rs: rs}
+	if start, _ := rply.rdr.Peek(len("-USAGE")); strings.HasPrefix(string(start), "-ERR") ||
+		strings.HasPrefix(string(start), "-USAGE") {
+		body, _ := io.ReadAll(rply)
+		rply.Close()
+		return nil, parseReplyError(string(body))
+	}
+	return rply, nil
+}
+
+// waitStream waits for the reply stream requested with streamReq, up to the reply timeout,
+// returning the error of the command replied by a command/reply instead
+func (fs *FSock) waitStream(streamReq chan *replyStream, repliesLost chan struct{}) (rs *replyStream, err error) {
+	var timeout <-chan time.Time
+	if d := fs.ReplyTimeout(); d > 0 {
+		tm := time.NewTimer(d)
+		defer tm.Stop()
+		timeout = tm.C
+	}
+	select {
+	case rs = <-streamReq:
+		return
+	case rply := <-fs.cmdChan: // not an api/response, eg: rejected as an unknown command
+		fs.cancelStream(streamReq)
+		if err = parseReplyError(rply); err == nil {
+			err = errors.New("Unexpected reply: <" + strings.TrimSpace(rply) + ">")
+		}
+		return
+	case <-repliesLost:
+		fs.cancelStream(streamReq)
+		return nil, ErrDisconnected
+	case <-timeout:
+	}
+	fs.replyMux.Lock()
+	defer fs.replyMux.Unlock()
+	switch {
+	case fs.streamReq != streamReq: // raced with the read loop taking it
+		return <-streamReq, nil
+	case fs.replyPending:
+		fs.streamReq = nil
+		<-fs.cmdChan
+		return nil, ErrReplyTimeout
+	}
+	fs.streamReq = nil
+	fs.staleReplies++
+	return nil, ErrReplyTimeout
+}
+
+// cancelStream withdraws the stream request not served
+func (fs *FSock) cancelStream(streamReq chan *replyStream) {
+	fs.replyMux.Lock()
+	if fs.streamReq == streamReq {
+		fs.streamReq = nil
+	}
+	fs.replyMux.Unlock()
+}
+
+// takeStream hands the api/response body of cl bytes over to the SendApiCmdStream waiting for it, if the reply
+// is its own and not the one of a timed out command. Called by the read loop, which owns the buffer.
+func (fs *FSock) takeStream(cl int) *replyStream {
+	fs.replyMux.Lock()
+	defer fs.replyMux.Unlock()
+	if fs.streamReq == nil || fs.staleReplies > 0 || fs.awaitingReplies == 0 {
+		return nil
+	}
+	fs.awaitingReplies--
+	rs := &replyStream{fs: fs, body: io.LimitReader(fs.buffer, int64(cl)), done: make(chan struct{})}
+	fs.streamReq <- rs // buffered, never blocks
+	fs.streamReq = nil
+	return rs
+}
+
+// holdForStream blocks the read loop until the reply stream is drained or closed, discarding the body left
+func (fs *FSock) holdForStream(rs *replyStream) error {
+	fs.fsMutex.RLock()
+	stopReadEvents := fs.stopReadEvents
+	fs.fsMutex.RUnlock()
+	select {
+	case <-rs.done:
+	case <-stopReadEvents: // the reads of the caller fail with the closed connection
+		return io.EOF
+	}
+	if _, err := io.Copy(io.Discard, rs.body); err != nil {
+		return fs.readBodyFailed(err)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+/*
+stream_test.go is released under the MIT License <http://www.opensource.org/licenses/mit-license.php
+Copyright (C) ITsysCOM. All Rights Reserved.
+
+Provides FreeSWITCH socket communication.
+*/
+package fsock
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreamSendApiCmdStream(t *testing.T) {
+	m := newFSMock(t)
+	first, rest := strings.Repeat("row\n", 1000), strings.Repeat("more\n", 1000)
+	release := make(chan struct{})
+	m.apiFrame = func(idx int, cmd string) bool {
+		switch cmd {
+		case "show big":
+			m.write(idx, fmt.Sprintf("Content-Type: api/response\nContent-Length: %d\n\n%s", len(first+rest), first))
+			<-release // the rest only written once the first part was read
+			m.write(idx, rest)
+			return true
+		case "slow":
+			time.Sleep(100 * time.Millisecond)
+			m.write(idx, "Content-Type: api/response\nContent-Length: 6\n\n+OK 1\n")
+			return true
+		}
+		return false
+	}
+	m.apiReply = func(cmd string) string {
+		if cmd == "bad" {
+			return "-ERR bad command\n"
+		}
+		return "+OK\n"
+	}
+	fs := newMockedFSock(t, m, nil, WithReplyTimeout(50*time.Millisecond))
+	rdr, err := fs.SendApiCmdStream("show big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(first))
+	if _, err = io.ReadFull(rdr, buf); err != nil {
+		t.Fatal(err)
+	} else if string(buf) != first {
+		t.Fatalf("Unexpected first part: %q", buf)
+	}
+	close(release)
+	if b, err := io.ReadAll(rdr); err != nil {
+		t.Fatal(err)
+	} else if string(b) != rest {
+		t.Fatalf("Unexpected rest: %q", b)
+	}
+	rdr.Close()
+	if rply, err := fs.SendApiCmd("status"); err != nil || rply != "+OK\n" {
+		t.Errorf("Unexpected reply: %q, %v", rply, err)
+	}
+
+	release = make(chan struct{})
+	close(release)
+	if rdr, err = fs.SendApiCmdStream("show big"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadFull(rdr, buf[:10]); err != nil {
+		t.Fatal(err)
+	}
+	rdr.Close() // the body left discarded by the read loop
+	if _, err = rdr.Read(buf); err != ErrStreamClosed {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrStreamClosed, err)
+	}
+	if rply, err := fs.SendApiCmd("status"); err != nil || rply != "+OK\n" {
+		t.Errorf("Unexpected reply: %q, %v", rply, err)
+	}
+
+	var rplyErr *ReplyError
+	if _, err = fs.SendApiCmdStream("bad"); !errors.As(err, &rplyErr) || rplyErr.Text != "bad command" {
+		t.Errorf("Unexpected error: <%v>", err)
+	}
+	if _, err = fs.SendApiCmdStream("slow"); err != ErrReplyTimeout {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrReplyTimeout, err)
+	}
+	time.Sleep(100 * time.Millisecond) // the late reply discarded
+	if rply, err := fs.SendApiCmd("status"); err != nil || rply != "+OK\n" {
+		t.Errorf("Unexpected reply: %q, %v", rply, err)
+	}
+	var nilFS *FSock
+	if _, err = nilFS.SendApiCmdStream("status"); err != ErrNotConnected {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrNotConnected, err)
+	}
+}
@@ -11,14 +11,23 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	mrand "math/rand"
 	"net/url"
+	"reflect"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"golang.org/x/text/encoding"
 )
 
 const EventBodyTag = "EvBody"
 
+// EventTruncatedHeader flags the events truncated by WithMaxEventBodySize, valued with their original size
+const EventTruncatedHeader = "FSock-Truncated-Size"
+
 type logger interface {
 	Alert(string) error
 	Close() error
@@ -42,6 +51,27 @@ func (nopLogger) Info(string) error    { return nil }
 func (nopLogger) Notice(string) error  { return nil }
 func (nopLogger) Warning(string) error { return nil }
 
+// decodeToUTF8 returns the converter of the text in the enc charset to UTF-8, passing the text as is if failing.
+// Not safe for concurrent use, the decoder keeping its state.
+func decodeToUTF8(enc encoding.Encoding) func(string) string {
+	dec := enc.NewDecoder()
+	return func(s string) string {
+		out, err := dec.String(s)
+		if err != nil {
+			return s
+		}
+		return out
+	}
+}
+
+// orNopLogger returns the nopLogger instead of the nil logger, the nil pointers wrapped as logger included
+func orNopLogger(l logger) logger {
+	if l == nil || (reflect.ValueOf(l).Kind() == reflect.Ptr && reflect.ValueOf(l).IsNil()) {
+		return nopLogger{}
+	}
+	return l
+}
+
 // Convert fseventStr into fseventMap
 func FSEventStrToMap(fsevstr string, headers []string) map[string]string {
 	fsevent := make(map[string]string)
@@ -59,6 +89,13 @@ func FSEventStrToMap(fsevstr string, headers []string) map[string]string {
 
 // Converts string received from fsock into a list of channel info, each represented in a map
 func MapChanData(chanInfoStr string) (chansInfoMap []map[string]string) {
+	chansInfoMap, _ = MapChanDataN(chanInfoStr, 0)
+	return
+}
+
+// MapChanDataN converts the show channels output as MapChanData, stopping after maxRows rows (0 for no limit),
+// so a runaway switch cannot exhaust the memory. truncated reports the rows left out.
+func MapChanDataN(chanInfoStr string, maxRows int) (chansInfoMap []map[string]string, truncated bool) {
 	chansInfoMap = make([]map[string]string, 0)
 	spltChanInfo := strings.Split(chanInfoStr, "\n")
 	if len(spltChanInfo) <= 4 {
@@ -70,6 +107,9 @@ func MapChanData(chanInfoStr string) (chansInfoMap []map[string]string) {
 		if len(hdrs) != len(chanInfo) {
 			continue
 		}
+		if maxRows > 0 && len(chansInfoMap) == maxRows {
+			return chansInfoMap, true
+		}
 		chnMp := make(map[string]string)
 		for iHdr, hdr := range hdrs {
 			chnMp[hdr] = chanInfo[iHdr]
@@ -80,20 +120,195 @@ func MapChanData(chanInfoStr string) (chansInfoMap []map[string]string) {
 }
 
 func EventToMap(event string) (result map[string]string) {
+	result, _ = eventToMap(event, urlDecode)
+	return
+}
+
+// EventToMapStrict is the strict version of EventToMap, erroring with the lines that cannot be parsed as headers
+func EventToMapStrict(event string) (map[string]string, error) {
+	result, malformed := eventToMap(event, urlDecode)
+	if len(malformed) != 0 {
+		return nil, fmt.Errorf("Malformed event headers: <%s>", strings.Join(malformed, ">, <"))
+	}
+	return result, nil
+}
+
+// eventToMap parses the event, the header values through parseVal, returning also the header lines it had to skip.
+// The body is sliced out of the event as is, the lines being walked by index instead of split.
+func eventToMap(event string, parseVal func(string) string) (result map[string]string, malformed []string) {
 	result = make(map[string]string)
 	body := false
-	spltevent := strings.Split(event, "\n")
-	for i := 0; i < len(spltevent); i++ {
-		if len(spltevent[i]) == 0 {
+	for start := 0; start <= len(event); {
+		end := strings.IndexByte(event[start:], '\n')
+		if end == -1 {
+			end = len(event)
+		} else {
+			end += start
+		}
+		line := event[start:end]
+		if len(line) == 0 {
 			body = true
+			start = end + 1
 			continue
 		}
 		if body {
-			result[EventBodyTag] = strings.Join(spltevent[i:], "\n")
+			result[EventBodyTag] = event[start:]
+			return
+		}
+		if idx := strings.Index(line, ": "); idx != -1 {
+			result[line[:idx]] = parseVal(strings.TrimSpace(line[idx+2:]))
+		} else {
+			malformed = append(malformed, line)
+		}
+		start = end + 1
+	}
+	return
+}
+
+// malformedHeaders returns the header lines without the ": " separator, up to the body if any,
+// scanning them as eventToMap without building the map nor decoding the values
+func malformedHeaders(hdrs string) (malformed []string) {
+	for len(hdrs) != 0 {
+		line := hdrs
+		if end := strings.IndexByte(hdrs, '\n'); end != -1 {
+			line, hdrs = hdrs[:end], hdrs[end+1:]
+		} else {
+			hdrs = ""
+		}
+		if len(line) == 0 { // the body follows
+			return
+		}
+		if !strings.Contains(line, ": ") {
+			malformed = append(malformed, line)
+		}
+	}
+	return
+}
+
+// truncateJSONEvent reads the json encoded event of size bytes out of r, keeping up to max bytes of its _body value.
+// The event stays valid json, flagged with the EventTruncatedHeader if its _body was cut.
+func truncateJSONEvent(r io.ByteReader, size, max int) (event string, truncated bool, err error) {
+	var out, str strings.Builder // str collects the string read outside _body, the next key if followed by ':'
+	var inStr, inBody, esc, isValue, keepUnit bool
+	var key string
+	var hexLeft, kept int
+	for i := 0; i < size; i++ {
+		var c byte
+		if c, err = r.ReadByte(); err != nil {
 			return
 		}
-		if val := strings.SplitN(spltevent[i], ": ", 2); len(val) == 2 {
-			result[val[0]] = urlDecode(strings.TrimSpace(val[1]))
+		if !inStr {
+			switch c {
+			case '"':
+				inStr, inBody = true, isValue && key == "_body"
+				isValue = false
+				str.Reset()
+			case ':':
+				key, isValue = str.String(), true
+			case ',':
+				isValue = false
+			}
+			out.WriteByte(c)
+			continue
+		}
+		unitStart := !esc && hexLeft == 0 // an escape sequence is kept or cut as a whole
+		switch {
+		case esc:
+			esc = false
+			if c == 'u' {
+				hexLeft = 4
+			}
+		case hexLeft > 0:
+			hexLeft--
+		case c == '\\':
+			esc = true
+		case c == '"':
+			inStr = false
+		}
+		if !inBody {
+			if inStr {
+				str.WriteByte(c)
+			}
+			out.WriteByte(c)
+			continue
+		}
+		if !inStr { // closing quote of _body
+			inBody = false
+			out.WriteByte(c)
+			continue
+		}
+		if unitStart {
+			keepUnit = kept < max
+			truncated = truncated || !keepUnit
+		}
+		if keepUnit {
+			out.WriteByte(c)
+			kept++
+		}
+	}
+	event = out.String()
+	if idx := strings.LastIndexByte(event, '}'); truncated && idx != -1 {
+		event = event[:idx] + `,"` + EventTruncatedHeader + `":"` + strconv.Itoa(size) + `"` + event[idx:]
+	}
+	return
+}
+
+// jsonEventToPlain converts a json encoded event into the plain format expected by the handlers
+func jsonEventToPlain(event string) (string, error) {
+	var evMap map[string]string
+	if err := json.Unmarshal([]byte(event), &evMap); err != nil {
+		return "", err
+	}
+	body, hasBody := evMap["_body"]
+	delete(evMap, "_body")
+	hdrs := make([]string, 0, len(evMap))
+	for hdr := range evMap {
+		hdrs = append(hdrs, hdr)
+	}
+	sort.Strings(hdrs)
+	var plain strings.Builder
+	for _, hdr := range hdrs {
+		plain.WriteString(hdr + ": " + url.QueryEscape(evMap[hdr]) + "\n")
+	}
+	if hasBody {
+		plain.WriteString("\n" + body)
+	}
+	return plain.String(), nil
+}
+
+// LogData is a FreeSWITCH log line received over the socket
+type LogData struct {
+	Level       int    // syslog level, 0 (console) to 7 (debug)
+	TextChannel string // Text-Channel header
+	File        string // originating file
+	Func        string // originating function
+	Line        int    // originating line
+	UserData    string // usually the UUID of the channel logging
+	Message     string
+}
+
+// parseLogData builds the LogData out of the log/data frame
+func parseLogData(hdr, body string) (ld *LogData) {
+	ld = &LogData{Message: body}
+	for _, strLn := range strings.Split(hdr, "\n") {
+		hdrVal := strings.SplitN(strLn, ": ", 2)
+		if len(hdrVal) != 2 {
+			continue
+		}
+		val := strings.TrimSpace(hdrVal[1])
+		switch hdrVal[0] {
+		case "Log-Level":
+			ld.Level, _ = strconv.Atoi(val)
+		case "Text-Channel":
+			ld.TextChannel = val
+		case "Log-File":
+			ld.File = val
+		case "Log-Func":
+			ld.Func = val
+		case "Log-Line":
+			ld.Line, _ = strconv.Atoi(val)
+		case "User-Data":
+			ld.UserData = val
 		}
 	}
 	return
@@ -145,6 +360,56 @@ func splitIgnoreGroups(s string, sep string) (sl []string) {
 	return
 }
 
+// headerValFold extracts the value of the header line matching hdr case-insensitively,
+// has is true also for a header line without value
+func headerValFold(hdrs, hdr string) (val string, has bool) {
+	for _, line := range strings.Split(hdrs, "\n") {
+		name := line
+		if idx := strings.IndexByte(line, ':'); idx != -1 {
+			name, val = line[:idx], line[idx+1:]
+		}
+		if strings.EqualFold(strings.TrimSpace(name), hdr) {
+			return strings.TrimSpace(val), true
+		}
+		val = ""
+	}
+	return
+}
+
+// splitPlainEvents splits the body of a text/event-plain frame batching several events separated by blank lines,
+// nil for a single event. The body of an event, which may hold blank lines, is skipped by its Content-Length
+// and each further event must start with its Event-Name header, so a single event is never mistaken for a batch.
+func splitPlainEvents(body string) (events []string) {
+	rest := body
+	for {
+		hdrsEnd := strings.Index(rest, "\n\n")
+		if hdrsEnd == -1 {
+			break
+		}
+		evEnd := hdrsEnd + 2
+		if cl, has := headerValFold(rest[:hdrsEnd], "Content-Length"); has {
+			n, err := strconv.Atoi(cl)
+			if err != nil || n < 0 || evEnd+n > len(rest) {
+				return nil
+			}
+			evEnd += n
+		}
+		next := strings.TrimLeft(rest[evEnd:], "\n")
+		if next == "" {
+			break
+		}
+		if !strings.HasPrefix(next, "Event-Name: ") {
+			return nil
+		}
+		events = append(events, rest[:evEnd])
+		rest = next
+	}
+	if len(events) == 0 {
+		return nil
+	}
+	return append(events, rest)
+}
+
 // Extracts value of a header from anywhere in content string
 func headerVal(hdrs, hdr string) string {
 	var hdrSIdx, hdrEIdx int
@@ -163,11 +428,34 @@ func headerVal(hdrs, hdr string) string {
 // FS event header values are urlencoded. Use this to decode them. On error, use original value
 func urlDecode(hdrVal string) string {
 	if valUnescaped, errUnescaping := url.QueryUnescape(hdrVal); errUnescaping == nil {
-		hdrVal = valUnescaped
+		return valUnescaped
 	}
 	return hdrVal
 }
 
+// writeFull writes b entirely, looping over the short writes without error which would otherwise
+// leave FreeSWITCH waiting for the rest of the command. A write making no progress is io.ErrShortWrite.
+func writeFull(w io.Writer, b []byte) (err error) {
+	for len(b) != 0 {
+		var n int
+		if n, err = w.Write(b); err != nil {
+			return
+		}
+		if n <= 0 {
+			return io.ErrShortWrite
+		}
+		b = b[n:]
+	}
+	return
+}
+
+func boolToInt32(b bool) int32 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
 func getMapKeys(m map[string][]func(string, int)) (keys []string) {
 	keys = make([]string, len(m))
 	indx := 0
@@ -185,15 +473,181 @@ func isSliceMember(ss []string, s string) bool {
 	return (i < len(ss) && ss[i] == s)
 }
 
+// Backoff computes the delays between the reconnect attempts
+type Backoff interface {
+	Next() time.Duration // returns the delay before the next attempt
+	Reset()              // restarts the delays from the beginning, called after a successful connect
+}
+
+// Clock provides the time to the reconnect loop, injectable for tests
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+}
+
+// systemClock is the default Clock
+type systemClock struct{}
+
+func (systemClock) Now() time.Time        { return time.Now() }
+func (systemClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+// BackoffPeeker is implemented by the Backoffs able to return their next delay without consuming it
+type BackoffPeeker interface {
+	Peek() time.Duration
+}
+
+// NewFibBackoff returns a Backoff with successive Fibonacci numbers of durationUnit, capped to maxDuration if positive
+func NewFibBackoff(durationUnit, maxDuration time.Duration) *FibBackoff {
+	return &FibBackoff{durationUnit: durationUnit, maxDuration: maxDuration, b: 1}
+}
+
+// FibBackoff is the default Fibonacci Backoff, safe for concurrent use
+type FibBackoff struct {
+	mux          sync.Mutex
+	durationUnit time.Duration
+	maxDuration  time.Duration
+	a, b         int
+}
+
+// Next returns the next Fibonacci number converted to time.Duration
+func (fb *FibBackoff) Next() time.Duration {
+	fb.mux.Lock()
+	defer fb.mux.Unlock()
+	fb.a, fb.b = fb.b, fb.a+fb.b
+	fibNrAsDuration := time.Duration(fb.a) * fb.durationUnit
+	if fb.maxDuration > 0 && fb.maxDuration < fibNrAsDuration {
+		return fb.maxDuration
+	}
+	return fibNrAsDuration
+}
+
+// Peek returns the delay the next call of Next will return
+func (fb *FibBackoff) Peek() time.Duration {
+	fb.mux.Lock()
+	defer fb.mux.Unlock()
+	fibNrAsDuration := time.Duration(fb.b) * fb.durationUnit
+	if fb.maxDuration > 0 && fb.maxDuration < fibNrAsDuration {
+		return fb.maxDuration
+	}
+	return fibNrAsDuration
+}
+
+// Reset restarts the sequence from the beginning
+func (fb *FibBackoff) Reset() {
+	fb.mux.Lock()
+	fb.a, fb.b = 0, 1
+	fb.mux.Unlock()
+}
+
+// Jitter magnitudes for NewJitterBackoff
+const (
+	JitterFull  = 1.0 // delays spread between 0 and the wrapped delay
+	JitterEqual = 0.5 // delays spread between half and the full wrapped delay
+)
+
+// NewJitterBackoff wraps the Backoff, randomizing each of its delays down by at most magnitude (0 to 1) of it,
+// so the clients reconnecting at the same time spread out
+func NewJitterBackoff(b Backoff, magnitude float64) *JitterBackoff {
+	if magnitude < 0 {
+		magnitude = 0
+	} else if magnitude > 1 {
+		magnitude = 1
+	}
+	return &JitterBackoff{b: b, magnitude: magnitude, rnd: mrand.New(mrand.NewSource(time.Now().UnixNano()))}
+}
+
+// JitterBackoff randomizes the delays of another Backoff, safe for concurrent use
+type JitterBackoff struct {
+	mux       sync.Mutex
+	b         Backoff
+	magnitude float64
+	rnd       *mrand.Rand
+	peeked    time.Duration // the jittered delay returned by Peek, returned by the next Next
+	hasPeeked bool
+}
+
+// Next returns the next delay of the wrapped Backoff, reduced with a random jitter
+func (jb *JitterBackoff) Next() time.Duration {
+	d := jb.b.Next()
+	jb.mux.Lock()
+	defer jb.mux.Unlock()
+	if jb.hasPeeked {
+		jb.hasPeeked = false
+		return jb.peeked
+	}
+	return jb.jitter(d)
+}
+
+// Peek returns the delay the next call of Next will return, 0 if the wrapped Backoff does not implement BackoffPeeker
+func (jb *JitterBackoff) Peek() time.Duration {
+	peeker, canPeek := jb.b.(BackoffPeeker)
+	if !canPeek {
+		return 0
+	}
+	jb.mux.Lock()
+	defer jb.mux.Unlock()
+	if !jb.hasPeeked {
+		jb.peeked, jb.hasPeeked = jb.jitter(peeker.Peek()), true
+	}
+	return jb.peeked
+}
+
+// jitter reduces the delay with a random jitter, under mux
+func (jb *JitterBackoff) jitter(d time.Duration) time.Duration {
+	maxJitter := int64(float64(d) * jb.magnitude)
+	if maxJitter <= 0 {
+		return d
+	}
+	return d - time.Duration(jb.rnd.Int63n(maxJitter+1))
+}
+
+// Reset resets the wrapped Backoff
+func (jb *JitterBackoff) Reset() {
+	jb.b.Reset()
+	jb.mux.Lock()
+	jb.hasPeeked = false
+	jb.mux.Unlock()
+}
+
+// delayFuncBackoff adapts the delay functions given to NewFSock to a Backoff able to peek, computing each delay ahead
+type delayFuncBackoff struct {
+	mux      sync.Mutex
+	newDelay func() func() time.Duration // creates the delay function, again on Reset
+	delay    func() time.Duration
+	next     time.Duration
+}
+
+// newDelayFuncBackoff returns the Backoff computing its delays with the functions created by newDelay
+func newDelayFuncBackoff(newDelay func() func() time.Duration) (db *delayFuncBackoff) {
+	db = &delayFuncBackoff{newDelay: newDelay}
+	db.Reset()
+	return
+}
+
+// Next returns the delay computed ahead, computing the following one
+func (db *delayFuncBackoff) Next() (d time.Duration) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	d, db.next = db.next, db.delay()
+	return
+}
+
+// Peek returns the delay the next call of Next will return
+func (db *delayFuncBackoff) Peek() time.Duration {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	return db.next
+}
+
+// Reset creates the delay function again, restarting the delays from the beginning
+func (db *delayFuncBackoff) Reset() {
+	db.mux.Lock()
+	db.delay = db.newDelay()
+	db.next = db.delay()
+	db.mux.Unlock()
+}
+
 // fibDuration returns successive Fibonacci numbers converted to time.Duration.
 func fibDuration(durationUnit, maxDuration time.Duration) func() time.Duration {
-	a, b := 0, 1
-	return func() time.Duration {
-		a, b = b, a+b
-		fibNrAsDuration := time.Duration(a) * durationUnit
-		if maxDuration > 0 && maxDuration < fibNrAsDuration {
-			return maxDuration
-		}
-		return fibNrAsDuration
-	}
+	return NewFibBackoff(durationUnit, maxDuration).Next
 }
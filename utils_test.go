@@ -7,11 +7,14 @@ Provides FreeSWITCH socket communication.
 package fsock
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"reflect"
 	"sort"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestSplitIgnoreGroups(t *testing.T) {
@@ -98,6 +101,55 @@ func TestEventToMapFiltered(t *testing.T) {
 	}
 }
 
+// eventToMapSplitJoin is the split and join implementation eventToMap replaced, to compare the outputs with
+func eventToMapSplitJoin(event string) (result map[string]string, malformed []string) {
+	result = make(map[string]string)
+	body := false
+	spltevent := strings.Split(event, "\n")
+	for i := 0; i < len(spltevent); i++ {
+		if len(spltevent[i]) == 0 {
+			body = true
+			continue
+		}
+		if body {
+			result[EventBodyTag] = strings.Join(spltevent[i:], "\n")
+			return
+		}
+		if val := strings.SplitN(spltevent[i], ": ", 2); len(val) == 2 {
+			result[val[0]] = urlDecode(strings.TrimSpace(val[1]))
+		} else {
+			malformed = append(malformed, spltevent[i])
+		}
+	}
+	return
+}
+
+func TestEventToMapSameAsSplitJoin(t *testing.T) {
+	for _, event := range []string{
+		"",
+		"\n",
+		"\n\n",
+		"Event-Name: CUSTOM",
+		"Event-Name: CUSTOM\n",
+		"Event-Name: CUSTOM\nContent-Length: 5\n\nhello",
+		"Event-Name: CUSTOM\nContent-Length: 6\n\nhello\n",
+		"Event-Name: CUSTOM\n\n\n\nbody\n\nafter blank\n",
+		"Event-Name: CUSTOM\nmalformed line\nCaller-Caller-ID-Name: John%20Doe\nEmpty: \nColons: a: b: c\n\nbody",
+		"\nbody only",
+		BODY,
+		largeBodyEvent,
+	} {
+		expMap, expMalformed := eventToMapSplitJoin(event)
+		rcvMap, rcvMalformed := eventToMap(event, urlDecode)
+		if !reflect.DeepEqual(expMap, rcvMap) || !reflect.DeepEqual(expMalformed, rcvMalformed) {
+			t.Errorf("%q: \nExpected: <%+v, %q>, \nReceived: <%+v, %q>", event, expMap, expMalformed, rcvMap, rcvMalformed)
+		}
+		if rcv := malformedHeaders(event); !reflect.DeepEqual(expMalformed, rcv) { // the scan of the frame headers
+			t.Errorf("%q: \nExpected: <%q>, \nReceived: <%q>", event, expMalformed, rcv)
+		}
+	}
+}
+
 func TestMapChanData(t *testing.T) {
 	chanInfoStr := `uuid,direction,created,created_epoch,name,state,cid_name,cid_num,ip_addr,dest,application,application_data,dialplan,context,read_codec,read_rate,read_bit_rate,write_codec,write_rate,write_bit_rate,secure,hostname,presence_id,presence_data,callstate,callee_name,callee_num,callee_direction,call_uuid,sent_callee_name,sent_callee_num
 fed464b3-a328-453f-9437-92b9b6a400fd,inbound,2014-10-26 18:08:32,1414343312,sofia/ipbxas/dan@172.16.254.66,CS_EXECUTE,dan,dan,172.16.254.66,+4986517174963,,,XML,ipbxas,PCMA,8000,64000,PCMA,8000,64000,,iPBXDev,dan@172.16.254.66,,HELD,,,,fed464b3-a328-453f-9437-92b9b6a400fd,,
@@ -540,6 +592,27 @@ func TestUtilsMapChanDataContinue(t *testing.T) {
 	}
 }
 
+func TestUtilsMapChanDataN(t *testing.T) {
+	infoStr := "uuid,state\n"
+	for i := 0; i < 5; i++ {
+		infoStr += fmt.Sprintf("uuid%d,CS_EXECUTE\n", i)
+	}
+	infoStr += "\n5 total.\n"
+	rows, truncated := MapChanDataN(infoStr, 3)
+	if !truncated {
+		t.Error("Expected the truncation reported")
+	}
+	if exp := []map[string]string{{"uuid": "uuid0", "state": "CS_EXECUTE"}, {"uuid": "uuid1", "state": "CS_EXECUTE"},
+		{"uuid": "uuid2", "state": "CS_EXECUTE"}}; !reflect.DeepEqual(exp, rows) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, rows)
+	}
+	for _, maxRows := range []int{0, 5} { // all the rows fitting
+		if rows, truncated = MapChanDataN(infoStr, maxRows); truncated || len(rows) != 5 {
+			t.Errorf("maxRows %d: \nExpected: <%+v, %+v>, \nReceived: <%+v, %+v>", maxRows, 5, false, len(rows), truncated)
+		}
+	}
+}
+
 func TestUtilsgenUUID(t *testing.T) {
 	uuid := genUUID()
 	if len(uuid) == 0 {
@@ -637,3 +710,214 @@ func BenchmarkHeaderVal(b *testing.B) {
 		headerVal(BODY, "Event-Date-Loca")
 	}
 }
+
+func BenchmarkEventToMap(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		EventToMap(BODY)
+	}
+}
+
+// largeBodyEvent is a CUSTOM event carrying a body of 64KB on many lines
+var largeBodyEvent = "Event-Name: CUSTOM\nEvent-Subclass: conference%3A%3Amaintenance\nContent-Length: 65536\n\n" +
+	strings.Repeat(strings.Repeat("x", 63)+"\n", 1024)
+
+func BenchmarkEventToMapLargeBody(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		EventToMap(largeBodyEvent)
+	}
+}
+
+func BenchmarkEventToMapLargeBodySplitJoin(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		eventToMapSplitJoin(largeBodyEvent)
+	}
+}
+
+func BenchmarkEventToMapNoURLDecode(b *testing.B) {
+	fs := &FSock{rawHdrVals: true} // as WithURLDecode(false)
+	for i := 0; i < b.N; i++ {
+		fs.eventMap(BODY)
+	}
+}
+
+func TestUtilsURLDecodeErrors(t *testing.T) {
+	ev := EventToMap("Event-Name: CUSTOM\nCaller-Caller-ID-Name: 100%zz\nVariable: a%20b\n")
+	if exp := "100%zz"; ev["Caller-Caller-ID-Name"] != exp {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, ev["Caller-Caller-ID-Name"])
+	} else if exp := "a b"; ev["Variable"] != exp {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, ev["Variable"])
+	}
+}
+
+func TestUtilsJSONEventToPlain(t *testing.T) {
+	event := `{"Event-Name":"CUSTOM","Event-Subclass":"conference::maintenance","Caller-Caller-ID-Name":"John Doe","_body":"body data"}`
+	exp := "Caller-Caller-ID-Name: John+Doe\nEvent-Name: CUSTOM\nEvent-Subclass: conference%3A%3Amaintenance\n\nbody data"
+	if rcv, err := jsonEventToPlain(event); err != nil {
+		t.Error(err)
+	} else if rcv != exp {
+		t.Errorf("\nExpected: %q, \nReceived: %q", exp, rcv)
+	}
+	if _, err := jsonEventToPlain("Event-Name: HEARTBEAT"); err == nil {
+		t.Error("Expected error for non json event")
+	}
+}
+
+func TestUtilsTruncateJSONEvent(t *testing.T) {
+	event := `{"Event-Name":"CUSTOM","_body":"ab\u00e9cd\"ef","Job-UUID":"x:y"}`
+	exp := `{"Event-Name":"CUSTOM","_body":"ab\u00e9","Job-UUID":"x:y","` + EventTruncatedHeader + `":"` + fmt.Sprint(len(event)) + `"}`
+	rcv, truncated, err := truncateJSONEvent(strings.NewReader(event), len(event), 3) // the escape sequence kept whole
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !truncated || rcv != exp {
+		t.Errorf("\nExpected: %q, \nReceived: %q", exp, rcv)
+	}
+	if _, err = jsonEventToPlain(rcv); err != nil {
+		t.Error(err)
+	}
+	if rcv, truncated, err = truncateJSONEvent(strings.NewReader(event), len(event), 20); err != nil {
+		t.Error(err)
+	} else if truncated || rcv != event {
+		t.Errorf("\nExpected: %q, \nReceived: %q", event, rcv)
+	}
+	if _, _, err = truncateJSONEvent(strings.NewReader(event), len(event)+1, 3); err == nil {
+		t.Error("Expected error for the short event")
+	}
+}
+
+func TestUtilsSplitPlainEvents(t *testing.T) {
+	withBody := "Event-Name: CUSTOM\nContent-Length: 20\n\nline1\n\nEvent-Name: x" // the body looking like a batch
+	if rcv := splitPlainEvents(withBody); rcv != nil {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%q>", nil, rcv)
+	}
+	batch := "Event-Name: HEARTBEAT\nCore-UUID: a\n\n" + withBody + "\n\nEvent-Name: CHANNEL_ANSWER\n\n"
+	if exp, rcv := []string{"Event-Name: HEARTBEAT\nCore-UUID: a\n\n", withBody,
+		"Event-Name: CHANNEL_ANSWER\n\n"}, splitPlainEvents(batch); !reflect.DeepEqual(exp, rcv) {
+		t.Errorf("\nExpected: <%q>, \nReceived: <%q>", exp, rcv)
+	}
+	for _, body := range []string{
+		"Event-Name: HEARTBEAT\nCore-UUID: a\n\n",
+		"Event-Name: HEARTBEAT\n\nnot an event\n",                             // no Event-Name after the blank line
+		"Event-Name: CUSTOM\nContent-Length: 100\n\nshort\n\nEvent-Name: x\n", // Content-Length past the frame
+		"Event-Name: CUSTOM\nContent-Length: x\n\nEvent-Name: x\n",
+	} {
+		if rcv := splitPlainEvents(body); rcv != nil {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%q>", nil, rcv)
+		}
+	}
+}
+
+func TestUtilsFibBackoff(t *testing.T) {
+	fb := NewFibBackoff(time.Second, 0)
+	exp := []time.Duration{time.Second, time.Second, 2 * time.Second, 3 * time.Second, 5 * time.Second, 8 * time.Second}
+	rcv := make([]time.Duration, len(exp))
+	for i := range rcv {
+		rcv[i] = fb.Next()
+	}
+	if !reflect.DeepEqual(exp, rcv) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, rcv)
+	}
+	fb.Reset()
+	if d := fb.Next(); d != time.Second {
+		t.Errorf("Expected sequence restarted, received: %v", d)
+	}
+
+	fb = NewFibBackoff(time.Second, 4*time.Second)
+	exp = []time.Duration{time.Second, time.Second, 2 * time.Second, 3 * time.Second, 4 * time.Second, 4 * time.Second}
+	for i := range rcv {
+		rcv[i] = fb.Next()
+	}
+	if !reflect.DeepEqual(exp, rcv) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, rcv)
+	}
+}
+
+func TestUtilsJitterBackoff(t *testing.T) {
+	for _, magnitude := range []float64{JitterFull, JitterEqual, 0.1} {
+		fb := NewFibBackoff(time.Second, 0)
+		jb := NewJitterBackoff(NewFibBackoff(time.Second, 0), magnitude)
+		var spread bool
+		for i := 0; i < 30; i++ {
+			d, jd := fb.Next(), jb.Next()
+			if min := d - time.Duration(float64(d)*magnitude); jd < min || jd > d {
+				t.Fatalf("Delay %v out of the jittered range [%v, %v]", jd, min, d)
+			}
+			spread = spread || jd != d
+		}
+		if !spread {
+			t.Errorf("Expected jittered delays for magnitude %v", magnitude)
+		}
+	}
+	jb := NewJitterBackoff(NewFibBackoff(time.Second, 0), 0)
+	for i := 0; i < 5; i++ {
+		jb.Next()
+	}
+	jb.Reset()
+	if d := jb.Next(); d != time.Second {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", time.Second, d)
+	}
+	jb = NewJitterBackoff(NewFibBackoff(time.Second, 0), JitterFull)
+	for i := 0; i < 10; i++ {
+		if peeked, peekedAgain := jb.Peek(), jb.Peek(); peeked != peekedAgain {
+			t.Fatalf("\nExpected: <%+v>, \nReceived: <%+v>", peeked, peekedAgain)
+		} else if d := jb.Next(); d != peeked {
+			t.Fatalf("\nExpected: <%+v>, \nReceived: <%+v>", peeked, d)
+		}
+	}
+	if d := NewJitterBackoff(new(backoffMock), JitterFull).Peek(); d != 0 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 0, d)
+	}
+}
+
+func TestUtilsDelayFuncBackoff(t *testing.T) {
+	db := newDelayFuncBackoff(func() func() time.Duration { return fibDuration(time.Second, 0) })
+	var rcv []time.Duration
+	for i := 0; i < 4; i++ {
+		peeked := db.Peek()
+		if d := db.Next(); d != peeked {
+			t.Fatalf("\nExpected: <%+v>, \nReceived: <%+v>", peeked, d)
+		}
+		rcv = append(rcv, peeked)
+	}
+	if exp := []time.Duration{time.Second, time.Second, 2 * time.Second, 3 * time.Second}; !reflect.DeepEqual(exp, rcv) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, rcv)
+	}
+	db.Reset()
+	if d := db.Peek(); d != time.Second {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", time.Second, d)
+	}
+}
+
+// shortWriter writes at most max bytes per call, without error
+type shortWriter struct {
+	buf   bytes.Buffer
+	max   int
+	calls int
+}
+
+func (w *shortWriter) Write(b []byte) (int, error) {
+	w.calls++
+	if len(b) > w.max {
+		b = b[:w.max]
+	}
+	return w.buf.Write(b)
+}
+
+func TestUtilsWriteFull(t *testing.T) {
+	cmd := "api originate {origination_uuid=abc}user/1001 &park\n\n"
+	w := &shortWriter{max: 4}
+	if err := writeFull(w, []byte(cmd)); err != nil {
+		t.Fatal(err)
+	}
+	if rcv := w.buf.String(); rcv != cmd {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", cmd, rcv)
+	}
+	if exp := (len(cmd) + 3) / 4; w.calls != exp {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, w.calls)
+	}
+	if err := writeFull(&shortWriter{}, []byte(cmd)); err != io.ErrShortWrite { // no progress
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", io.ErrShortWrite, err)
+	}
+}
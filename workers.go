@@ -0,0 +1,148 @@
+/*
+workers.go is released under the MIT License <http://www.opensource.org/licenses/mit-license.php
+Copyright (C) ITsysCOM. All Rights Reserved.
+
+Provides FreeSWITCH socket communication.
+*/
+package fsock
+
+import (
+	"hash/fnv"
+	"strings"
+	"sync"
+)
+
+// eventWorkersQueue is the number of frames buffered per worker before the read loop blocks
+const eventWorkersQueue = 1024
+
+// eventFrame is an event frame as read from the socket
+type eventFrame struct {
+	hdr  string
+	body string
+}
+
+// eventWorkers parses and dispatches the event frames out of the read loop.
+// The frames of one channel always go to the same worker so their order is preserved.
+type eventWorkers struct {
+	queues []chan eventFrame
+	wg     sync.WaitGroup
+}
+
+// newEventWorkers starts n workers processing the frames with process
+func newEventWorkers(n int, process func(hdr, body string)) (ew *eventWorkers) {
+	ew = &eventWorkers{queues: make([]chan eventFrame, n)}
+	ew.wg.Add(n)
+	for i := range ew.queues {
+		ew.queues[i] = make(chan eventFrame, eventWorkersQueue)
+		go func(q chan eventFrame) {
+			defer ew.wg.Done()
+			for frm := range q {
+				process(frm.hdr, frm.body)
+			}
+		}(ew.queues[i])
+	}
+	return
+}
+
+// submit queues the frame on the worker of its channel
+func (ew *eventWorkers) submit(hdr, body string) {
+	h := fnv.New32a()
+	h.Write([]byte(frameChannelKey(hdr, body)))
+	ew.queues[h.Sum32()%uint32(len(ew.queues))] <- eventFrame{hdr: hdr, body: body}
+}
+
+// stop waits for the workers to process the queued frames and exit
+func (ew *eventWorkers) stop() {
+	for _, q := range ew.queues {
+		close(q)
+	}
+	ew.wg.Wait()
+}
+
+// frameChannelKey returns the Unique-ID of the channel the frame refers to, without parsing the whole event.
+// Events without channel return an empty key.
+func frameChannelKey(hdr, body string) string {
+	if strings.Contains(hdr, "text/event-json") {
+		idx := strings.Index(body, `"Unique-ID"`)
+		if idx == -1 {
+			return ""
+		}
+		val := strings.TrimLeft(body[idx+len(`"Unique-ID"`):], " \t\r\n:")
+		if !strings.HasPrefix(val, `"`) {
+			return ""
+		}
+		if end := strings.IndexByte(val[1:], '"'); end != -1 {
+			return val[1 : end+1]
+		}
+		return ""
+	}
+	for rest := body; rest != ""; {
+		line := rest
+		if idx := strings.IndexByte(rest, '\n'); idx != -1 {
+			line, rest = rest[:idx], rest[idx+1:]
+		} else {
+			rest = ""
+		}
+		if line == "" { // end of headers
+			break
+		}
+		if strings.HasPrefix(line, "Unique-ID: ") {
+			return strings.TrimSpace(line[len("Unique-ID: "):])
+		}
+	}
+	return ""
+}
+
+// handlerLimiter bounds the handler goroutines running per event name, queuing the others in arrival order
+type handlerLimiter struct {
+	max    int
+	mu     sync.Mutex
+	events map[string]*limitedEvent
+}
+
+// limitedEvent is the state of the handlers of one event name
+type limitedEvent struct {
+	running int
+	queue   []func()
+}
+
+func newHandlerLimiter(max int) *handlerLimiter {
+	return &handlerLimiter{max: max, events: make(map[string]*limitedEvent)}
+}
+
+// run starts the handler if under the limit of the event name, otherwise queues it for the running ones
+func (hl *handlerLimiter) run(eventName string, handler func()) {
+	hl.mu.Lock()
+	le, has := hl.events[eventName]
+	if !has {
+		le = new(limitedEvent)
+		hl.events[eventName] = le
+	}
+	if le.running >= hl.max {
+		le.queue = append(le.queue, handler)
+		hl.mu.Unlock()
+		return
+	}
+	le.running++
+	hl.mu.Unlock()
+	go hl.work(eventName, le, handler)
+}
+
+// work runs the handler, then the queued ones of the event name until none is left
+func (hl *handlerLimiter) work(eventName string, le *limitedEvent, handler func()) {
+	for {
+		handler()
+		hl.mu.Lock()
+		if len(le.queue) == 0 {
+			if le.running--; le.running == 0 {
+				delete(hl.events, eventName)
+			}
+			hl.mu.Unlock()
+			return
+		}
+		handler = le.queue[0]
+		le.queue[0] = nil
+		le.queue = le.queue[1:]
+		hl.mu.Unlock()
+	}
+}
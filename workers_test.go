@@ -0,0 +1,158 @@
+/*
+workers_test.go is released under the MIT License <http://www.opensource.org/licenses/mit-license.php
+Copyright (C) ITsysCOM. All Rights Reserved.
+
+Provides FreeSWITCH socket communication.
+*/
+package fsock
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWorkersFrameChannelKey(t *testing.T) {
+	for _, tc := range []struct {
+		hdr, body, exp string
+	}{
+		{"Content-Type: text/event-plain\n", "Event-Name: CHANNEL_ANSWER\nOther-Leg-Unique-ID: 4ca6ef1a\nUnique-ID: 4c882cc4\n", "4c882cc4"},
+		{"Content-Type: text/event-plain\n", "Event-Name: HEARTBEAT\nCore-UUID: 651a8db2\n\nUnique-ID: body", ""},
+		{"Content-Type: text/event-json\n", "{\n\t\"Event-Name\":\t\"CHANNEL_ANSWER\",\n\t\"Unique-ID\":\t\"4c882cc4\"\n}", "4c882cc4"},
+		{"Content-Type: text/event-json\n", `{"Event-Name":"HEARTBEAT"}`, ""},
+	} {
+		if rcv := frameChannelKey(tc.hdr, tc.body); rcv != tc.exp {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", tc.exp, rcv)
+		}
+	}
+}
+
+func TestWorkersOrdering(t *testing.T) {
+	var mux sync.Mutex
+	seqs := make(map[string][]int)
+	ew := newEventWorkers(4, func(hdr, body string) {
+		ev := EventToMap(body)
+		seq, _ := strconv.Atoi(ev["Event-Sequence"])
+		mux.Lock()
+		seqs[ev["Unique-ID"]] = append(seqs[ev["Unique-ID"]], seq)
+		mux.Unlock()
+	})
+	for i := 0; i < 1000; i++ {
+		ew.submit("Content-Type: text/event-plain\n",
+			fmt.Sprintf("Event-Name: CHANNEL_STATE\nUnique-ID: uuid%d\nEvent-Sequence: %d\n", i%10, i))
+	}
+	ew.stop()
+	if len(seqs) != 10 {
+		t.Fatalf("Expected 10 channels, received: %d", len(seqs))
+	}
+	for uuid, chSeqs := range seqs {
+		if len(chSeqs) != 100 {
+			t.Errorf("Expected 100 events for %s, received: %d", uuid, len(chSeqs))
+		}
+		for i := 1; i < len(chSeqs); i++ {
+			if chSeqs[i] < chSeqs[i-1] {
+				t.Fatalf("Out of order events for %s: %v", uuid, chSeqs)
+			}
+		}
+	}
+}
+
+func TestWorkersWithParseWorkers(t *testing.T) {
+	m := newFSMock(t)
+	var mux sync.Mutex
+	var received []string
+	fs := newMockedFSock(t, m, map[string][]func(string, int){
+		"CHANNEL_STATE": {func(ev string, _ int) {
+			mux.Lock()
+			received = append(received, headerVal(ev, "Unique-ID"))
+			mux.Unlock()
+		}},
+	}, WithParseWorkers(2))
+	var events strings.Builder
+	for i := 0; i < 20; i++ {
+		body := fmt.Sprintf("Event-Name: CHANNEL_STATE\nUnique-ID: uuid%d\n", i%4)
+		fmt.Fprintf(&events, "Content-Length: %d\nContent-Type: text/event-plain\n\n%s", len(body), body)
+	}
+	m.write(0, events.String())
+	for i := 0; i < 100 && fs.Stats().Events < 20; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if rcv := fs.Stats().Events; rcv != 20 {
+		t.Fatalf("\nExpected: <%+v>, \nReceived: <%+v>", 20, rcv)
+	}
+	for i := 0; i < 100; i++ {
+		mux.Lock()
+		n := len(received)
+		mux.Unlock()
+		if n == 20 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("Expected 20 events handled, received: %d", len(received))
+}
+
+func benchmarkReadEvents(b *testing.B, opts ...FSockOption) {
+	m := newFSMock(b)
+	fs := newMockedFSock(b, m, map[string][]func(string, int){
+		"CHANNEL_STATE": {func(string, int) {}},
+	}, opts...)
+	var events strings.Builder
+	for i := 0; i < b.N; i++ {
+		body := fmt.Sprintf("Event-Name: CHANNEL_STATE\nCore-UUID: 651a8db2-4f67-4cf3-b4c0-b5fd2b8a7a11\n"+
+			"Unique-ID: 4c882cc4-cd02-11e6-8b82-%012d\nChannel-State: CS_EXECUTE\nChannel-Name: sofia/internal/1001%%40192.168.56.74\n"+
+			"Event-Sequence: %d\n", i%64, i)
+		fmt.Fprintf(&events, "Content-Length: %d\nContent-Type: text/event-plain\n\n%s", len(body), body)
+	}
+	base := fs.Stats().Events
+	b.ResetTimer()
+	m.write(0, events.String())
+	for fs.Stats().Events-base < uint64(b.N) {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func BenchmarkWorkersInline(b *testing.B) {
+	benchmarkReadEvents(b)
+}
+
+func BenchmarkWorkersOffloaded(b *testing.B) {
+	benchmarkReadEvents(b, WithParseWorkers(4))
+}
+
+func TestFSockWithHandlerConcurrency(t *testing.T) {
+	const events, limit = 100, 3
+	var running, maxRunning, handled int32
+	done := make(chan struct{})
+	m := newFSMock(t)
+	newMockedFSock(t, m, map[string][]func(string, int){
+		"CHANNEL_ANSWER": {func(string, int) {
+			cur := atomic.AddInt32(&running, 1)
+			for prev := atomic.LoadInt32(&maxRunning); cur > prev; prev = atomic.LoadInt32(&maxRunning) {
+				if atomic.CompareAndSwapInt32(&maxRunning, prev, cur) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&running, -1)
+			if atomic.AddInt32(&handled, 1) == events {
+				close(done)
+			}
+		}},
+	}, WithHandlerConcurrency(limit))
+	for i := 0; i < events; i++ {
+		m.sendEvent(0, fmt.Sprintf("Event-Name: CHANNEL_ANSWER\nUnique-ID: %d\n", i))
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Handled %d out of %d events", atomic.LoadInt32(&handled), events)
+	}
+	if maxRun := atomic.LoadInt32(&maxRunning); maxRun > limit {
+		t.Errorf("Expected at most %d handlers running at once, received: %d", limit, maxRun)
+	}
+}